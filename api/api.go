@@ -0,0 +1,390 @@
+// Package api is the reader api: the readers verify the cards, ask for the
+// card keys and enroll new cards. The same methods answer over http and mqtt.
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"server/events"
+	"server/metrics"
+	"server/ratelimit"
+	"server/store"
+)
+
+type (
+	KeyRequest struct {
+		ApiKey       string `json:"apikey"`
+		SerialNumber string `json:"serialnumber"`
+		Write        bool   `json:"write"`
+	}
+	KeyAnswer struct {
+		Ok  bool   `json:"ok"`
+		Key string `json:"key"`
+	}
+	VerifyRequest struct {
+		ApiKey       string `json:"apikey"`
+		Authtoken    string `json:"authtoken"`
+		SerialNumber string `json:"serialnumber"`
+	}
+	VerifyAnswer struct {
+		Ok         bool   `json:"ok"`
+		Name       string `json:"name"`
+		Permission string `json:"perm"`
+		// the new authtoken of the card with the rolling authtokens, the
+		// reader writes it on the card
+		Authtoken string `json:"authtoken,omitempty"`
+	}
+	AddCardRequest struct {
+		ApiKey       string `json:"apikey"`
+		SerialNumber string `json:"serialnumber"`
+	}
+	AddCardAnswer struct {
+		Ok        bool   `json:"ok"`
+		Authtoken string `json:"authtoken"`
+		WriteKey  string `json:"writekey"`
+		ReadKey   string `json:"readkey"`
+	}
+)
+
+// Answer is what every reader api answer has
+type Answer interface {
+	ok() bool
+}
+
+func (a VerifyAnswer) ok() bool  { return a.Ok }
+func (a KeyAnswer) ok() bool     { return a.Ok }
+func (a AddCardAnswer) ok() bool { return a.Ok }
+
+// Result is the result label of the api metrics
+func Result(ans Answer, err error) string {
+	switch {
+	case err != nil:
+		return metrics.BadRequest
+	case ans.ok():
+		return metrics.Ok
+	default:
+		return metrics.Denied
+	}
+}
+
+type (
+	// KeySizes are the lengths of the generated card keys in random bytes
+	KeySizes struct {
+		ReadKey   int
+		WriteKey  int
+		Authtoken int
+	}
+	Config struct {
+		Store  store.Store
+		Events *events.Bus  // nil publishes nowhere
+		Log    *slog.Logger // slog.Default() if nil
+		Keys   KeySizes
+		// Limits are the rate limits of the api keys and the addresses, and
+		// the blocks of the readers with too many bad authtokens. nil
+		// limits nothing.
+		Limits *ratelimit.Limiter
+		// Rolling gives the card a new authtoken on every granted verify,
+		// the previous one is still taken for Grace after the roll. An
+		// older one than that is a cloned card, it gets suspended.
+		Rolling bool
+		Grace   time.Duration
+	}
+	// Server answers the reader requests, it is the http.Handler of the
+	// /api/ pages: the requests and their openapi document
+	Server struct {
+		Store   store.Store
+		Events  *events.Bus
+		Log     *slog.Logger
+		Keys    KeySizes
+		Limits  *ratelimit.Limiter
+		Rolling bool
+		Grace   time.Duration
+
+		mux     *http.ServeMux
+		replays replays
+	}
+)
+
+// Endpoints are the reader requests, /api/request/{endpoint}
+var Endpoints = []string{"verify", "key", "addCard"}
+
+func New(c Config) *Server {
+	s := &Server{
+		Store:   c.Store,
+		Events:  c.Events,
+		Log:     c.Log,
+		Keys:    c.Keys,
+		Limits:  c.Limits,
+		Rolling: c.Rolling,
+		Grace:   c.Grace,
+		mux:     http.NewServeMux(),
+	}
+	if s.Log == nil {
+		s.Log = slog.Default()
+	}
+	if s.Events == nil {
+		s.Events = &events.Bus{}
+	}
+	if s.Limits == nil {
+		s.Limits = ratelimit.New(ratelimit.Config{})
+	}
+	s.mux.Handle("POST /api/request/verify", jsonAPI(handler(s, "verify", s.Verify)))
+	s.mux.Handle("POST /api/request/key", jsonAPI(handler(s, "key", s.Key)))
+	s.mux.Handle("POST /api/request/addCard", jsonAPI(handler(s, "addCard", s.AddCard)))
+	s.mux.HandleFunc("GET /api/openapi.yaml", serveSpecYAML)
+	s.mux.HandleFunc("GET /api/openapi.json", serveSpecJSON)
+	s.mux.HandleFunc("GET /api/docs", serveDocs)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handler decodes the json request, runs fn and writes its answer. A
+// request that can't be decoded or isn't valid gets 400, a too long one 413,
+// one over the rate limits 429, one of a blocked reader 403 and one without
+// the signature its reader needs 401. fn only gets the valid and admitted
+// requests.
+func handler[Req Request, Ans Answer](s *Server, endpoint string, fn func(context.Context, Req) Ans) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var ans Ans
+		body, err := io.ReadAll(r.Body)
+		var request Req
+		if err == nil {
+			request, err = Decode[Req](bytes.NewReader(body))
+		}
+		if err != nil {
+			s.Log.WarnContext(r.Context(), "bad api request", "endpoint", endpoint, "err", err)
+			metrics.Request("http", endpoint, Result(ans, err), start)
+			code := http.StatusBadRequest
+			var tooLong *http.MaxBytesError
+			if errors.As(err, &tooLong) {
+				code = http.StatusRequestEntityTooLarge
+			}
+			writeError(w, code, err)
+			return
+		}
+		err = s.Admit(request, remoteIP(r))
+		if err != nil {
+			s.Log.WarnContext(r.Context(), "api request refused", "endpoint", endpoint, "err", err)
+			metrics.Request("http", endpoint, metrics.Refused, start)
+			refuse(w, err)
+			return
+		}
+		err = s.signature(r.Context(), request.apiKey(), r.Header, body)
+		if err != nil {
+			metrics.Request("http", endpoint, metrics.Refused, start)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		ans = fn(r.Context(), request)
+		metrics.Request("http", endpoint, Result(ans, nil), start)
+		js, err := json.Marshal(ans)
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
+
+// addLog writes the access log and publishes the event, event is one of the
+// events types. A failed write is logged and returned, its event isn't
+// published: the granting handlers refuse the request then, the others only
+// lose the entry.
+func (s *Server) addLog(ctx context.Context, event string, e store.LogEntry) error {
+	_, err := s.Store.AddLog(ctx, e)
+	if err != nil {
+		metrics.TxError(err)
+		s.Log.ErrorContext(ctx, "failed to write the access log", "event", event, "reader", e.Reader.Int64, "err", err)
+		return err
+	}
+	// sql.NullString and friends would end up as objects in the json
+	plain := func(v driver.Valuer) any {
+		v2, _ := v.Value()
+		return v2
+	}
+	s.Events.Publish(events.Event{
+		Type:      event,
+		Card:      plain(e.Card),
+		Reader:    plain(e.Reader),
+		Person:    plain(e.Person),
+		Allowed:   e.Allowed,
+		Direction: plain(e.Direction),
+		Comment:   plain(e.Comment),
+	})
+	return nil
+}
+
+func (s *Server) Verify(ctx context.Context, request VerifyRequest) VerifyAnswer {
+	reader, err := s.Store.ReaderByKey(ctx, request.ApiKey)
+	if err != nil {
+		s.Log.WarnContext(ctx, "verify: bad api key", "serial", request.SerialNumber, "err", err)
+		s.addLog(ctx, events.Alarm, store.LogEntry{Card: store.Null(request.SerialNumber)})
+		return VerifyAnswer{}
+	}
+	card, err := s.Store.Card(ctx, request.SerialNumber)
+	var person store.Person
+	if err == nil {
+		person, err = s.Store.Person(ctx, card.Owner)
+	}
+	var next string
+	if err == nil {
+		next, err = s.authtoken(ctx, card, request.Authtoken)
+	}
+	if err != nil {
+		s.Log.InfoContext(ctx, "verify: denied, bad serial number or authtoken", "serial", request.SerialNumber, "reader", reader.Id, "err", err)
+		var comment string
+		if errors.Is(err, errSuspended) || errors.Is(err, errExpired) || errors.Is(err, errCloned) || errors.Is(err, errRolled) {
+			comment = err.Error()
+		}
+		s.addLog(ctx, events.Denied, store.LogEntry{Card: store.Null(request.SerialNumber), Reader: store.Int(reader.Id), Direction: store.Null(reader.Direction), Comment: store.Null(comment)})
+		switch {
+		case errors.Is(err, errBadToken):
+			s.badToken(ctx, reader, request.SerialNumber)
+		case errors.Is(err, errCloned):
+			s.suspend(ctx, reader, card)
+		}
+		return VerifyAnswer{}
+	}
+	err = s.addLog(ctx, events.Granted, store.LogEntry{Card: store.Null(request.SerialNumber), Reader: store.Int(reader.Id), Person: store.Int(person.Id), Allowed: true, Direction: store.Null(reader.Direction)})
+	if err != nil {
+		return VerifyAnswer{}
+	}
+	s.Log.InfoContext(ctx, "verify: granted", "serial", request.SerialNumber, "reader", reader.Id, "person", person.Id)
+	return VerifyAnswer{
+		Ok:         true,
+		Name:       person.Name,
+		Permission: person.Permission,
+		Authtoken:  next,
+	}
+}
+
+func (s *Server) Key(ctx context.Context, request KeyRequest) KeyAnswer {
+	reader, err := s.Store.ReaderByKey(ctx, request.ApiKey)
+	if err != nil {
+		s.Log.WarnContext(ctx, "key: bad api key", "serial", request.SerialNumber, "err", err)
+		s.addLog(ctx, events.Alarm, store.LogEntry{Comment: store.Null("key request denied wrong api key")})
+		return KeyAnswer{}
+	}
+	card, err := s.Store.Card(ctx, request.SerialNumber)
+	if err != nil {
+		s.Log.InfoContext(ctx, "key: unknown card", "serial", request.SerialNumber, "reader", reader.Id, "err", err)
+		s.addLog(ctx, events.Denied, store.LogEntry{Card: store.Null(request.SerialNumber), Reader: store.Int(reader.Id), Comment: store.Null("scan failed")})
+		return KeyAnswer{}
+	}
+	// the keys of a likely cloned card would let the copy be rewritten
+	if card.Suspended {
+		s.Log.InfoContext(ctx, "key: card suspended", "serial", request.SerialNumber, "reader", reader.Id)
+		s.addLog(ctx, events.Denied, store.LogEntry{Card: store.Null(request.SerialNumber), Reader: store.Int(reader.Id), Person: store.Int(card.Owner), Comment: store.Null(errSuspended.Error())})
+		return KeyAnswer{}
+	}
+	ans := KeyAnswer{
+		Ok:  true,
+		Key: "",
+	}
+	if request.Write {
+		if reader.WriteCard {
+			ans.Key = card.WriteKey
+		} else {
+			ans.Ok = false
+			ans.Key = ""
+		}
+	} else {
+		ans.Key = card.ReadKey
+	}
+	event := events.Key
+	if !ans.Ok {
+		event = events.Denied
+	}
+	err = s.addLog(ctx, event, store.LogEntry{Card: store.Null(request.SerialNumber), Reader: store.Int(reader.Id), Allowed: ans.Ok, Comment: store.Null(fmt.Sprintf("writekey value was: %v", request.Write))})
+	if err != nil {
+		return KeyAnswer{}
+	}
+	s.Log.InfoContext(ctx, "key: answered", "serial", request.SerialNumber, "reader", reader.Id, "write", request.Write, "ok", ans.Ok)
+	return ans
+}
+
+// RandomKey is n random bytes in unpadded base64
+func RandomKey(n int) string {
+	key := make([]byte, n)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawStdEncoding.EncodeToString(key)
+}
+
+func (s *Server) AddCard(ctx context.Context, request AddCardRequest) AddCardAnswer {
+	reader, err := s.Store.ReaderByKey(ctx, request.ApiKey)
+	if err != nil {
+		s.Log.WarnContext(ctx, "addCard: bad api key", "serial", request.SerialNumber, "err", err)
+		s.addLog(ctx, events.Alarm, store.LogEntry{Comment: store.Null("addcard request denied wrong api key")})
+		return AddCardAnswer{}
+	}
+	if !reader.AddCard {
+		s.Log.InfoContext(ctx, "addCard: reader can't add cards", "reader", reader.Id)
+		s.addLog(ctx, events.Denied, store.LogEntry{Reader: store.Int(reader.Id), Comment: store.Null("card add permission denied")})
+		return AddCardAnswer{}
+	}
+	ans := AddCardAnswer{
+		Ok:        true,
+		ReadKey:   RandomKey(s.Keys.ReadKey),
+		WriteKey:  RandomKey(s.Keys.WriteKey),
+		Authtoken: RandomKey(s.Keys.Authtoken),
+	}
+	// the new cards belong to nobody (person 0) until an admin assigns them
+	err = s.Store.AddCard(ctx, store.Card{SerialNumber: request.SerialNumber, Authtoken: ans.Authtoken, WriteKey: ans.WriteKey, ReadKey: ans.ReadKey})
+	if err != nil {
+		s.Log.ErrorContext(ctx, "addCard: failed to add card", "serial", request.SerialNumber, "err", err)
+		s.addLog(ctx, events.Denied, store.LogEntry{Reader: store.Int(reader.Id), Comment: store.Null("failed to add card")})
+		return AddCardAnswer{}
+	}
+	s.Log.InfoContext(ctx, "addCard: card added", "serial", request.SerialNumber, "reader", reader.Id)
+	// the card is saved with these keys, without them it couldn't be used
+	// nor added again: it is answered even if the entry is lost
+	s.addLog(ctx, events.Enrolled, store.LogEntry{Card: store.Null(request.SerialNumber), Reader: store.Int(reader.Id), Person: store.Int(0), Allowed: ans.Ok, Comment: store.Null("added card")})
+	return ans
+}
+
+// WatchReaders publishes a reader_offline event when a reader that was seen
+// goes quiet for longer than offline
+func (s *Server) WatchReaders(ticker *time.Ticker, done chan bool, offline time.Duration) {
+	quietReaders := make(map[int64]bool)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		readers, err := s.Store.ListReaders(context.Background())
+		if err != nil {
+			s.Log.Error("reader watch", "err", err)
+			continue
+		}
+		for _, r := range readers {
+			if r.LastSeen.IsZero() {
+				continue
+			}
+			quiet := time.Since(r.LastSeen) > offline
+			if quiet && !quietReaders[r.Id] {
+				s.Log.Warn("reader offline", "reader", r.Id)
+				s.Events.Publish(events.Event{Type: events.ReaderOffline, Reader: r.Id, Comment: "reader offline"})
+			}
+			quietReaders[r.Id] = quiet
+		}
+	}
+}
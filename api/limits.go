@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"server/events"
+	"server/ratelimit"
+	"server/store"
+)
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Admit takes a token of the address and of the api key of the request, the
+// error is ratelimit.Limited or ratelimit.Blocked. The mqtt requests have no
+// address.
+func (s *Server) Admit(request Request, ip string) error {
+	if ip != "" {
+		err := s.Limits.Allow(ratelimit.Key{Kind: ratelimit.IP, Value: ip})
+		if err != nil {
+			return err
+		}
+	}
+	return s.Limits.Allow(ratelimit.Key{Kind: ratelimit.ApiKey, Value: request.apiKey()})
+}
+
+// refuse answers the error of Admit, the Retry-After is in whole seconds
+func refuse(w http.ResponseWriter, err error) {
+	var limited ratelimit.Limited
+	var blocked ratelimit.Blocked
+	switch {
+	case errors.As(err, &limited):
+		w.Header().Set("Retry-After", seconds(limited.RetryAfter))
+		writeError(w, http.StatusTooManyRequests, errors.New("too many requests"))
+	case errors.As(err, &blocked):
+		w.Header().Set("Retry-After", seconds(time.Until(blocked.Until)))
+		writeError(w, http.StatusForbidden, fmt.Errorf("blocked until %s", blocked.Until.UTC().Format(time.RFC3339)))
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// badToken counts a bad authtoken of the reader, too many of them block its
+// api key for a while. The block is an alarm.
+func (s *Server) badToken(ctx context.Context, reader store.Reader, serial string) {
+	reason := fmt.Sprintf("reader %d: %d bad authtokens in %v", reader.Id, s.Limits.Failures, s.Limits.Window)
+	b, blocked := s.Limits.Fail(ratelimit.Key{Kind: ratelimit.ApiKey, Value: reader.ApiKey}, reason)
+	if !blocked {
+		return
+	}
+	s.Log.WarnContext(ctx, "reader blocked", "reader", reader.Id, "serial", serial, "until", b.Until)
+	s.addLog(ctx, events.Alarm, store.LogEntry{Card: store.Null(serial), Reader: store.Int(reader.Id), Comment: store.Null("reader blocked until " + b.Until.Format(time.DateTime) + ", too many bad authtokens")})
+}
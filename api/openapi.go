@@ -0,0 +1,202 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	htmltemplate "html/template"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	//go:embed openapi.yaml
+	openapiYAML []byte
+	//go:embed docs.html
+	docsHTML string
+)
+
+type (
+	// Spec is the part of the openapi document the docs and the tests use
+	Spec struct {
+		Info struct {
+			Title       string `yaml:"title"`
+			Version     string `yaml:"version"`
+			Description string `yaml:"description"`
+		} `yaml:"info"`
+		Paths      map[string]map[string]Operation `yaml:"paths"`
+		Components struct {
+			Schemas   map[string]Schema   `yaml:"schemas"`
+			Responses map[string]Response `yaml:"responses"`
+		} `yaml:"components"`
+	}
+	Operation struct {
+		OperationId string `yaml:"operationId"`
+		Summary     string `yaml:"summary"`
+		Description string `yaml:"description"`
+		RequestBody struct {
+			Content map[string]Media `yaml:"content"`
+		} `yaml:"requestBody"`
+		Responses map[string]Response `yaml:"responses"`
+	}
+	Response struct {
+		Ref         string           `yaml:"$ref"`
+		Description string           `yaml:"description"`
+		Headers     map[string]Media `yaml:"headers"`
+		Content     map[string]Media `yaml:"content"`
+	}
+	Media struct {
+		Schema   Schema `yaml:"schema"`
+		Example  any    `yaml:"example"`
+		Examples map[string]struct {
+			Value any `yaml:"value"`
+		} `yaml:"examples"`
+	}
+	Schema struct {
+		Ref                  string            `yaml:"$ref"`
+		Type                 string            `yaml:"type"`
+		Description          string            `yaml:"description"`
+		Pattern              string            `yaml:"pattern"`
+		MinLength            int               `yaml:"minLength"`
+		Required             []string          `yaml:"required"`
+		Properties           map[string]Schema `yaml:"properties"`
+		AdditionalProperties *bool             `yaml:"additionalProperties"`
+		Default              any               `yaml:"default"`
+	}
+)
+
+// LoadSpec parses the openapi document served at /api/openapi.yaml
+func LoadSpec() (*Spec, error) {
+	var s Spec
+	err := yaml.Unmarshal(openapiYAML, &s)
+	return &s, err
+}
+
+// Schema follows the $ref of the schema, the refs of the properties stay
+func (s *Spec) Schema(schema Schema) Schema {
+	for schema.Ref != "" {
+		schema = s.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// Response follows the $ref of the response
+func (s *Spec) Response(r Response) Response {
+	for r.Ref != "" {
+		r = s.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	}
+	return r
+}
+
+func serveSpecYAML(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openapiYAML)
+}
+
+// the json of the document is made once from the yaml
+var openapiJSON = func() []byte {
+	var doc any
+	err := yaml.Unmarshal(openapiYAML, &doc)
+	if err != nil {
+		panic(err)
+	}
+	js, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return js
+}()
+
+func serveSpecJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapiJSON)
+}
+
+// field is a row of the field tables of the docs
+type field struct {
+	Name        string
+	Type        string
+	Required    bool
+	Pattern     string
+	Description string
+}
+
+func (s *Spec) fields(schema Schema) []field {
+	schema = s.Schema(schema)
+	fields := make([]field, 0, len(schema.Properties))
+	for _, name := range slices.Sorted(maps.Keys(schema.Properties)) {
+		p := s.Schema(schema.Properties[name])
+		desc := schema.Properties[name].Description
+		if desc == "" {
+			desc = p.Description
+		}
+		fields = append(fields, field{name, p.Type, slices.Contains(schema.Required, name), p.Pattern, desc})
+	}
+	return fields
+}
+
+func pretty(v any) string {
+	js, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(js)
+}
+
+var docsTemplate = htmltemplate.Must(htmltemplate.New("docs").Funcs(htmltemplate.FuncMap{"pretty": pretty}).Parse(docsHTML))
+
+// serveDocs is the html page of the openapi document
+func serveDocs(w http.ResponseWriter, r *http.Request) {
+	spec, err := LoadSpec()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type endpoint struct {
+		Path, Method string
+		Operation
+		Request  []field
+		Example  any
+		Answer   []field
+		Examples map[string]any
+		Errors   map[string]string
+	}
+	var endpoints []endpoint
+	for _, path := range slices.Sorted(maps.Keys(spec.Paths)) {
+		for _, method := range slices.Sorted(maps.Keys(spec.Paths[path])) {
+			op := spec.Paths[path][method]
+			request := op.RequestBody.Content["application/json"]
+			answer := spec.Response(op.Responses["200"]).Content["application/json"]
+			e := endpoint{
+				Path:      path,
+				Method:    strings.ToUpper(method),
+				Operation: op,
+				Request:   spec.fields(request.Schema),
+				Example:   request.Example,
+				Answer:    spec.fields(answer.Schema),
+				Examples:  make(map[string]any),
+				Errors:    make(map[string]string),
+			}
+			for name, ex := range answer.Examples {
+				e.Examples[name] = ex.Value
+			}
+			for code, res := range op.Responses {
+				if code != "200" {
+					e.Errors[code] = spec.Response(res).Description
+				}
+			}
+			endpoints = append(endpoints, e)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = docsTemplate.Execute(w, struct {
+		Spec      *Spec
+		Endpoints []endpoint
+	}{spec, endpoints})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"server/store"
+)
+
+// MaxBody is the longest request body in bytes, a request is a few short
+// strings
+const MaxBody = 4 << 10
+
+// ErrorAnswer is the json body of the http errors of the requests
+type ErrorAnswer struct {
+	Error string `json:"error"`
+}
+
+// serialNumber is the uid of the card in hex, 4 to 10 bytes, with or
+// without colons between the bytes: 04:a1:b2:c3 or 04A1B2C3
+var serialNumber = regexp.MustCompile(`^([0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){3,9}|([0-9a-fA-F]{2}){4,10})$`)
+
+// Request is what every reader api request has, the requests that aren't
+// valid don't get to the handlers
+type Request interface {
+	validate() error
+	apiKey() string
+}
+
+func (r VerifyRequest) apiKey() string  { return r.ApiKey }
+func (r KeyRequest) apiKey() string     { return r.ApiKey }
+func (r AddCardRequest) apiKey() string { return r.ApiKey }
+
+// Reader is the reader of the api key of the request, ErrNotFound if the key
+// is of no reader
+func (s *Server) Reader(ctx context.Context, request Request) (store.Reader, error) {
+	return s.Store.ReaderByKey(ctx, request.apiKey())
+}
+
+func validKey(apiKey string) error {
+	if apiKey == "" {
+		return errors.New("no apikey")
+	}
+	return nil
+}
+
+func validSerial(serial string) error {
+	if !serialNumber.MatchString(serial) {
+		return fmt.Errorf("bad serialnumber %q", serial)
+	}
+	return nil
+}
+
+func (r VerifyRequest) validate() error {
+	err := errors.Join(validKey(r.ApiKey), validSerial(r.SerialNumber))
+	if r.Authtoken == "" {
+		err = errors.Join(err, errors.New("no authtoken"))
+	}
+	return err
+}
+
+func (r KeyRequest) validate() error {
+	return errors.Join(validKey(r.ApiKey), validSerial(r.SerialNumber))
+}
+
+func (r AddCardRequest) validate() error {
+	return errors.Join(validKey(r.ApiKey), validSerial(r.SerialNumber))
+}
+
+// Decode reads one json request from body, the unknown fields, anything
+// after the json and the invalid fields are errors
+func Decode[Req Request](body io.Reader) (Req, error) {
+	var request Req
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&request)
+	if err != nil {
+		return request, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return request, errors.New("data after the json request")
+	}
+	return request, request.validate()
+}
+
+// writeError answers an ErrorAnswer with the status code
+func writeError(w http.ResponseWriter, code int, err error) {
+	js, _ := json.Marshal(ErrorAnswer{strings.ReplaceAll(err.Error(), "\n", "; ")})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(js)
+}
+
+// jsonAPI lets through the json requests, charset utf-8 or none, up to
+// MaxBody bytes. The others get 415.
+func jsonAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err == nil && mediaType != "application/json" {
+			err = fmt.Errorf("content type %s isn't application/json", mediaType)
+		}
+		if charset, ok := params["charset"]; err == nil && ok && !strings.EqualFold(charset, "utf-8") {
+			err = fmt.Errorf("charset %s isn't utf-8", charset)
+		}
+		if err != nil {
+			writeError(w, http.StatusUnsupportedMediaType, err)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBody)
+		next.ServeHTTP(w, r)
+	})
+}
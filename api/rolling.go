@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"server/events"
+	"server/metrics"
+	"server/store"
+)
+
+// the denials of the authtoken check, errBadToken counts toward the block
+// of the reader, the others are comments of the access log
+var (
+	errBadToken  = errors.New("bad authtoken")
+	errSuspended = errors.New("card suspended")
+	errExpired   = errors.New("previous authtoken after the grace time")
+	errCloned    = errors.New("old authtoken after a newer one, likely cloned card")
+	errRolled    = errors.New("authtoken rolled by another tap meanwhile")
+)
+
+func same(token, authtoken string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(authtoken)) == 1
+}
+
+// authtoken checks the authtoken of a tap of the card. With the rolling
+// authtokens next is the token the reader writes on the card: a new one for
+// the current token, the current one again for the previous token within
+// the grace time, as the reader may have failed to write it. Any older token
+// is only on a copy of the card.
+func (s *Server) authtoken(ctx context.Context, card store.Card, authtoken string) (next string, err error) {
+	if card.Suspended {
+		return "", errSuspended
+	}
+	switch {
+	case same(card.Authtoken, authtoken):
+		if !s.Rolling {
+			return "", nil
+		}
+		next = RandomKey(s.Keys.Authtoken)
+		err = s.Store.RollAuthtoken(ctx, card.SerialNumber, card.Authtoken, next)
+		metrics.TxError(err)
+		if errors.Is(err, store.ErrNotFound) {
+			return "", errRolled
+		}
+		return next, err
+	case !s.Rolling:
+		return "", errBadToken
+	case same(card.PrevAuthtoken, authtoken):
+		if time.Since(card.Rolled) > s.Grace {
+			return "", errExpired
+		}
+		return card.Authtoken, nil
+	}
+	used, err := s.Store.UsedAuthtoken(ctx, card.SerialNumber, authtoken)
+	if err != nil {
+		return "", err
+	}
+	if used {
+		return "", errCloned
+	}
+	return "", errBadToken
+}
+
+// suspend suspends the likely cloned card, the tap of the copy is an alarm
+func (s *Server) suspend(ctx context.Context, reader store.Reader, card store.Card) {
+	err := s.Store.SetSuspended(ctx, card.SerialNumber, true)
+	if err != nil {
+		s.Log.ErrorContext(ctx, "verify: failed to suspend card", "serial", card.SerialNumber, "err", err)
+		return
+	}
+	s.Log.WarnContext(ctx, "card suspended, likely cloned", "serial", card.SerialNumber, "reader", reader.Id, "owner", card.Owner)
+	s.addLog(ctx, events.Alarm, store.LogEntry{Card: store.Null(card.SerialNumber), Reader: store.Int(reader.Id), Person: store.Int(card.Owner), Direction: store.Null(reader.Direction), Comment: store.Null("card suspended, an old authtoken after a newer one, likely cloned")})
+}
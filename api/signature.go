@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/events"
+	"server/store"
+)
+
+// SignatureWindow is how far the X-Timestamp of a signed request may be from
+// the time of the server, a signature is taken once within it
+const SignatureWindow = 5 * time.Minute
+
+var errSignature = errors.New("bad signature")
+
+// replays are the signatures taken within the window, with the time they
+// were taken
+type replays struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// first records the decoded mac of a signature, false if it was taken
+// before. The hex of the header could be written in any case.
+func (r *replays) first(signature []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+	}
+	now := time.Now()
+	// the timestamp may be a window ahead of the server, its signature is
+	// good for two windows
+	for s, t := range r.seen {
+		if now.Sub(t) > 2*SignatureWindow {
+			delete(r.seen, s)
+		}
+	}
+	if _, ok := r.seen[string(signature)]; ok {
+		return false
+	}
+	r.seen[string(signature)] = now
+	return true
+}
+
+// signature checks the X-Timestamp and X-Signature of a request of a reader
+// with a secret, the format of client.HMAC: "sha256=" and the hex
+// hmac-sha256 of the timestamp, a dot and the body. The requests of an
+// unknown api key go on, the handler denies them.
+func (s *Server) signature(ctx context.Context, apiKey string, header http.Header, body []byte) error {
+	reader, err := s.Store.ReaderByKey(ctx, apiKey)
+	if err != nil || reader.Secret == "" {
+		return nil
+	}
+	mac, err := checkSignature(reader.Secret, header, body)
+	if err == nil && !s.replays.first(mac) {
+		err = fmt.Errorf("%w: replayed", errSignature)
+	}
+	if err != nil {
+		s.Log.WarnContext(ctx, "bad signature", "reader", reader.Id, "err", err)
+		s.addLog(ctx, events.Alarm, store.LogEntry{Reader: store.Int(reader.Id), Comment: store.Null("request denied " + err.Error())})
+	}
+	return err
+}
+
+// Unsigned refuses the requests of a reader with a secret that come without
+// the headers of a signature, over mqtt. Like with a bad signature the
+// refusal goes to the access log as an alarm.
+func (s *Server) Unsigned(ctx context.Context, request Request) error {
+	reader, err := s.Reader(ctx, request)
+	if err != nil || reader.Secret == "" {
+		return nil
+	}
+	err = fmt.Errorf("%w: the reader signs its requests, they can't come over mqtt", errSignature)
+	s.Log.WarnContext(ctx, "bad signature", "reader", reader.Id, "err", err)
+	s.addLog(ctx, events.Alarm, store.LogEntry{Reader: store.Int(reader.Id), Comment: store.Null("request denied " + err.Error())})
+	return err
+}
+
+// checkSignature returns the decoded mac of a good signature
+func checkSignature(secret string, header http.Header, body []byte) ([]byte, error) {
+	ts := header.Get("X-Timestamp")
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: no timestamp", errSignature)
+	}
+	if d := time.Since(time.Unix(unix, 0)); d > SignatureWindow || d < -SignatureWindow {
+		return nil, fmt.Errorf("%w: timestamp out of the window", errSignature)
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(header.Get("X-Signature"), "sha256="))
+	if err != nil || !strings.HasPrefix(header.Get("X-Signature"), "sha256=") {
+		return nil, fmt.Errorf("%w: no sha256 signature", errSignature)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, errSignature
+	}
+	return got, nil
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signed(secret string, at time.Time, body []byte) http.Header {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return http.Header{"X-Timestamp": {ts}, "X-Signature": {"sha256=" + hex.EncodeToString(mac.Sum(nil))}}
+}
+
+func TestCheckSignature(t *testing.T) {
+	body := []byte(`{"apiKey":"k"}`)
+	good := signed("titok", time.Now(), body)
+	with := func(name, value string) http.Header {
+		h := good.Clone()
+		h.Set(name, value)
+		return h
+	}
+	sig := strings.TrimPrefix(good.Get("X-Signature"), "sha256=")
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		body   []byte
+		ok     bool
+	}{
+		{"good", good, body, true},
+		{"upper case hex", with("X-Signature", "sha256="+strings.ToUpper(sig)), body, true},
+		{"edge of the window", signed("titok", time.Now().Add(-SignatureWindow+time.Second), body), body, true},
+		{"other body", good, []byte(`{"apiKey":"x"}`), false},
+		{"other secret", signed("masik", time.Now(), body), body, false},
+		{"no timestamp", with("X-Timestamp", ""), body, false},
+		{"timestamp not a number", with("X-Timestamp", "tegnap"), body, false},
+		{"other timestamp", with("X-Timestamp", strconv.FormatInt(time.Now().Unix()-1, 10)), body, false},
+		{"too old", signed("titok", time.Now().Add(-SignatureWindow-time.Second), body), body, false},
+		{"too new", signed("titok", time.Now().Add(SignatureWindow+time.Second), body), body, false},
+		{"no prefix", with("X-Signature", sig), body, false},
+		{"other prefix", with("X-Signature", "sha1="+sig), body, false},
+		{"not hex", with("X-Signature", "sha256=zz"+sig[2:]), body, false},
+		{"short", with("X-Signature", "sha256="+sig[:32]), body, false},
+		{"no signature", with("X-Signature", ""), body, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mac, err := checkSignature("titok", tc.header, tc.body)
+			if (err == nil) != tc.ok {
+				t.Fatalf("err %v, want ok %v", err, tc.ok)
+			}
+			if err != nil && !errors.Is(err, errSignature) {
+				t.Errorf("err %v isn't errSignature", err)
+			}
+			// the replays are keyed on the mac, whatever the case of the hex
+			want := strings.ToLower(strings.TrimPrefix(tc.header.Get("X-Signature"), "sha256="))
+			if err == nil && hex.EncodeToString(mac) != want {
+				t.Errorf("mac %x, want %s", mac, want)
+			}
+		})
+	}
+}
+
+func TestReplays(t *testing.T) {
+	var r replays
+	mac := []byte{1, 2, 3}
+	if !r.first(mac) {
+		t.Fatal("first signature taken")
+	}
+	if r.first([]byte{1, 2, 3}) {
+		t.Error("same mac taken twice")
+	}
+	if !r.first([]byte{1, 2, 4}) {
+		t.Error("other mac refused")
+	}
+	// the ones older than two windows are forgotten
+	r.seen[string(mac)] = time.Now().Add(-2*SignatureWindow - time.Second)
+	if !r.first(mac) {
+		t.Error("old signature still remembered")
+	}
+}
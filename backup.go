@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"server/store/sqlite"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// the tables a db needs to be one of ours
+var schemaTables = []string{"people", "cards", "reader", "accessLog", "admins"}
+
+// encrypted backups: magic, scrypt salt, gcm nonce, then the sealed db
+var backupMagic = []byte("CRBACKUP1\n")
+
+const (
+	backupPrefix = "cardreader-"
+	backupSuffix = ".db"
+	saltSize     = 16
+)
+
+func backupKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func encrypt(passphrase string, plain []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	crand.Read(salt)
+	key, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	crand.Read(nonce)
+	out := slices.Concat(backupMagic, salt, nonce)
+	// the header is authenticated too
+	return gcm.Seal(out, nonce, plain, out), nil
+}
+
+func encrypted(data []byte) bool {
+	return bytes.HasPrefix(data, backupMagic)
+}
+
+func decrypt(passphrase string, data []byte) ([]byte, error) {
+	if !encrypted(data) {
+		return nil, errors.New("not an encrypted backup")
+	}
+	rest := data[len(backupMagic):]
+	if len(rest) < saltSize {
+		return nil, errors.New("truncated backup")
+	}
+	key, err := backupKey(passphrase, rest[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	header := len(backupMagic) + saltSize + gcm.NonceSize()
+	if len(data) < header {
+		return nil, errors.New("truncated backup")
+	}
+	plain, err := gcm.Open(nil, data[header-gcm.NonceSize():header], data[header:], data[:header])
+	if err != nil {
+		return nil, errors.New("wrong passphrase or damaged backup")
+	}
+	return plain, nil
+}
+
+// verifyDB checks a db file: integrity, our tables and a schema version this
+// server can migrate
+func verifyDB(file string) (int, error) {
+	db, err := sql.Open("sqlite3", "file:"+file+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var result string
+	err = db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return 0, err
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("integrity check: %s", result)
+	}
+	for _, table := range schemaTables {
+		var n int
+		err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("no %s table, not a cardreader db", table)
+		}
+	}
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	if version > sqlite.SchemaVersion {
+		return version, fmt.Errorf("schema version %d is newer than the %d of this server", version, sqlite.SchemaVersion)
+	}
+	return version, nil
+}
+
+// backupTo writes a verified copy of the running db to file, encrypted when
+// there is a passphrase. The plain snapshot of an encrypted backup is made in
+// a private temp dir, not next to the backups.
+func backupTo(db *sql.DB, file string) error {
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("%s already exists", file)
+	}
+	tmp := file + ".tmp"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	snapshot := tmp
+	if config.Backup.Passphrase != "" {
+		dir, err := os.MkdirTemp("", "cardreader-backup-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		snapshot = filepath.Join(dir, "snapshot.db")
+	}
+	// VACUUM INTO reads in one transaction, the server keeps working meanwhile
+	_, err := db.Exec("VACUUM INTO ?", snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = verifyDB(snapshot)
+	if err != nil {
+		return fmt.Errorf("backup verification: %w", err)
+	}
+	if config.Backup.Passphrase == "" {
+		return os.Rename(tmp, file)
+	}
+	plain, err := os.ReadFile(snapshot)
+	if err != nil {
+		return err
+	}
+	sealed, err := encrypt(config.Backup.Passphrase, plain)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(tmp, sealed, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// backupNow makes a backup into the backup dir and drops the oldest ones
+// over Keep
+func backupNow(db *sql.DB) (string, error) {
+	dir := config.Backup.Dir
+	if dir == "" {
+		return "", errors.New("no backup dir in the config")
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", err
+	}
+	name := backupPrefix + time.Now().Format("20060102-150405") + backupSuffix
+	if config.Backup.Passphrase != "" {
+		name += ".enc"
+	}
+	file := filepath.Join(dir, name)
+	err = backupTo(db, file)
+	if err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return file, err
+	}
+	backups := make([]string, 0)
+	for _, e := range entries {
+		n := e.Name()
+		if strings.HasPrefix(n, backupPrefix) && (strings.HasSuffix(n, backupSuffix) || strings.HasSuffix(n, backupSuffix+".enc")) {
+			backups = append(backups, n)
+		}
+	}
+	// the timestamp in the name sorts by age
+	slices.Sort(backups)
+	for len(backups) > config.Backup.Keep {
+		err = os.Remove(filepath.Join(dir, backups[0]))
+		if err != nil {
+			return file, err
+		}
+		backups = backups[1:]
+	}
+	return file, nil
+}
+
+func runBackups(db *sql.DB, ticker *time.Ticker, done chan bool) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		file, err := backupNow(db)
+		if err != nil {
+			slog.Error("backup", "err", err)
+			continue
+		}
+		slog.Info("backup", "file", file)
+	}
+}
+
+// openBackup returns a plain db file of the backup to check or restore, the
+// returned cleanup removes the decrypted copy
+func openBackup(file string) (string, func(), error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", nil, err
+	}
+	if !encrypted(data) {
+		return file, func() {}, nil
+	}
+	passphrase := config.Backup.Passphrase
+	if passphrase == "" {
+		passphrase, err = readPassword()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	plain, err := decrypt(passphrase, data)
+	if err != nil {
+		return "", nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(config.DB.Path), ".restore-*.db")
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = tmp.Write(plain)
+	if err == nil {
+		err = tmp.Close()
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp.Name(), cleanup, nil
+}
+
+// notInUse fails if another process, a running server, has the db open. A
+// wal db can't leave the wal mode then. It also folds the wal into the file,
+// the old db is one file after the restore.
+func notInUse(path string) error {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=1000")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var mode string
+	err = db.QueryRow("PRAGMA journal_mode=DELETE").Scan(&mode)
+	if err != nil {
+		return fmt.Errorf("the database is in use, stop the server first: %w", err)
+	}
+	return nil
+}
+
+// restore swaps the backup in place of the db, the old db is kept next to
+// it. It refuses while a server has the db open.
+func restore(db *sql.DB, file string) (string, error) {
+	plain, cleanup, err := openBackup(file)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	version, err := verifyDB(plain)
+	if err != nil {
+		return "", err
+	}
+	slog.Debug("restore", "file", file, "schemaVersion", version)
+	data, err := os.ReadFile(plain)
+	if err != nil {
+		return "", err
+	}
+	// the new file goes into the dir of the db so the rename is atomic
+	tmp := config.DB.Path + ".restore"
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return "", err
+	}
+	old := config.DB.Path + ".before-restore-" + time.Now().Format("20060102-150405")
+	err = db.Close()
+	if err == nil {
+		err = notInUse(config.DB.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	err = os.Rename(config.DB.Path, old)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		os.Rename(config.DB.Path+suffix, old+suffix)
+	}
+	err = os.Rename(tmp, config.DB.Path)
+	if err != nil {
+		return "", err
+	}
+	return old, nil
+}
@@ -0,0 +1,752 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+
+	"server/api"
+	"server/frontend"
+	"server/store"
+)
+
+// the subcommands run instead of the server: server [flags] admin list -o json
+type command struct {
+	args string
+	help string
+	run  func(st store.Store, args []string) error
+	// file is run instead of run by the commands of the sqlite db file
+	file func(db *sql.DB, args []string) error
+}
+
+// filled in init, the commands use newFlags which reads it
+var commands map[string]map[string]command
+
+func init() {
+	commands = map[string]map[string]command{
+		"admin": {
+			"add":     {"[-r role] username", "add an admin, the password is asked for or read from stdin", adminAdd, nil},
+			"list":    {"[-o table|json]", "list the admins", adminList, nil},
+			"passwd":  {"username", "set the password of an admin", adminPasswd, nil},
+			"delete":  {"username", "delete an admin, it goes to the trash", adminDelete, nil},
+			"disable": {"[-enable] username", "disable (or enable again) the login of an admin", adminDisable, nil},
+		},
+		"reader": {
+			"add":        {"[-add-card] [-write-card] [-zone zone] [-direction in|out]", "add a reader and print its api key", readerAdd, nil},
+			"list":       {"[-o table|json]", "list the readers", readerList, nil},
+			"rotate-key": {"id", "give the reader a new api key and print it", readerRotateKey, nil},
+			"secret":     {"[-clear] id", "give the reader a new secret of the signed requests and print it", readerSecret, nil},
+		},
+		"card": {
+			"list":    {"[-owner id] [-o table|json]", "list the cards", cardList, nil},
+			"revoke":  {"serialNumber", "delete a card, it goes to the trash", cardRevoke, nil},
+			"suspend": {"[-lift] serialNumber", "suspend a card (or lift the suspension), its taps are denied", cardSuspend, nil},
+		},
+		"people": {
+			"import": {"[-format csv|json] [-commit] file", "import people, without -commit it is a dry run", peopleImport, nil},
+		},
+		"db": {
+			"backup":          {args: "[file]", help: "verified copy of the database into file, or into the backup dir of the config", file: dbBackup},
+			"verify":          {args: "file", help: "check a backup: integrity and schema version", file: dbVerify},
+			"restore":         {args: "file", help: "put a backup in place of the database, refused while the server runs on it", file: dbRestore},
+			"vacuum":          {args: "", help: "rebuild the database file", file: dbVacuum},
+			"integrity-check": {args: "", help: "check the database and its foreign keys, exits with error if it is damaged", file: dbIntegrityCheck},
+		},
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] [command subcommand [args]]\n\ncommands:\n", os.Args[0])
+	groups := make([]string, 0, len(commands))
+	for name := range commands {
+		groups = append(groups, name)
+	}
+	slices.Sort(groups)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, group := range groups {
+		subs := make([]string, 0, len(commands[group]))
+		for name := range commands[group] {
+			subs = append(subs, name)
+		}
+		slices.Sort(subs)
+		for _, sub := range subs {
+			c := commands[group][sub]
+			fmt.Fprintf(tw, "  %s %s %s\t%s\n", group, sub, c.args, c.help)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintln(out, "\nflags:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a subcommand, db is the sqlite db of the db commands, nil
+// with postgres
+func runCommand(st store.Store, db *sql.DB, args []string) error {
+	group, ok := commands[args[0]]
+	if !ok || len(args) < 2 {
+		usage()
+		return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	c, ok := group[args[1]]
+	if !ok {
+		usage()
+		return fmt.Errorf("unknown command %q", args[0]+" "+args[1])
+	}
+	if c.file != nil {
+		if db == nil {
+			return errors.New("the db commands work on sqlite dbs only, use the tools of postgres")
+		}
+		return c.file(db, args[2:])
+	}
+	return c.run(st, args[2:])
+}
+
+// newFlags is the flag set of a subcommand, usage comes from commands
+func newFlags(group, sub string) *flag.FlagSet {
+	fs := flag.NewFlagSet(group+" "+sub, flag.ContinueOnError)
+	fs.Usage = func() {
+		c := commands[group][sub]
+		fmt.Fprintf(fs.Output(), "usage: %s %s %s\n%s\n", group, sub, c.args, c.help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// oneArg parses the flags of a subcommand that takes exactly one argument
+func oneArg(fs *flag.FlagSet, args []string) (string, error) {
+	err := fs.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", errors.New("one argument needed")
+	}
+	return fs.Arg(0), nil
+}
+
+// cliAdmin is the name of the changes made from the cli in the audit trail
+func cliAdmin() string {
+	u, err := user.Current()
+	if err != nil {
+		return "cli"
+	}
+	return "cli:" + u.Username
+}
+
+// readHash reads a password with readPassword and hashes it
+func readHash() (string, error) {
+	password, err := readPassword()
+	if err != nil {
+		return "", err
+	}
+	hash, err := frontend.ComputepwHash([]byte(password))
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", errors.New("the password is longer than 72 bytes")
+	}
+	return string(hash), err
+}
+
+// readPassword asks twice on a terminal, otherwise reads the first line of
+// stdin so scripts can pipe it in
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return "", errors.New("empty password on stdin")
+		}
+		return line, nil
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "again: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", errors.New("the passwords don't match")
+	}
+	if len(first) == 0 {
+		return "", errors.New("empty password")
+	}
+	return string(first), nil
+}
+
+// printRows writes the rows as an aligned table or a json array
+func printRows(format string, cols []string, rows [][]any) error {
+	for _, values := range rows {
+		for k, v := range values {
+			switch v := v.(type) {
+			case []byte:
+				values[k] = string(v)
+			case time.Time:
+				values[k] = v.Local().Format(time.DateTime)
+			}
+		}
+	}
+	switch format {
+	case "json":
+		objects := make([]map[string]any, len(rows))
+		for i, values := range rows {
+			objects[i] = make(map[string]any, len(cols))
+			for k, v := range values {
+				objects[i][cols[k]] = v
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(objects)
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(cols, "\t"))
+		for _, values := range rows {
+			line := make([]string, len(values))
+			for k, v := range values {
+				if v != nil {
+					line[k] = fmt.Sprint(v)
+				}
+			}
+			fmt.Fprintln(tw, strings.Join(line, "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// list prints the rows of a list subcommand that only has -o
+func list(group string, args []string, cols []string, rows func(ctx context.Context) ([][]any, error)) error {
+	fs := newFlags(group, "list")
+	format := fs.String("o", "table", "output: table or json")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	values, err := rows(context.Background())
+	if err != nil {
+		return err
+	}
+	return printRows(*format, cols, values)
+}
+
+// orNil prints the empty string as NULL
+func orNil(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// change runs fn in a transaction that is committed only if fn succeeds
+func change(st store.Store, fn func(ctx context.Context, tx store.Tables) error) error {
+	ctx := context.Background()
+	return st.Change(ctx, func(tx store.Tables) error {
+		return fn(ctx, tx)
+	})
+}
+
+func adminAdd(st store.Store, args []string) error {
+	fs := newFlags("admin", "add")
+	role := fs.String("r", "operator", "role: viewer, operator, installer or superadmin")
+	name, err := oneArg(fs, args)
+	if err != nil {
+		return err
+	}
+	if !frontend.ValidRole(*role) {
+		return fmt.Errorf("unknown role %q", *role)
+	}
+	hash, err := readHash()
+	if err != nil {
+		return err
+	}
+	return change(st, func(ctx context.Context, tx store.Tables) error {
+		_, err := tx.Insert(ctx, "admins", store.Row{"username": name, "pwhash": hash, "role": *role})
+		if err != nil {
+			return err
+		}
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "add", "admins", nil, []map[string]any{{"username": name, "role": *role}})
+	})
+}
+
+func adminList(st store.Store, args []string) error {
+	return list("admin", args, []string{"id", "username", "role", "disabled"}, func(ctx context.Context) ([][]any, error) {
+		admins, err := st.ListAdmins(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rows := make([][]any, len(admins))
+		for k, a := range admins {
+			rows[k] = []any{a.Id, a.Username, a.Role, a.Disabled}
+		}
+		return rows, nil
+	})
+}
+
+func adminPasswd(st store.Store, args []string) error {
+	name, err := oneArg(newFlags("admin", "passwd"), args)
+	if err != nil {
+		return err
+	}
+	hash, err := readHash()
+	if err != nil {
+		return err
+	}
+	return change(st, func(ctx context.Context, tx store.Tables) error {
+		n, err := tx.Update(ctx, "admins", store.Row{"pwhash": hash}, store.Row{"username": name})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("no admin %q", name)
+		}
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "passwd", "admins", nil, []map[string]any{{"username": name}})
+	})
+}
+
+// lastSuperadmin keeps the cli from locking everybody out of the admin
+// pages, before is the row of the admin name as it was before the change
+func lastSuperadmin(ctx context.Context, tx store.Tables, name string, before []store.Row) error {
+	err := frontend.KeepSuperadmin(ctx, tx, before)
+	if errors.Is(err, frontend.ErrLastSuperadmin) {
+		return fmt.Errorf("%q is the last enabled superadmin", name)
+	}
+	return err
+}
+
+func adminDelete(st store.Store, args []string) error {
+	name, err := oneArg(newFlags("admin", "delete"), args)
+	if err != nil {
+		return err
+	}
+	return change(st, func(ctx context.Context, tx store.Tables) error {
+		before, err := tx.Rows(ctx, "admins", nil, store.Row{"username": name})
+		if err != nil {
+			return err
+		}
+		if len(before) == 0 {
+			return fmt.Errorf("no admin %q", name)
+		}
+		err = frontend.MoveToTrash(ctx, tx, cliAdmin(), "admins", "admins", before)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Delete(ctx, "admins", store.Row{"username": name})
+		if err != nil {
+			return err
+		}
+		err = lastSuperadmin(ctx, tx, name, before)
+		if err != nil {
+			return err
+		}
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "delete", "admins", before, nil)
+	})
+}
+
+func adminDisable(st store.Store, args []string) error {
+	fs := newFlags("admin", "disable")
+	enable := fs.Bool("enable", false, "enable the admin again")
+	name, err := oneArg(fs, args)
+	if err != nil {
+		return err
+	}
+	return change(st, func(ctx context.Context, tx store.Tables) error {
+		before, err := tx.Rows(ctx, "admins", nil, store.Row{"username": name})
+		if err != nil {
+			return err
+		}
+		if len(before) == 0 {
+			return fmt.Errorf("no admin %q", name)
+		}
+		_, err = tx.Update(ctx, "admins", store.Row{"disabled": !*enable}, store.Row{"username": name})
+		if err != nil {
+			return err
+		}
+		err = lastSuperadmin(ctx, tx, name, before)
+		if err != nil {
+			return err
+		}
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "update", "admins", nil, []map[string]any{{"username": name, "disabled": !*enable}})
+	})
+}
+
+// apiKeyBytes is the length of the generated reader api keys
+const apiKeyBytes = 24
+
+func readerAdd(st store.Store, args []string) error {
+	fs := newFlags("reader", "add")
+	addCard := fs.Bool("add-card", false, "the reader can add cards")
+	writeCard := fs.Bool("write-card", false, "the reader gets the write keys of the cards")
+	zone := fs.String("zone", "", "zone of the reader")
+	direction := fs.String("direction", "", "in or out, empty if the reader toggles")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	switch *direction {
+	case "", "in", "out":
+	default:
+		return fmt.Errorf("direction is in or out, not %q", *direction)
+	}
+	key := api.RandomKey(apiKeyBytes)
+	var id any
+	err = change(st, func(ctx context.Context, tx store.Tables) error {
+		added, err := tx.Insert(ctx, "reader", store.Row{"apiKey": key, "addCard": *addCard, "writeCard": *writeCard, "zone": orNil(*zone), "direction": orNil(*direction)})
+		if err != nil {
+			return err
+		}
+		id = added["id"]
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "add", "reader", nil, []map[string]any{{"id": id, "apiKey": "***", "addCard": *addCard, "writeCard": *writeCard, "zone": orNil(*zone), "direction": orNil(*direction)}})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("reader %v\napi key: %s\n", id, key)
+	return nil
+}
+
+func readerList(st store.Store, args []string) error {
+	return list("reader", args, []string{"id", "addCard", "writeCard", "zone", "direction", "lastSeen", "signed"}, func(ctx context.Context) ([][]any, error) {
+		readers, err := st.ListReaders(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rows := make([][]any, len(readers))
+		for k, r := range readers {
+			var lastSeen any
+			if !r.LastSeen.IsZero() {
+				lastSeen = r.LastSeen
+			}
+			rows[k] = []any{r.Id, r.AddCard, r.WriteCard, orNil(r.Zone), orNil(r.Direction), lastSeen, r.Secret != ""}
+		}
+		return rows, nil
+	})
+}
+
+// readerId parses the id argument of the reader subcommands
+func readerId(fs *flag.FlagSet, args []string) (int, error) {
+	arg, err := oneArg(fs, args)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("reader id is a number, not %q", arg)
+	}
+	return id, nil
+}
+
+func readerRotateKey(st store.Store, args []string) error {
+	id, err := readerId(newFlags("reader", "rotate-key"), args)
+	if err != nil {
+		return err
+	}
+	key := api.RandomKey(apiKeyBytes)
+	err = change(st, func(ctx context.Context, tx store.Tables) error {
+		n, err := tx.Update(ctx, "reader", store.Row{"apiKey": key}, store.Row{"id": id})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("no reader %d", id)
+		}
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "rotate-key", "reader", nil, []map[string]any{{"id": id, "apiKey": "***"}})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("api key: %s\n", key)
+	return nil
+}
+
+func readerSecret(st store.Store, args []string) error {
+	fs := newFlags("reader", "secret")
+	remove := fs.Bool("clear", false, "remove the secret, the requests don't need a signature")
+	id, err := readerId(fs, args)
+	if err != nil {
+		return err
+	}
+	var secret any
+	if !*remove {
+		secret = api.RandomKey(apiKeyBytes)
+	}
+	err = change(st, func(ctx context.Context, tx store.Tables) error {
+		n, err := tx.Update(ctx, "reader", store.Row{"secret": secret}, store.Row{"id": id})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("no reader %d", id)
+		}
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "secret", "reader", nil, []map[string]any{{"id": id, "signed": !*remove}})
+	})
+	if err != nil {
+		return err
+	}
+	if !*remove {
+		fmt.Printf("secret: %s\n", secret)
+	}
+	return nil
+}
+
+func cardList(st store.Store, args []string) error {
+	fs := newFlags("card", "list")
+	owner := fs.String("owner", "", "only the cards of this person id")
+	format := fs.String("o", "table", "output: table or json")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	cards, err := st.ListCards(ctx)
+	if err != nil {
+		return err
+	}
+	people, err := st.ListPeople(ctx)
+	if err != nil {
+		return err
+	}
+	names := make(map[int64]string, len(people))
+	for _, p := range people {
+		names[p.Id] = p.Name
+	}
+	rows := make([][]any, 0, len(cards))
+	for _, c := range cards {
+		if *owner != "" && strconv.FormatInt(c.Owner, 10) != *owner {
+			continue
+		}
+		var name any
+		if n, ok := names[c.Owner]; ok {
+			name = n
+		}
+		rows = append(rows, []any{c.SerialNumber, c.Owner, name, c.Suspended})
+	}
+	return printRows(*format, []string{"serialNumber", "owner", "name", "suspended"}, rows)
+}
+
+func cardRevoke(st store.Store, args []string) error {
+	serial, err := oneArg(newFlags("card", "revoke"), args)
+	if err != nil {
+		return err
+	}
+	return change(st, func(ctx context.Context, tx store.Tables) error {
+		before, err := tx.Rows(ctx, "cards", nil, store.Row{"serialNumber": serial})
+		if err != nil {
+			return err
+		}
+		if len(before) == 0 {
+			return fmt.Errorf("no card %q", serial)
+		}
+		err = frontend.MoveToTrash(ctx, tx, cliAdmin(), "cards", "cards", before)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Delete(ctx, "cards", store.Row{"serialNumber": serial})
+		if err != nil {
+			return err
+		}
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "delete", "cards", before, nil)
+	})
+}
+
+func cardSuspend(st store.Store, args []string) error {
+	fs := newFlags("card", "suspend")
+	lift := fs.Bool("lift", false, "lift the suspension, the card works again")
+	serial, err := oneArg(fs, args)
+	if err != nil {
+		return err
+	}
+	return change(st, func(ctx context.Context, tx store.Tables) error {
+		n, err := tx.Update(ctx, "cards", store.Row{"suspended": !*lift}, store.Row{"serialNumber": serial})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("no card %q", serial)
+		}
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "update", "cards", nil, []map[string]any{{"serialNumber": serial, "suspended": !*lift}})
+	})
+}
+
+func peopleImport(st store.Store, args []string) error {
+	fs := newFlags("people", "import")
+	format := fs.String("format", "", "csv or json, from the file extension if empty")
+	commit := fs.Bool("commit", false, "save the rows, only if none of them failed")
+	file, err := oneArg(fs, args)
+	if err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(path.Ext(file), ".")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	rows, err := frontend.ParseImport(*format, data)
+	if err != nil {
+		return err
+	}
+	err = change(st, func(ctx context.Context, tx store.Tables) error {
+		after, failed := frontend.ImportRows(ctx, tx, "people", rows)
+		for _, row := range rows {
+			if row.Err != "" {
+				fmt.Printf("line %d: %s\n", row.Line, row.Err)
+			}
+		}
+		fmt.Printf("%d rows, %d failed\n", len(rows), failed)
+		switch {
+		case failed != 0:
+			return errors.New("nothing imported")
+		case !*commit:
+			fmt.Println("dry run, add -commit to save")
+			return frontend.ErrDryRun
+		}
+		return frontend.Audit(ctx, tx, cliAdmin(), "", "import", "people", nil, after)
+	})
+	if errors.Is(err, frontend.ErrDryRun) {
+		return nil
+	}
+	return err
+}
+
+func dbBackup(db *sql.DB, args []string) error {
+	fs := newFlags("db", "backup")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	switch fs.NArg() {
+	case 0:
+		file, err := backupNow(db)
+		if err != nil {
+			return err
+		}
+		fmt.Println(file)
+		return nil
+	case 1:
+		return backupTo(db, fs.Arg(0))
+	default:
+		fs.Usage()
+		return errors.New("too many arguments")
+	}
+}
+
+func dbVerify(db *sql.DB, args []string) error {
+	file, err := oneArg(newFlags("db", "verify"), args)
+	if err != nil {
+		return err
+	}
+	plain, cleanup, err := openBackup(file)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	version, err := verifyDB(plain)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ok, schema version %d\n", version)
+	return nil
+}
+
+func dbRestore(db *sql.DB, args []string) error {
+	file, err := oneArg(newFlags("db", "restore"), args)
+	if err != nil {
+		return err
+	}
+	old, err := restore(db, file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %s, the previous database is %s\n", file, old)
+	return nil
+}
+
+func dbVacuum(db *sql.DB, args []string) error {
+	err := newFlags("db", "vacuum").Parse(args)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("VACUUM")
+	return err
+}
+
+func dbIntegrityCheck(db *sql.DB, args []string) error {
+	err := newFlags("db", "integrity-check").Parse(args)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	ok := false
+	for rows.Next() {
+		var line string
+		err = rows.Scan(&line)
+		if err != nil {
+			return err
+		}
+		fmt.Println(line)
+		ok = line == "ok"
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("integrity check failed")
+	}
+	// rows of older dbs that point to deleted rows
+	rows, err = db.Query(`SELECT "table", rowid, parent FROM pragma_foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	orphans := 0
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		err = rows.Scan(&table, &rowid, &parent)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s row %d points to a missing %s row\n", table, rowid.Int64, parent)
+		orphans++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if orphans != 0 {
+		return fmt.Errorf("%d orphaned rows", orphans)
+	}
+	return nil
+}
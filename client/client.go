@@ -0,0 +1,291 @@
+// Package client is the Go client of the reader api, for the reader
+// integrations, the testtools and the end to end tests.
+//
+//	c := client.New("https://cardreader.example.com")
+//	c.Retries = 2
+//	ans, err := c.Verify(ctx, client.VerifyRequest{ApiKey: key, SerialNumber: serial, Authtoken: token})
+//
+// A denied request is not an error, it is an answer with Ok false. The
+// errors are the requests that got no answer: network errors, timeouts and
+// the http errors of the server (StatusError).
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	VerifyRequest struct {
+		ApiKey       string `json:"apikey"`
+		Authtoken    string `json:"authtoken"`
+		SerialNumber string `json:"serialnumber"`
+	}
+	VerifyAnswer struct {
+		Ok         bool   `json:"ok"`
+		Name       string `json:"name"`
+		Permission string `json:"perm"`
+		// the new authtoken with the rolling authtokens on the server, it
+		// has to be written on the card
+		Authtoken string `json:"authtoken,omitempty"`
+	}
+	KeyRequest struct {
+		ApiKey       string `json:"apikey"`
+		SerialNumber string `json:"serialnumber"`
+		Write        bool   `json:"write"`
+	}
+	KeyAnswer struct {
+		Ok  bool   `json:"ok"`
+		Key string `json:"key"`
+	}
+	AddCardRequest struct {
+		ApiKey       string `json:"apikey"`
+		SerialNumber string `json:"serialnumber"`
+	}
+	AddCardAnswer struct {
+		Ok        bool   `json:"ok"`
+		Authtoken string `json:"authtoken"`
+		WriteKey  string `json:"writekey"`
+		ReadKey   string `json:"readkey"`
+	}
+)
+
+// Signer adds the signature headers to a request, body is the json it sends
+type Signer func(r *http.Request, body []byte)
+
+// Client is a reader of the server at BaseURL, e.g. http://localhost:8090.
+// The fields can be changed before the first request.
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	// Retries is how many times a request that got no answer is sent again,
+	// see retryable. 0 sends every request once. The server may have handled
+	// a request whose answer got lost, the retry of it is logged again.
+	Retries int
+	// Backoff is the wait before the first retry, it doubles with every
+	// retry up to MaxBackoff and is jittered by ±50%
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Sign       Signer // nil doesn't sign
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTP:       &http.Client{Timeout: 10 * time.Second},
+		Backoff:    200 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+	}
+}
+
+// SetTLS makes the requests with the tls config, e.g. of TLSConfig
+func (c *Client) SetTLS(config *tls.Config) {
+	c.HTTP = &http.Client{
+		Timeout:   c.HTTP.Timeout,
+		Transport: &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: true},
+	}
+}
+
+// TLSConfig trusts the certificates of caFile (empty is the system roots)
+// and sends the client certificate of certFile and keyFile if they are set
+func TLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// HMAC signs with the shared secret: X-Timestamp is the unix time of the
+// request and X-Signature is "sha256=" and the hex hmac-sha256 of the
+// timestamp, a dot and the body. The server checks the signature of the
+// readers that have a secret (reader secret in the cli): the timestamp has
+// to be within api.SignatureWindow of the server time and a signature is
+// taken only once, so the same request in the same second is a replay.
+// There are no signatures over mqtt: the server refuses the mqtt requests of
+// the readers that have a secret, they have to use https.
+func HMAC(secret string) Signer {
+	return func(r *http.Request, body []byte) {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		r.Header.Set("X-Timestamp", ts)
+		r.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// StatusError is the answer of the server that isn't 200
+type StatusError struct {
+	Code int
+	Body string
+	// Message is the error of the json body the server sends with the
+	// requests it refused: the bad requests (400), the too long ones (413)
+	// and the wrong content type (415)
+	Message string
+	// RetryAfter is the Retry-After header of the answer
+	RetryAfter time.Duration
+}
+
+func (e StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("http %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("http %d: %s", e.Code, e.Body)
+}
+
+func statusError(code int, body []byte, header http.Header) StatusError {
+	var ans struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(body, &ans)
+	return StatusError{Code: code, Body: string(body), Message: ans.Error, RetryAfter: retryAfter(header)}
+}
+
+func (c *Client) Verify(ctx context.Context, request VerifyRequest) (VerifyAnswer, error) {
+	var ans VerifyAnswer
+	err := c.call(ctx, "verify", request, &ans)
+	return ans, err
+}
+
+func (c *Client) GetKey(ctx context.Context, request KeyRequest) (KeyAnswer, error) {
+	var ans KeyAnswer
+	err := c.call(ctx, "key", request, &ans)
+	return ans, err
+}
+
+// AddCard enrolls the card. A retried AddCard whose first answer got lost
+// is denied as the card exists by then.
+func (c *Client) AddCard(ctx context.Context, request AddCardRequest) (AddCardAnswer, error) {
+	var ans AddCardAnswer
+	err := c.call(ctx, "addCard", request, &ans)
+	return ans, err
+}
+
+func (c *Client) call(ctx context.Context, endpoint string, request, ans any) error {
+	js, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	for attempt := 0; ; attempt++ {
+		var code int
+		var header http.Header
+		code, body, header, err = c.post(ctx, endpoint, "application/json", js)
+		if err == nil && code != http.StatusOK {
+			err = statusError(code, body, header)
+		}
+		if err == nil {
+			break
+		}
+		if attempt >= c.Retries || !retryable(err) {
+			return err
+		}
+		wait := c.backoff(attempt)
+		var status StatusError
+		if errors.As(err, &status) && status.RetryAfter > 0 {
+			wait = status.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), err)
+		case <-time.After(wait):
+		}
+	}
+	err = json.Unmarshal(body, ans)
+	if err != nil {
+		return fmt.Errorf("%s: bad answer %q: %w", endpoint, body, err)
+	}
+	return nil
+}
+
+// retryable are the errors where the server didn't answer the request:
+// network errors and the overloaded or restarting server. The other http
+// errors would only come again.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var status StatusError
+	if errors.As(err, &status) {
+		switch status.Code {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+func retryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.Backoff << min(attempt, 16)
+	if c.MaxBackoff > 0 {
+		d = min(d, c.MaxBackoff)
+	}
+	return d/2 + rand.N(d+1)
+}
+
+// Post sends body as is to /api/request/{endpoint}, once, for the requests
+// the typed methods can't make
+func (c *Client) Post(ctx context.Context, endpoint, contentType string, body []byte) (int, []byte, error) {
+	code, ans, _, err := c.post(ctx, endpoint, contentType, body)
+	return code, ans, err
+}
+
+func (c *Client) post(ctx context.Context, endpoint, contentType string, body []byte) (int, []byte, http.Header, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/api/request/"+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	r.Header.Set("User-Agent", "cardreader-client/1")
+	if c.Sign != nil {
+		c.Sign(r, body)
+	}
+	res, err := c.HTTP.Do(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer res.Body.Close()
+	ans, err := io.ReadAll(res.Body)
+	return res.StatusCode, ans, res.Header, err
+}
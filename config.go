@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"server/frontend"
+	"server/ratelimit"
+)
+
+// envPrefix of the environment overrides, the rest of the name is the yaml
+// path in upper case: CARDREADER_DB_PATH, CARDREADER_MQTT_BROKER...
+const envPrefix = "CARDREADER"
+
+// Config is the yaml config file. The values come from the defaults, then the
+// file, then the environment, then the flags given on the command line.
+type Config struct {
+	Listen string `yaml:"listen"`
+	TLS    struct {
+		Cert string `yaml:"cert"`
+		Key  string `yaml:"key"`
+	} `yaml:"tls"`
+	DB struct {
+		// sqlite or postgres, only the backups and the db commands need
+		// sqlite
+		Driver string `yaml:"driver"`
+		Path   string `yaml:"path"`
+		DSN    string `yaml:"dsn"` // connection string of postgres
+		// how long a sqlite write waits for the others before it fails
+		BusyTimeout time.Duration `yaml:"busyTimeout"`
+	} `yaml:"db"`
+	Session struct {
+		Lifetime      time.Duration `yaml:"lifetime"`
+		CleanInterval time.Duration `yaml:"cleanInterval"`
+	} `yaml:"session"`
+	// lengths of the generated card keys in random bytes
+	Keys struct {
+		ReadKey   int `yaml:"readKey"`
+		WriteKey  int `yaml:"writeKey"`
+		Authtoken int `yaml:"authtoken"`
+	} `yaml:"keys"`
+	// with Rolling every granted verify gives the card a new authtoken, the
+	// previous one is still taken for Grace in case the reader couldn't
+	// write the new one. An older token than that suspends the card.
+	Cards struct {
+		Rolling bool          `yaml:"rolling"`
+		Grace   time.Duration `yaml:"grace"`
+	} `yaml:"cards"`
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+	Features struct {
+		Webhooks    bool `yaml:"webhooks"`
+		Live        bool `yaml:"live"`
+		Metrics     bool `yaml:"metrics"`
+		ReaderWatch bool `yaml:"readerWatch"`
+	} `yaml:"features"`
+	// scheduled backups go into Dir every Interval (0 is off), the newest
+	// Keep of them stay. With a passphrase they are encrypted.
+	Backup struct {
+		Dir        string        `yaml:"dir"`
+		Interval   time.Duration `yaml:"interval"`
+		Keep       int           `yaml:"keep"`
+		Passphrase string        `yaml:"passphrase"`
+	} `yaml:"backup"`
+	Trash struct {
+		Days int `yaml:"days"`
+	} `yaml:"trash"`
+	Webhooks struct {
+		Attempts int `yaml:"attempts"`
+	} `yaml:"webhooks"`
+	Readers struct {
+		Offline time.Duration `yaml:"offline"`
+	} `yaml:"readers"`
+	// token buckets of the reader api per api key and per address: Burst
+	// requests at once, then Rate a minute, a 0 rate is no limit. BadTokens
+	// bad authtokens of a reader within BadTokenWindow block its api key
+	// for BlockFor, 0 never blocks.
+	Limits struct {
+		KeyRate        int           `yaml:"keyRate"`
+		KeyBurst       int           `yaml:"keyBurst"`
+		IPRate         int           `yaml:"ipRate"`
+		IPBurst        int           `yaml:"ipBurst"`
+		BadTokens      int           `yaml:"badTokens"`
+		BadTokenWindow time.Duration `yaml:"badTokenWindow"`
+		BlockFor       time.Duration `yaml:"blockFor"`
+	} `yaml:"limits"`
+	Metrics struct {
+		Listen   string `yaml:"listen"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+	} `yaml:"metrics"`
+	MQTT struct {
+		Broker   string `yaml:"broker"`
+		Prefix   string `yaml:"prefix"`
+		ClientId string `yaml:"clientId"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+	} `yaml:"mqtt"`
+	Attendance struct {
+		Zone       string `yaml:"zone"`
+		MissingIn  string `yaml:"missingIn"`
+		MissingOut string `yaml:"missingOut"`
+		DayStart   string `yaml:"dayStart"`
+		DayEnd     string `yaml:"dayEnd"`
+	} `yaml:"attendance"`
+}
+
+var config = defaultConfig()
+
+var (
+	configPath  = flag.String("config", "", "path of the yaml config file")
+	checkConfig = flag.Bool("check-config", false, "validate the config and exit")
+)
+
+func defaultConfig() Config {
+	var c Config
+	c.Listen = ":8090"
+	c.DB.Driver = "sqlite"
+	c.DB.Path = "./database.db"
+	c.DB.BusyTimeout = 5 * time.Second
+	c.Session.Lifetime = time.Hour
+	c.Session.CleanInterval = time.Hour
+	c.Keys.ReadKey = 6
+	c.Keys.WriteKey = 6
+	c.Keys.Authtoken = 16
+	c.Cards.Grace = 5 * time.Minute
+	c.Log.Level = "info"
+	c.Log.Format = "text"
+	c.Features.Webhooks = true
+	c.Features.Live = true
+	c.Features.ReaderWatch = true
+	c.Backup.Interval = 24 * time.Hour
+	c.Backup.Keep = 7
+	c.Trash.Days = 30
+	c.Webhooks.Attempts = 10
+	c.Readers.Offline = 10 * time.Minute
+	c.Limits.KeyRate = 120
+	c.Limits.KeyBurst = 20
+	c.Limits.IPRate = 600
+	c.Limits.IPBurst = 100
+	c.Limits.BadTokens = 5
+	c.Limits.BadTokenWindow = 10 * time.Minute
+	c.Limits.BlockFor = 15 * time.Minute
+	c.MQTT.Prefix = "cardreader"
+	c.MQTT.ClientId = "cardreader-server"
+	c.Attendance.MissingIn = frontend.MissingDefault
+	c.Attendance.MissingOut = frontend.MissingDefault
+	c.Attendance.DayStart = "08:00"
+	c.Attendance.DayEnd = "16:00"
+	return c
+}
+
+// the flags of the settings that had one before the config file
+func init() {
+	flag.StringVar(&config.DB.Path, "dbpath", config.DB.Path, "path to the db file")
+	flag.IntVar(&config.Trash.Days, "trashdays", config.Trash.Days, "days the deleted rows are kept in the trash")
+	flag.StringVar(&config.Log.Level, "log-level", config.Log.Level, "log level: debug, info, warn or error")
+	flag.StringVar(&config.Log.Format, "log-format", config.Log.Format, "log format: text or json")
+
+	flag.IntVar(&config.Webhooks.Attempts, "webhook-attempts", config.Webhooks.Attempts, "delivery attempts of a webhook event before it is dropped")
+	flag.DurationVar(&config.Readers.Offline, "reader-offline", config.Readers.Offline, "a reader not heard of for this long is reported offline")
+
+	flag.StringVar(&config.Metrics.Listen, "metrics-listen", config.Metrics.Listen, "address of the /metrics listener like :9100, empty serves it on the admin listener")
+	flag.StringVar(&config.Metrics.User, "metrics-user", config.Metrics.User, "basic auth user of /metrics, no auth if empty")
+	flag.StringVar(&config.Metrics.Password, "metrics-password", config.Metrics.Password, "basic auth password of /metrics")
+
+	flag.StringVar(&config.MQTT.Broker, "mqtt-broker", config.MQTT.Broker, "mqtt broker url like tcp://localhost:1883, the mqtt bridge is off if empty")
+	flag.StringVar(&config.MQTT.Prefix, "mqtt-prefix", config.MQTT.Prefix, "root of the mqtt topics")
+	flag.StringVar(&config.MQTT.ClientId, "mqtt-client-id", config.MQTT.ClientId, "mqtt client id of the server")
+	flag.StringVar(&config.MQTT.User, "mqtt-user", config.MQTT.User, "mqtt username")
+	flag.StringVar(&config.MQTT.Password, "mqtt-password", config.MQTT.Password, "mqtt password")
+
+	flag.StringVar(&config.Attendance.Zone, "attendance-zone", config.Attendance.Zone, "only taps on readers of this zone count for attendance, all if empty")
+	flag.StringVar(&config.Attendance.MissingIn, "attendance-missing-in", config.Attendance.MissingIn, "exit without entry: skip, default (from -attendance-day-start) or tap (counts 0)")
+	flag.StringVar(&config.Attendance.MissingOut, "attendance-missing-out", config.Attendance.MissingOut, "entry without exit: skip, default (until -attendance-day-end) or tap (counts 0)")
+	flag.StringVar(&config.Attendance.DayStart, "attendance-day-start", config.Attendance.DayStart, "assumed entry time for missing entries")
+	flag.StringVar(&config.Attendance.DayEnd, "attendance-day-end", config.Attendance.DayEnd, "assumed exit time for missing exits")
+}
+
+// limits is the rate limiter of the reader api from the config
+func limits() *ratelimit.Limiter {
+	return ratelimit.New(ratelimit.Config{
+		Rules: map[string]ratelimit.Rule{
+			ratelimit.ApiKey: {Rate: float64(config.Limits.KeyRate) / 60, Burst: config.Limits.KeyBurst},
+			ratelimit.IP:     {Rate: float64(config.Limits.IPRate) / 60, Burst: config.Limits.IPBurst},
+		},
+		Failures: config.Limits.BadTokens,
+		Window:   config.Limits.BadTokenWindow,
+		BlockFor: config.Limits.BlockFor,
+	})
+}
+
+// loadConfig is called after flag.Parse, the file and the environment go
+// under the flags given on the command line
+func loadConfig() error {
+	given := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+	path := *configPath
+	if path == "" {
+		path = os.Getenv(envPrefix + "_CONFIG")
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&config)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	err := fromEnv(reflect.ValueOf(&config).Elem(), envPrefix)
+	if err != nil {
+		return err
+	}
+	for name, value := range given {
+		if name == "config" || name == "check-config" {
+			continue
+		}
+		flag.Set(name, value)
+	}
+	return nil
+}
+
+// fromEnv walks the config and sets the fields that have an environment
+// variable
+func fromEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + "_" + strings.ToUpper(t.Field(i).Tag.Get("yaml"))
+		if field.Kind() == reflect.Struct {
+			err := fromEnv(field, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+		case time.Duration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.SetInt(int64(d))
+		case int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.SetInt(int64(n))
+		case bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.SetBool(b)
+		}
+	}
+	return nil
+}
+
+// validate returns every problem of the config, not only the first one
+func (c Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Listen != "", "listen: empty")
+	check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls: cert and key go together")
+	for _, f := range []string{c.TLS.Cert, c.TLS.Key} {
+		if f != "" {
+			_, err := os.Stat(f)
+			check(err == nil, "tls: %v", err)
+		}
+	}
+	switch c.DB.Driver {
+	case "sqlite":
+		check(c.DB.Path != "", "db.path: empty")
+		check(c.DB.BusyTimeout >= 0, "db.busyTimeout: can't be negative")
+	case "postgres":
+		check(c.DB.DSN != "", "db.dsn: needed for postgres")
+		check(c.Backup.Dir == "", "backup.dir: backups need sqlite")
+	default:
+		check(false, "db.driver: sqlite or postgres, not %q", c.DB.Driver)
+	}
+	check(c.Session.Lifetime >= time.Minute, "session.lifetime: at least 1m")
+	check(c.Session.CleanInterval > 0, "session.cleanInterval: must be positive")
+	check(c.Keys.ReadKey >= 4, "keys.readKey: at least 4 bytes")
+	check(c.Keys.WriteKey >= 4, "keys.writeKey: at least 4 bytes")
+	check(c.Keys.Authtoken >= 8, "keys.authtoken: at least 8 bytes")
+	check(c.Cards.Grace >= 0, "cards.grace: can't be negative")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level: unknown level %q", c.Log.Level)
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format: text or json, not %q", c.Log.Format)
+	check(c.Backup.Interval >= 0, "backup.interval: can't be negative")
+	check(c.Backup.Interval == 0 || c.Backup.Interval >= time.Minute, "backup.interval: at least 1m")
+	check(c.Backup.Keep >= 1, "backup.keep: at least 1")
+	check(c.Trash.Days >= 1, "trash.days: at least 1")
+	check(c.Webhooks.Attempts >= 1, "webhooks.attempts: at least 1")
+	check(c.Readers.Offline >= time.Minute, "readers.offline: at least 1m")
+	// the admin listener is public, /metrics shows the readers and the
+	// sessions
+	check(!c.Features.Metrics || c.Metrics.Listen != "" || (c.Metrics.User != "" && c.Metrics.Password != ""), "metrics: user and password needed to serve /metrics on the admin listener")
+	check(c.Limits.KeyRate >= 0 && c.Limits.IPRate >= 0, "limits: the rates can't be negative")
+	check(c.Limits.KeyRate == 0 || c.Limits.KeyBurst >= 1, "limits.keyBurst: at least 1")
+	check(c.Limits.IPRate == 0 || c.Limits.IPBurst >= 1, "limits.ipBurst: at least 1")
+	check(c.Limits.BadTokens >= 0, "limits.badTokens: can't be negative")
+	check(c.Limits.BadTokens == 0 || c.Limits.BadTokenWindow > 0, "limits.badTokenWindow: must be positive")
+	check(c.Limits.BadTokens == 0 || c.Limits.BlockFor >= time.Second, "limits.blockFor: at least 1s")
+	check(c.MQTT.Broker == "" || c.MQTT.Prefix != "", "mqtt.prefix: empty")
+	check(c.MQTT.Broker == "" || c.MQTT.ClientId != "", "mqtt.clientId: empty")
+	_, err := attendanceRules()
+	check(err == nil, "attendance: %v", err)
+	return errors.Join(errs...)
+}
@@ -0,0 +1,57 @@
+// Package events is the bus of the access events, the reader api publishes
+// every logged event and the notifiers (webhooks, live view...) handle them.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	Granted       = "granted"
+	Denied        = "denied"
+	Enrolled      = "enrolled" // card added by a reader
+	Key           = "key"      // card key handed out to a reader
+	ReaderOffline = "reader_offline"
+	Alarm         = "alarm"
+)
+
+// Types are all the event types, in the order the admin ui lists them
+var Types = []string{Granted, Denied, Enrolled, Key, ReaderOffline, Alarm}
+
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Card      any       `json:"card"`
+	Reader    any       `json:"reader"`
+	Person    any       `json:"person"`
+	Allowed   bool      `json:"allowed"`
+	Direction any       `json:"direction"`
+	Comment   any       `json:"comment"`
+}
+
+// Bus hands the published events to the handlers, the zero value is ready
+// to use
+type Bus struct {
+	lock     sync.RWMutex
+	handlers []func(Event)
+}
+
+// Handle registers fn for every later event. The handlers run in the
+// goroutine of the publisher so they have to be quick.
+func (b *Bus) Handle(fn func(Event)) {
+	b.lock.Lock()
+	b.handlers = append(b.handlers, fn)
+	b.lock.Unlock()
+}
+
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, fn := range b.handlers {
+		fn(e)
+	}
+}
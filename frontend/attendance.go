@@ -0,0 +1,232 @@
+package frontend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"server/store"
+)
+
+// what to do with a day where the entry or the exit tap is missing
+const (
+	MissingSkip    = "skip"    // the open session doesn't count
+	MissingDefault = "default" // the session starts/ends at DayStart/DayEnd
+	MissingTap     = "tap"     // the lone tap starts and ends the session, counts 0
+)
+
+type (
+	AttendanceRules struct {
+		MissingIn  string
+		MissingOut string
+		DayStart   time.Duration // since midnight
+		DayEnd     time.Duration
+		Zone       string // only readers of this zone count, all if empty
+	}
+	attendanceEvent struct {
+		Person    int
+		Name      string
+		Time      time.Time
+		Direction string
+	}
+	attendanceSession struct {
+		In      time.Time
+		Out     time.Time
+		Missing string // "in" or "out" when one side was filled by the rules
+	}
+	attendanceDay struct {
+		Person   int
+		Name     string
+		Day      string
+		Sessions []attendanceSession
+		Total    time.Duration
+		Issues   int
+	}
+	attendanceWeek struct {
+		Person int
+		Name   string
+		Week   string
+		Days   int
+		Total  time.Duration
+		Issues int
+	}
+)
+
+func ValidMissingRule(rule string) bool {
+	return rule == MissingSkip || rule == MissingDefault || rule == MissingTap
+}
+
+// ParseClock parses "8:30" into the time since midnight
+func ParseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// pairDay makes sessions of the taps of one person on one day. Readers
+// without direction toggle: a tap opens a session if none is open, closes it
+// otherwise.
+func (rules AttendanceRules) pairDay(events []attendanceEvent) ([]attendanceSession, int) {
+	sessions := make([]attendanceSession, 0)
+	issues := 0
+	var open *time.Time
+	for _, e := range events {
+		dir := e.Direction
+		if dir != "in" && dir != "out" {
+			if open == nil {
+				dir = "in"
+			} else {
+				dir = "out"
+			}
+		}
+		switch {
+		case dir == "in" && open == nil:
+			t := e.Time
+			open = &t
+		case dir == "in":
+			// double entry, the earlier one stays
+		case dir == "out" && open != nil:
+			sessions = append(sessions, attendanceSession{In: *open, Out: e.Time})
+			open = nil
+		default:
+			issues++
+			switch rules.MissingIn {
+			case MissingDefault:
+				// the filled in entry can't go back into the session before
+				in := midnight(e.Time).Add(rules.DayStart)
+				if n := len(sessions); n > 0 && in.Before(sessions[n-1].Out) {
+					in = sessions[n-1].Out
+				}
+				if in.After(e.Time) {
+					in = e.Time
+				}
+				sessions = append(sessions, attendanceSession{In: in, Out: e.Time, Missing: "in"})
+			case MissingTap:
+				sessions = append(sessions, attendanceSession{In: e.Time, Out: e.Time, Missing: "in"})
+			}
+		}
+	}
+	if open != nil {
+		issues++
+		switch rules.MissingOut {
+		case MissingDefault:
+			out := midnight(*open).Add(rules.DayEnd)
+			if out.Before(*open) {
+				out = *open
+			}
+			sessions = append(sessions, attendanceSession{In: *open, Out: out, Missing: "out"})
+		case MissingTap:
+			sessions = append(sessions, attendanceSession{In: *open, Out: *open, Missing: "out"})
+		}
+	}
+	return sessions, issues
+}
+
+// attendance reads the granted taps between from and to (local dates,
+// inclusive) and computes the days and the iso weeks per person
+func (rules AttendanceRules) attendance(ctx context.Context, st store.Reports, from, to string, person sql.NullInt64) ([]attendanceDay, []attendanceWeek, error) {
+	taps, err := st.Taps(ctx, store.LogFilter{From: from, To: to, Person: person, Zone: rules.Zone})
+	if err != nil {
+		return nil, nil, err
+	}
+	days := make([]attendanceDay, 0)
+	var events []attendanceEvent
+	flush := func() {
+		if len(events) == 0 {
+			return
+		}
+		d := attendanceDay{Person: events[0].Person, Name: events[0].Name, Day: events[0].Time.Format(time.DateOnly)}
+		d.Sessions, d.Issues = rules.pairDay(events)
+		for _, s := range d.Sessions {
+			d.Total += s.Out.Sub(s.In)
+		}
+		days = append(days, d)
+		events = events[:0]
+	}
+	for _, t := range taps {
+		e := attendanceEvent{Person: int(t.Person), Name: t.Name, Time: t.Time.Local(), Direction: t.Direction}
+		if len(events) != 0 && (events[0].Person != e.Person || events[0].Time.Format(time.DateOnly) != e.Time.Format(time.DateOnly)) {
+			flush()
+		}
+		events = append(events, e)
+	}
+	flush()
+	weeks := make([]attendanceWeek, 0)
+	for _, d := range days {
+		t, _ := time.ParseInLocation(time.DateOnly, d.Day, time.Local)
+		y, w := t.ISOWeek()
+		week := fmt.Sprintf("%d-W%02d", y, w)
+		i := slices.IndexFunc(weeks, func(w attendanceWeek) bool { return w.Person == d.Person && w.Week == week })
+		if i < 0 {
+			weeks = append(weeks, attendanceWeek{Person: d.Person, Name: d.Name, Week: week})
+			i = len(weeks) - 1
+		}
+		weeks[i].Days++
+		weeks[i].Total += d.Total
+		weeks[i].Issues += d.Issues
+	}
+	return days, weeks, nil
+}
+
+func hours(d time.Duration) string {
+	return strconv.FormatFloat(d.Hours(), 'f', 2, 64)
+}
+
+// AttendanceHandler is /admin/attendance?from=2025-03-01&to=2025-03-31&person=3,
+// format=csv gives the weekly payroll export
+func (s *Server) AttendanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.permitted(w, r, "attendance", PermRead) {
+		return
+	}
+	from := r.FormValue("from")
+	to := r.FormValue("to")
+	person := r.FormValue("person")
+	id, err := optionalId(person)
+	if err != nil {
+		s.drawError(w, r, http.StatusBadRequest, "Hibás kérés.")
+		return
+	}
+	days, weeks, err := s.Attendance.attendance(r.Context(), s.Store, from, to, id)
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "attendance query", "err", err)
+		s.drawError(w, r, http.StatusInternalServerError, "Adatbázis hiba.")
+		return
+	}
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("payroll_%s_%s.csv", from, to)))
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"person", "name", "week", "days", "hours", "missingPunches"})
+		for _, v := range weeks {
+			cw.Write([]string{strconv.Itoa(v.Person), v.Name, v.Week, strconv.Itoa(v.Days), hours(v.Total), strconv.Itoa(v.Issues)})
+		}
+		cw.Flush()
+		if err = cw.Error(); err != nil {
+			s.Log.ErrorContext(r.Context(), "writing payroll csv", "err", err)
+		}
+		return
+	}
+	err = s.Html.ExecuteTemplate(w, "attendance.html", struct {
+		Status headerdata
+		From   string
+		To     string
+		Person string
+		Rules  AttendanceRules
+		Days   []attendanceDay
+		Weeks  []attendanceWeek
+	}{s.statusFromContext(r, "attendance"), from, to, person, s.Attendance, days, weeks})
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+	}
+}
@@ -0,0 +1,104 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"server/store"
+)
+
+// columns that never get into the audit trail in clear text, in lower case
+// as postgres names the columns
+var auditRedacted = map[string]bool{
+	"pwhash":        true,
+	"apikey":        true,
+	"secret":        true,
+	"authtoken":     true,
+	"prevauthtoken": true,
+	"writekey":      true,
+	"readkey":       true,
+}
+
+// redact returns a copy of the rows without the keys, the rows of the
+// caller go on to the trash and the pages as they are
+func redact(rows []map[string]any) []map[string]any {
+	out := make([]map[string]any, len(rows))
+	for i, m := range rows {
+		out[i] = make(map[string]any, len(m))
+		for k, v := range m {
+			if auditRedacted[strings.ToLower(k)] {
+				v = "***"
+			}
+			out[i][k] = v
+		}
+	}
+	return out
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit writes an adminAudit row in the transaction of the change, so the
+// change and its trace are committed together
+func audit(tx store.Tables, r *http.Request, action, table string, before, after []map[string]any) error {
+	uname, _ := r.Context().Value(contextkey("uname")).(string)
+	return Audit(r.Context(), tx, uname, remoteIP(r), action, table, before, after)
+}
+
+// Audit is audit for the changes made outside of a request, like the cli
+func Audit(ctx context.Context, tx store.Tables, admin, ip, action, table string, before, after []map[string]any) error {
+	var b, a any
+	if before != nil {
+		js, err := json.Marshal(redact(before))
+		if err != nil {
+			return err
+		}
+		b = string(js)
+	}
+	if after != nil {
+		js, err := json.Marshal(redact(after))
+		if err != nil {
+			return err
+		}
+		a = string(js)
+	}
+	_, err := tx.Insert(ctx, "adminAudit", store.Row{"admin": admin, "action": action, "tableName": table, "before": b, "after": a, "ip": ip})
+	return err
+}
+
+// AuditHandler lists the audit trail, the query string filters it
+func (s *Server) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.permitted(w, r, "audit", PermRead) {
+		return
+	}
+	filter := store.AuditFilter{
+		Admin:  r.FormValue("admin"),
+		Action: r.FormValue("action"),
+		Table:  r.FormValue("table"),
+		From:   r.FormValue("from"),
+		To:     r.FormValue("to"),
+		Text:   r.FormValue("text"),
+	}
+	entries, err := s.Store.AuditLog(r.Context(), filter, 500)
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "audit query", "err", err)
+		s.drawError(w, r, http.StatusInternalServerError, "Adatbázis hiba.")
+		return
+	}
+	err = s.Html.ExecuteTemplate(w, "audit.html", struct {
+		Status  headerdata
+		Filter  store.AuditFilter
+		Entries []store.AuditEntry
+	}{Status: s.statusFromContext(r, "audit"), Filter: filter, Entries: entries})
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+	}
+}
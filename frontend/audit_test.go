@@ -0,0 +1,15 @@
+package frontend
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	rows := []map[string]any{{"serialNumber": "04:0a:0b:0c", "readKey": "titok", "apiKey": "kulcs"}}
+	got := redact(rows)
+	if got[0]["readKey"] != "***" || got[0]["apiKey"] != "***" || got[0]["serialNumber"] != "04:0a:0b:0c" {
+		t.Errorf("redacted: %v", got)
+	}
+	// the trash and the preview still need the keys
+	if rows[0]["readKey"] != "titok" || rows[0]["apiKey"] != "kulcs" {
+		t.Errorf("the rows of the caller changed: %v", rows)
+	}
+}
@@ -0,0 +1,81 @@
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"server/ratelimit"
+	"server/store"
+)
+
+// blockRow is a block of the reader api with the reader of the api key
+type blockRow struct {
+	ratelimit.Block
+	Reader string
+}
+
+// BlocksHandler lists the api keys and addresses the reader api blocks
+func (s *Server) BlocksHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.permitted(w, r, "blocks", PermRead) {
+		return
+	}
+	status := s.statusFromContext(r, "blocks")
+	rows := make([]blockRow, 0)
+	for _, b := range s.Limits.Blocks() {
+		row := blockRow{Block: b}
+		if b.Kind == ratelimit.ApiKey {
+			if reader, err := s.Store.ReaderByKey(r.Context(), b.Value); err == nil {
+				row.Reader = fmt.Sprint(reader.Id)
+				if place := strings.TrimSpace(reader.Zone + " " + reader.Direction); place != "" {
+					row.Reader += " (" + place + ")"
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+	err := s.Html.ExecuteTemplate(w, "blocks.html", struct {
+		Status headerdata
+		Blocks []blockRow
+	}{Status: status, Blocks: rows})
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+	}
+}
+
+// UnblockHandler lifts a block before it ends
+func (s *Server) UnblockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/admin/blocks", http.StatusSeeOther)
+		return
+	}
+	if !s.permitted(w, r, "blocks", PermDelete) {
+		return
+	}
+	key := ratelimit.Key{Kind: r.PostFormValue("kind"), Value: r.PostFormValue("value")}
+	// the api key is a secret, the audit gets its reader and its hash
+	var before []map[string]any
+	for _, b := range s.Limits.Blocks() {
+		if b.Key == key {
+			row := map[string]any{"key": b.Key.String(), "reason": b.Reason, "until": b.Until}
+			if b.Kind == ratelimit.ApiKey {
+				if reader, err := s.Store.ReaderByKey(r.Context(), b.Value); err == nil {
+					row["reader"] = reader.Id
+				}
+			}
+			before = append(before, row)
+		}
+	}
+	if !s.Limits.Unblock(key) {
+		s.drawError(w, r, http.StatusNotFound, "Nincs ilyen tiltás.")
+		return
+	}
+	s.Log.InfoContext(r.Context(), "unblocked", "kind", key.Kind)
+	err := s.change(r.Context(), func(tx store.Tables) error {
+		return audit(tx, r, "unblock", "blocks", before, nil)
+	})
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "unblock audit", "err", err)
+	}
+	http.Redirect(w, r, "/admin/blocks", http.StatusSeeOther)
+}
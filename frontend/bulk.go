@@ -0,0 +1,405 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"server/store"
+)
+
+// biggest accepted import file
+const maxImport = 8 << 20
+
+type (
+	bulkTable struct {
+		cols   []string // columns of the export
+		secret []string // only exported for superadmins who ask for them
+		// rows reads the export, the values in the order of cols
+		rows func(ctx context.Context, st store.Store) ([][]any, error)
+	}
+	ImportRow struct {
+		Line   int
+		Values map[string]string
+		Err    string
+	}
+)
+
+// orNil exports the empty string as NULL
+func orNil(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+var bulkTables = map[string]bulkTable{
+	"people": {
+		cols: []string{"id", "name", "permission"},
+		rows: func(ctx context.Context, st store.Store) ([][]any, error) {
+			people, err := st.ListPeople(ctx)
+			if err != nil {
+				return nil, err
+			}
+			out := make([][]any, len(people))
+			for k, p := range people {
+				out[k] = []any{p.Id, p.Name, p.Permission}
+			}
+			return out, nil
+		},
+	},
+	"cards": {
+		cols:   []string{"serialNumber", "authtoken", "writeKey", "readKey", "owner", "ownerName"},
+		secret: []string{"authtoken", "writeKey", "readKey"},
+		rows: func(ctx context.Context, st store.Store) ([][]any, error) {
+			cards, err := st.ListCards(ctx)
+			if err != nil {
+				return nil, err
+			}
+			people, err := st.ListPeople(ctx)
+			if err != nil {
+				return nil, err
+			}
+			names := make(map[int64]string, len(people))
+			for _, p := range people {
+				names[p.Id] = p.Name
+			}
+			out := make([][]any, len(cards))
+			for k, c := range cards {
+				var name any
+				if n, ok := names[c.Owner]; ok {
+					name = n
+				}
+				out[k] = []any{c.SerialNumber, c.Authtoken, c.WriteKey, c.ReadKey, c.Owner, name}
+			}
+			return out, nil
+		},
+	},
+	"readers": {
+		cols:   []string{"id", "apiKey", "addCard", "writeCard", "zone", "direction"},
+		secret: []string{"apiKey"},
+		rows: func(ctx context.Context, st store.Store) ([][]any, error) {
+			readers, err := st.ListReaders(ctx)
+			if err != nil {
+				return nil, err
+			}
+			out := make([][]any, len(readers))
+			for k, r := range readers {
+				out[k] = []any{r.Id, r.ApiKey, r.AddCard, r.WriteCard, orNil(r.Zone), orNil(r.Direction)}
+			}
+			return out, nil
+		},
+	},
+}
+
+// columns of the import files, the first ones are needed
+var importCols = map[string][]string{
+	"people": {"name", "permission", "id"},
+	"cards":  {"serialNumber", "authtoken", "writeKey", "readKey", "owner", "ownerName", "ownerPermission"},
+}
+
+// ExportHandler writes a table as csv or json: /admin/export/cards?format=csv&secrets=1
+func (s *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	page := r.PathValue("page")
+	bt, ok := bulkTables[page]
+	if !ok {
+		s.drawError(w, r, http.StatusNotFound, "Ismeretlen tábla.")
+		return
+	}
+	if !s.permitted(w, r, page, PermRead) {
+		return
+	}
+	status := s.statusFromContext(r, page)
+	secrets := r.FormValue("secrets") != ""
+	if secrets && status.Role != "superadmin" {
+		s.drawError(w, r, http.StatusForbidden, "A kulcsokat csak superadmin exportálhatja.")
+		return
+	}
+	format := r.FormValue("format")
+	if format != "csv" && format != "json" {
+		s.drawError(w, r, http.StatusBadRequest, "Ismeretlen formátum.")
+		return
+	}
+	values, err := bt.rows(r.Context(), s.Store)
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "export query", "table", page, "err", err)
+		s.drawError(w, r, http.StatusInternalServerError, "Adatbázis hiba.")
+		return
+	}
+	cols := make([]int, 0, len(bt.cols))
+	for k, v := range bt.cols {
+		isSecret := false
+		for _, sec := range bt.secret {
+			isSecret = isSecret || sec == v
+		}
+		if secrets || !isSecret {
+			cols = append(cols, k)
+		}
+	}
+	records := make([][]any, 0, len(values))
+	for _, row := range values {
+		record := make([]any, len(cols))
+		for k, v := range cols {
+			record[k] = row[v]
+		}
+		records = append(records, record)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", page+"."+format))
+	if format == "json" {
+		out := make([]map[string]any, len(records))
+		for i, record := range records {
+			out[i] = make(map[string]any, len(cols))
+			for k, v := range cols {
+				out[i][bt.cols[v]] = record[k]
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(out)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		header := make([]string, len(cols))
+		for k, v := range cols {
+			header[k] = bt.cols[v]
+		}
+		cw.Write(header)
+		for _, record := range records {
+			line := make([]string, len(record))
+			for k, v := range record {
+				if v != nil {
+					line[k] = fmt.Sprint(v)
+				}
+			}
+			cw.Write(line)
+		}
+		cw.Flush()
+		err = cw.Error()
+	}
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "writing export", "table", page, "err", err)
+	}
+}
+
+// ParseImport reads csv (with a header line) or a json array of objects
+func ParseImport(format string, data []byte) ([]ImportRow, error) {
+	out := make([]ImportRow, 0)
+	switch format {
+	case "csv":
+		cr := csv.NewReader(bytes.NewReader(data))
+		cr.FieldsPerRecord = -1
+		cr.TrimLeadingSpace = true
+		header, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+		for line := 2; ; line++ {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			row := ImportRow{Line: line, Values: make(map[string]string, len(header))}
+			for k, v := range header {
+				if k < len(record) {
+					row.Values[strings.TrimSpace(v)] = strings.TrimSpace(record[k])
+				}
+			}
+			out = append(out, row)
+		}
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var records []map[string]any
+		err := dec.Decode(&records)
+		if err != nil {
+			return nil, err
+		}
+		for k, record := range records {
+			row := ImportRow{Line: k + 1, Values: make(map[string]string, len(record))}
+			for name, v := range record {
+				if v != nil {
+					row.Values[name] = strings.TrimSpace(fmt.Sprint(v))
+				}
+			}
+			out = append(out, row)
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return out, nil
+}
+
+func importPeople(ctx context.Context, tx store.Tables, v map[string]string) error {
+	if v["name"] == "" {
+		return errors.New("üres name")
+	}
+	row := store.Row{"name": v["name"], "permission": v["permission"]}
+	if v["id"] != "" {
+		id, err := strconv.Atoi(v["id"])
+		if err != nil {
+			return errors.New("az id nem szám")
+		}
+		row["id"] = id
+	}
+	_, err := tx.Insert(ctx, "people", row)
+	return err
+}
+
+// cards come with their owner, either the id of an existing person or a name,
+// unknown names are added to people with ownerPermission
+func importCard(ctx context.Context, tx store.Tables, v map[string]string) error {
+	for _, k := range []string{"serialNumber", "authtoken", "writeKey", "readKey"} {
+		if v[k] == "" {
+			return fmt.Errorf("üres %s", k)
+		}
+	}
+	var owner any
+	switch {
+	case v["owner"] != "":
+		id, err := strconv.ParseInt(v["owner"], 10, 64)
+		if err != nil {
+			return errors.New("az owner nem szám")
+		}
+		people, err := tx.Rows(ctx, "people", []string{"id"}, store.Row{"id": id})
+		if err != nil {
+			return err
+		}
+		if len(people) == 0 {
+			return fmt.Errorf("nincs %d id-jű ember", id)
+		}
+		owner = id
+	case v["ownerName"] != "":
+		// the first one of the namesakes
+		people, err := tx.Rows(ctx, "people", []string{"id"}, store.Row{"name": v["ownerName"]})
+		if err != nil {
+			return err
+		}
+		if len(people) != 0 {
+			owner = people[0]["id"]
+			break
+		}
+		added, err := tx.Insert(ctx, "people", store.Row{"name": v["ownerName"], "permission": v["ownerPermission"]})
+		if err != nil {
+			return err
+		}
+		owner = added["id"]
+	default:
+		return errors.New("nincs owner vagy ownerName")
+	}
+	_, err := tx.Insert(ctx, "cards", store.Row{"serialNumber": v["serialNumber"], "authtoken": v["authtoken"], "writeKey": v["writeKey"], "readKey": v["readKey"], "owner": owner})
+	return err
+}
+
+// ImportRows inserts the rows into people or cards in tx, the failed rows get
+// their Err. It returns the imported rows for the audit and the failed count.
+func ImportRows(ctx context.Context, tx store.Tables, page string, rows []ImportRow) ([]map[string]any, int) {
+	importer := importPeople
+	if page == "cards" {
+		importer = importCard
+	}
+	failed := 0
+	after := make([]map[string]any, 0, len(rows))
+	for k, row := range rows {
+		err := importer(ctx, tx, row.Values)
+		if err != nil {
+			rows[k].Err = err.Error()
+			failed++
+			continue
+		}
+		m := make(map[string]any, len(row.Values))
+		for name, v := range row.Values {
+			m[name] = v
+		}
+		after = append(after, m)
+	}
+	return after, failed
+}
+
+// ErrDryRun rolls back an import that is only shown
+var ErrDryRun = errors.New("dry run")
+
+// ImportFactory makes the import page of people or cards. Every post is a dry
+// run showing the per row result, the rows are only committed when the form
+// has commit set and none of them failed.
+func (s *Server) ImportFactory(page string) http.HandlerFunc {
+	table := page
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.permitted(w, r, page, PermCreate) {
+			return
+		}
+		data := struct {
+			Status    headerdata
+			Url       string
+			Cols      []string
+			Format    string
+			Raw       string
+			Rows      []ImportRow
+			Failed    int
+			Committed bool
+		}{Status: s.statusFromContext(r, page), Url: page, Cols: importCols[page]}
+		if r.Method != http.MethodPost {
+			err := s.Html.ExecuteTemplate(w, "import.html", data)
+			if err != nil {
+				s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+			}
+			return
+		}
+		data.Format = r.FormValue("format")
+		data.Raw = r.FormValue("data")
+		if f, h, err := r.FormFile("file"); err == nil {
+			// one byte over the limit tells a too big file from one that fits
+			raw, err := io.ReadAll(io.LimitReader(f, maxImport+1))
+			f.Close()
+			if err != nil {
+				s.drawError(w, r, http.StatusBadRequest, "Nem sikerült beolvasni a fájlt.")
+				return
+			}
+			if len(raw) > maxImport {
+				s.drawError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("A fájl túl nagy, legfeljebb %d MB lehet.", maxImport>>20))
+				return
+			}
+			data.Raw = string(raw)
+			if data.Format == "" {
+				data.Format = strings.TrimPrefix(path.Ext(h.Filename), ".")
+			}
+		}
+		var err error
+		data.Rows, err = ParseImport(data.Format, []byte(data.Raw))
+		if err != nil {
+			s.drawError(w, r, http.StatusBadRequest, "Hibás import fájl: "+err.Error())
+			return
+		}
+		commit := r.FormValue("commit") != ""
+		err = s.change(r.Context(), func(tx store.Tables) error {
+			var after []map[string]any
+			after, data.Failed = ImportRows(r.Context(), tx, page, data.Rows)
+			if !commit || data.Failed != 0 || len(data.Rows) == 0 {
+				return ErrDryRun
+			}
+			return audit(tx, r, "import", table, nil, after)
+		})
+		switch {
+		case errors.Is(err, ErrDryRun):
+		case err != nil:
+			s.Log.ErrorContext(r.Context(), "import", "table", table, "err", err)
+			s.drawError(w, r, http.StatusInternalServerError, "Adatbázis hiba.")
+			return
+		default:
+			data.Committed = true
+		}
+		err = s.Html.ExecuteTemplate(w, "import.html", data)
+		if err != nil {
+			s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+		}
+	}
+}
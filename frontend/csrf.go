@@ -0,0 +1,99 @@
+package frontend
+
+import (
+	crand "crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var ErrInvalidCsrf = errors.New("invalid csrf token")
+
+// accepted tokens for the request: the one of the session behind the AUTH
+// cookie and the pre session one from the CSRF cookie (login form)
+func (s *Server) requestCsrf(r *http.Request) []string {
+	tokens := make([]string, 0, 2)
+	if c, err := r.Cookie("AUTH"); err == nil {
+		if token, err := s.Sessions.csrf(c.Value); err == nil {
+			tokens = append(tokens, token)
+		}
+	}
+	if c, err := r.Cookie("CSRF"); err == nil && c.Value != "" {
+		tokens = append(tokens, c.Value)
+	}
+	return tokens
+}
+
+// sets a fresh pre session token for forms rendered before login
+func newPreSessionCsrf(w http.ResponseWriter) string {
+	token := crand.Text()
+	http.SetCookie(w, &http.Cookie{
+		Name:     "CSRF",
+		Value:    token,
+		Path:     "/admin/login",
+		MaxAge:   3600,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+func (s *Server) drawError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	status := headerdata{Title: "error", features: s.features}
+	if uname, ok := r.Context().Value(contextkey("uname")).(string); ok {
+		status.Loggedin = true
+		status.Uname = uname
+		status.Role, _ = r.Context().Value(contextkey("role")).(string)
+	}
+	w.WriteHeader(code)
+	err := s.Html.ExecuteTemplate(w, "error.html", struct {
+		Status  headerdata
+		Message string
+	}{Status: status, Message: message})
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+	}
+}
+
+// CsrfProtect rejects every non GET/HEAD request whose "csrf" form value
+// doesn't match the token of the session
+func (s *Server) CsrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		expected := s.requestCsrf(r)
+		if len(expected) == 0 {
+			s.Log.WarnContext(r.Context(), "csrf: no token for request", "path", r.URL.Path)
+			s.drawError(w, r, http.StatusForbidden, "Lejárt vagy hibás űrlap, töltsd újra az oldalt.")
+			return
+		}
+		var err error
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			err = r.ParseMultipartForm(maxImport)
+		} else {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			s.Log.WarnContext(r.Context(), "csrf: bad form", "path", r.URL.Path, "err", err)
+			s.drawError(w, r, http.StatusBadRequest, "Hibás kérés.")
+			return
+		}
+		got := []byte(r.PostFormValue("csrf"))
+		ok := false
+		for _, v := range expected {
+			if subtle.ConstantTimeCompare(got, []byte(v)) == 1 {
+				ok = true
+			}
+		}
+		if !ok {
+			s.Log.WarnContext(r.Context(), "csrf: token mismatch", "path", r.URL.Path)
+			s.drawError(w, r, http.StatusForbidden, "Lejárt vagy hibás űrlap, töltsd újra az oldalt.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -4,79 +4,108 @@ import (
 	"bytes"
 	"context"
 	crand "crypto/rand"
-	"database/sql"
 	"errors"
 	"fmt"
-	htmltemplate "html/template"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
-	"text/template"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
-	_ "github.com/mattn/go-sqlite3"
+	"server/store"
 )
 
 var ErrInvalidCooki = errors.New("invalid auth cookie")
 
-var (
-	Database  *sql.DB
-	Htmltmpl  *htmltemplate.Template
-	Txttmpl   *template.Template
-	Authstore autstore
-)
-
 type (
 	contextkey string
 	headerdata struct {
 		Uname    string
 		Loggedin bool
-		AdminTab bool
+		Role     string
 		Title    string
+		Csrf     string
+		features map[string]bool
 	}
 	renderData struct {
 		Status headerdata
 		Filds  []map[string]any
 	}
 	Authcookie struct {
-		cookie   string
-		uname    string
-		time     time.Time
-		adminTab bool
+		cookie string
+		uname  string
+		time   time.Time
+		role   string
+		csrf   string
 	}
 	autstore struct {
-		Cookies []Authcookie
-		lock    sync.Mutex
-		Ticker  time.Ticker
-		Done    chan bool
+		Cookies  []Authcookie
+		lock     sync.Mutex
+		Lifetime time.Duration
+		Ticker   time.Ticker
+		Done     chan bool
 	}
 )
 
-func (s *autstore) valid(cookie string) (string, bool, error) {
+func (s *autstore) valid(cookie string) (string, string, error) {
 	s.lock.Lock()
 	for k, v := range s.Cookies {
-		if (v.cookie == cookie) && (time.Since(v.time) < 1*time.Hour) {
+		if (v.cookie == cookie) && (time.Since(v.time) < s.Lifetime) {
 			s.Cookies[k].time = time.Now()
 			uname := v.uname
-			ad := v.adminTab
+			role := v.role
 			s.lock.Unlock()
-			return uname, ad, nil
+			return uname, role, nil
 		}
 	}
 	s.lock.Unlock()
-	return "", false, ErrInvalidCooki
+	return "", "", ErrInvalidCooki
 }
 
-func (s *autstore) add(cookie, uname string, admintab bool) {
+func (s *autstore) csrf(cookie string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, v := range s.Cookies {
+		if (v.cookie == cookie) && (time.Since(v.time) < s.Lifetime) {
+			return v.csrf, nil
+		}
+	}
+	return "", ErrInvalidCooki
+}
+
+func (s *autstore) add(cookie, uname, role string) {
 	now := time.Now()
-	c := Authcookie{cookie: cookie, uname: uname, time: now, adminTab: admintab}
+	c := Authcookie{cookie: cookie, uname: uname, time: now, role: role, csrf: crand.Text()}
 	s.lock.Lock()
 	s.Cookies = append(s.Cookies, c)
 	s.lock.Unlock()
 }
 
+// remove ends the session of the cookie
+func (s *autstore) remove(cookie string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Cookies = slices.DeleteFunc(s.Cookies, func(v Authcookie) bool {
+		return v.cookie == cookie
+	})
+}
+
+// Active is the number of the sessions that didn't expire yet
+func (s *autstore) Active() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for _, v := range s.Cookies {
+		if time.Since(v.time) < s.Lifetime {
+			n++
+		}
+	}
+	return n
+}
+
 func (s *autstore) Clean() {
 	for {
 		select {
@@ -86,7 +115,7 @@ func (s *autstore) Clean() {
 			s.lock.Lock()
 			newcookies := make([]Authcookie, 0, len(s.Cookies))
 			for _, v := range s.Cookies {
-				if time.Since(v.time) < 1*time.Hour {
+				if time.Since(v.time) < s.Lifetime {
 					newcookies = append(newcookies, v)
 				}
 			}
@@ -100,7 +129,7 @@ func RootHandler(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, "./admin", http.StatusSeeOther)
 }
 
-func LoginNeeded(next http.Handler, admintab bool) http.Handler {
+func (s *Server) LoginNeeded(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c, err := r.Cookie("AUTH")
 		if err != nil {
@@ -109,190 +138,182 @@ func LoginNeeded(next http.Handler, admintab bool) http.Handler {
 				return
 			}
 		}
-		uname, at, err := Authstore.valid(c.Value)
+		uname, role, err := s.Sessions.valid(c.Value)
 		if err != nil {
 			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
 			return
 		}
-		if admintab {
-			if !at {
-				http.Error(w, "Access Denied", http.StatusForbidden)
-				return
-			}
+		// the admin may have been deleted, disabled or given another role
+		// since the login, in the ui or the cli of another process
+		admin, err := s.Store.Admin(r.Context(), uname)
+		if err != nil || admin.Disabled || admin.Role != role {
+			s.Log.InfoContext(r.Context(), "session dropped, the admin changed", "user", uname, "err", err)
+			s.Sessions.remove(c.Value)
+			http.SetCookie(w, &http.Cookie{Name: "AUTH", Path: "/", MaxAge: -1})
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			return
 		}
-		c.MaxAge = 3600
+		c.MaxAge = int(s.Sessions.Lifetime.Seconds())
 		c.Path = "/"
 		http.SetCookie(w, c)
 		cont := r.Context()
 		cont = context.WithValue(cont, contextkey("uname"), uname)
-		cont = context.WithValue(cont, contextkey("adminTab"), at)
+		cont = context.WithValue(cont, contextkey("role"), role)
+		token, _ := s.Sessions.csrf(c.Value)
+		cont = context.WithValue(cont, contextkey("csrf"), token)
 		next.ServeHTTP(w, r.WithContext(cont))
 		return
 	})
 }
 
-func ComputepwHash(pw []byte) []byte {
-	hash, _ := bcrypt.GenerateFromPassword(pw, bcrypt.DefaultCost)
-	return hash
+// ComputepwHash is the bcrypt hash of the password, bcrypt.ErrPasswordTooLong
+// over 72 bytes
+func ComputepwHash(pw []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(pw, bcrypt.DefaultCost)
 }
 
-func Login(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 	drawLogin := func(Failed bool) {
-		status := headerdata{Loggedin: false, Title: "login", AdminTab: false}
-		err := Htmltmpl.ExecuteTemplate(w, "login.html", struct {
+		status := headerdata{Loggedin: false, Title: "login", Csrf: newPreSessionCsrf(w), features: s.features}
+		err := s.Html.ExecuteTemplate(w, "login.html", struct {
 			Status headerdata
 			Failed bool
 		}{Status: status, Failed: Failed})
 		if err != nil {
-			fmt.Println(err)
+			s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
 		}
 	}
 	if r.Method == http.MethodPost {
 		err := r.ParseForm()
 		if err != nil {
-			fmt.Println("error: ", err.Error())
+			s.Log.WarnContext(r.Context(), "login: bad form", "err", err)
 			return
 		}
 		uname := r.FormValue("username")
 		passwd := r.FormValue("password")
-		tx, err := Database.Begin()
-		defer tx.Rollback()
+		admin, err := s.Store.Admin(r.Context(), uname)
 		if err != nil {
-			fmt.Println("error: ", err.Error())
+			s.Log.InfoContext(r.Context(), "login: unknown user", "user", uname, "remote", remoteIP(r), "err", err)
+			drawLogin(true)
 			return
 		}
-		row := tx.QueryRow("SELECT pwhash, adminTab FROM admins WHERE username=? LIMIT 1", uname)
-		var dbHash string
-		var adminTab bool
-		err = row.Scan(&dbHash, &adminTab)
+		err = bcrypt.CompareHashAndPassword([]byte(admin.Pwhash), []byte(passwd))
 		if err != nil {
-			fmt.Println("error: ", err.Error())
+			s.Log.InfoContext(r.Context(), "login: bad password", "user", uname, "remote", remoteIP(r))
 			drawLogin(true)
 			return
 		}
-		err = bcrypt.CompareHashAndPassword([]byte(dbHash), []byte(passwd))
-		if err != nil {
-			fmt.Println(err)
+		if admin.Disabled {
+			s.Log.InfoContext(r.Context(), "login: disabled admin", "user", uname, "remote", remoteIP(r))
 			drawLogin(true)
+			return
 		}
+		http.SetCookie(w, &http.Cookie{Name: "CSRF", Path: "/admin/login", MaxAge: -1})
 		authtoken := crand.Text()
-		Authstore.add(authtoken, uname, adminTab)
+		s.Sessions.add(authtoken, uname, admin.Role)
 		cookie := http.Cookie{
 			Name:     "AUTH",
 			Value:    authtoken,
 			Path:     "/",
-			MaxAge:   3600,
+			MaxAge:   int(s.Sessions.Lifetime.Seconds()),
 			HttpOnly: true,
 			Secure:   true,
 			SameSite: http.SameSiteStrictMode,
 		}
 		http.SetCookie(w, &cookie)
+		s.Log.InfoContext(r.Context(), "login", "user", uname, "role", admin.Role, "remote", remoteIP(r))
 		http.Redirect(w, r, "/admin", http.StatusSeeOther)
 	} else {
 		drawLogin(false)
 	}
 }
 
-func Logout(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
 	c, err := r.Cookie("AUTH")
 	if err != nil {
-		println(err)
+		s.Log.DebugContext(r.Context(), "logout without cookie", "err", err)
 		return
 	}
-	c.MaxAge = -1
-	http.SetCookie(w, c)
+	s.Sessions.remove(c.Value)
+	http.SetCookie(w, &http.Cookie{Name: "AUTH", Path: "/", MaxAge: -1})
 	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
 }
 
-func Admin(w http.ResponseWriter, r *http.Request) {
-	cont := r.Context()
-	uname := cont.Value(contextkey("uname")).(string)
-	admintab := cont.Value(contextkey("adminTab")).(bool)
-	status := headerdata{Loggedin: true, Title: "main", Uname: uname, AdminTab: admintab}
-	fmt.Println("render main")
-	err := Htmltmpl.ExecuteTemplate(w, "home.html", status)
+func (s *Server) Admin(w http.ResponseWriter, r *http.Request) {
+	status := s.statusFromContext(r, "main")
+	err := s.Html.ExecuteTemplate(w, "home.html", status)
 	if err != nil {
-		fmt.Println(err)
+		s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
 	}
 }
 
-func TableFactory(title string, fildNames []string, table string) http.HandlerFunc {
-	sqlfilds := ""
-	for _, v := range fildNames {
-		sqlfilds += v
-		sqlfilds += ", "
-	}
-	sqlfilds = sqlfilds[0:(len(sqlfilds) - 2)]
-	query := fmt.Sprintf("Select %s from %s", sqlfilds, table)
+func (s *Server) TableFactory(title string, fildNames []string, table string) http.HandlerFunc {
 	args := struct {
 		FildNames []string
 		Url       string
 	}{fildNames, title}
 	buff := new(bytes.Buffer)
-	Txttmpl.ExecuteTemplate(buff, "magic.html.tmpl", args)
-	templ, err := Htmltmpl.Clone()
+	s.Txt.ExecuteTemplate(buff, "magic.html.tmpl", args)
+	templ, err := s.Html.Clone()
 	if err != nil {
 		panic(err)
 	}
 	templ, err = templ.Parse(buff.String())
 	if err != nil {
-		fmt.Println("fuck this shit")
+		s.Log.Error("parsing table template", "table", title, "err", err)
 		panic(err)
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		cont := r.Context()
-		uname := cont.Value(contextkey("uname")).(string)
-		admintab := cont.Value(contextkey("adminTab")).(bool)
-		status := headerdata{Loggedin: true, Title: title, Uname: uname, AdminTab: admintab}
-		tx, err := Database.Begin()
-		if err != nil {
-			fmt.Println(err)
+		if !s.permitted(w, r, title, PermRead) {
 			return
 		}
-		rows, err := tx.Query(query)
+		var data renderData
+		data.Status = s.statusFromContext(r, title)
+		var err error
+		data.Filds, err = s.Store.Rows(r.Context(), table, fildNames, nil)
 		if err != nil {
-			fmt.Println(err)
-			tx.Rollback()
+			s.Log.ErrorContext(r.Context(), "table query", "table", table, "err", err)
 			return
 		}
-		defer rows.Close()
-
-		var data renderData
-		data.Status = status
-		data.Filds = make([]map[string]any, 0)
-		cols, _ := rows.Columns()
-		for rows.Next() {
-			// Create a slice of interface{}'s to represent each column,
-			// and a second slice to contain pointers to each item in the columns slice.
-			columns := make([]interface{}, len(cols))
-			columnPointers := make([]interface{}, len(cols))
-			for i := range columns {
-				columnPointers[i] = &columns[i]
-			}
+		err = templ.ExecuteTemplate(w, "magic", data)
+		if err != nil {
+			s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+		}
+	}
+}
 
-			err := rows.Scan(columnPointers...)
+// formRow reads the checked fields of the add and delete forms, the error
+// is the message to the admin: a number field isn't a number or a password
+// is too long
+func formRow(r *http.Request, fildNames, fildTypes []string) (store.Row, error) {
+	row := make(store.Row, len(fildNames))
+	for k, v := range fildNames {
+		if r.FormValue(v+"box") == "" {
+			continue
+		}
+		value := r.FormValue(v)
+		switch fildTypes[k] {
+		case "number":
+			n, err := strconv.Atoi(value)
 			if err != nil {
-				fmt.Println("error: " + err.Error())
-				tx.Rollback()
-				return
+				return nil, fmt.Errorf("A(z) %s mező nem szám.", v)
 			}
-			m := make(map[string]interface{})
-			for i, colName := range cols {
-				val := columnPointers[i].(*interface{})
-				m[colName] = *val
+			row[v] = n
+		case "password":
+			hash, err := ComputepwHash([]byte(value))
+			if err != nil {
+				return nil, fmt.Errorf("A(z) %s mező túl hosszú, legfeljebb 72 bájt lehet.", v)
 			}
-			data.Filds = append(data.Filds, m)
-		}
-		tx.Commit()
-		err = templ.ExecuteTemplate(w, "magic", data)
-		if err != nil {
-			fmt.Println(err)
+			row[v] = string(hash)
+		default:
+			row[v] = value
 		}
 	}
+	return row, nil
 }
 
-func AddFactory(title string, fildNames []string, fildTypes []string, table string) http.HandlerFunc {
+func (s *Server) AddFactory(title string, fildNames []string, fildTypes []string, table string) http.HandlerFunc {
 	type FildNames struct {
 		Name string
 		Type string
@@ -307,8 +328,8 @@ func AddFactory(title string, fildNames []string, fildTypes []string, table stri
 		Url       string
 	}{fnames, title}
 	buff := new(bytes.Buffer)
-	Txttmpl.ExecuteTemplate(buff, "magicAdd.html.tmpl", args)
-	templ, err := Htmltmpl.Clone()
+	s.Txt.ExecuteTemplate(buff, "magicAdd.html.tmpl", args)
+	templ, err := s.Html.Clone()
 	if err != nil {
 		panic(err)
 	}
@@ -318,69 +339,39 @@ func AddFactory(title string, fildNames []string, fildTypes []string, table stri
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.permitted(w, r, title, PermCreate) {
+			return
+		}
 		if r.Method == http.MethodPost {
 			r.ParseForm()
-			queryfilds := make([]string, 0, len(fildNames))
-			queryvalues := make([]any, 0, len(fildNames))
-			for k, v := range fildNames {
-				b := r.FormValue(v + "box")
-				if b != "" {
-					queryfilds = append(queryfilds, v)
-					value := r.FormValue(v)
-					switch fildTypes[k] {
-					case "number":
-						n, err := strconv.Atoi(value)
-						if err != nil {
-							fmt.Println(err)
-							return
-						}
-						queryvalues = append(queryvalues, n)
-					case "password":
-						queryvalues = append(queryvalues, ComputepwHash([]byte(value)))
-					default:
-						queryvalues = append(queryvalues, value)
-					}
-				}
-			}
-			query := "INSERT INTO " + table + " ("
-			for _, v := range queryfilds {
-				query += v + ", "
-			}
-			query = query[:len(query)-2] + ") VALUES ("
-			for range queryvalues {
-				query += "?, "
-			}
-			query = query[:len(query)-2] + ")"
-			tx, err := Database.Begin()
+			row, err := formRow(r, fildNames, fildTypes)
 			if err != nil {
-				fmt.Println(err)
+				s.Log.WarnContext(r.Context(), "add: bad field", "table", table, "err", err)
+				s.drawError(w, r, http.StatusBadRequest, err.Error())
 				return
 			}
-			_, err = tx.Exec(query, queryvalues...)
-			if err != nil {
-				fmt.Fprintln(w, err)
-				tx.Rollback()
-				return
-			}
-			err = tx.Commit()
+			err = s.change(r.Context(), func(tx store.Tables) error {
+				added, err := tx.Insert(r.Context(), table, row)
+				if err != nil {
+					return err
+				}
+				return audit(tx, r, "add", table, nil, []map[string]any{added})
+			})
 			if err != nil {
+				s.Log.ErrorContext(r.Context(), "add", "table", table, "err", err)
 				fmt.Fprintln(w, err)
-				tx.Rollback()
 				return
 			}
 			http.Redirect(w, r, "/admin/"+title, http.StatusSeeOther)
 
 			return
 		}
-		cont := r.Context()
-		uname := cont.Value(contextkey("uname")).(string)
-		admintab := cont.Value(contextkey("adminTab")).(bool)
-		status := headerdata{Loggedin: true, Title: title, Uname: uname, AdminTab: admintab}
+		status := s.statusFromContext(r, title)
 		err = templ.ExecuteTemplate(w, "magicadd", status)
 	}
 }
 
-func DelFactory(title string, fildNames []string, fildTypes []string, table string) http.HandlerFunc {
+func (s *Server) DelFactory(title string, fildNames []string, fildTypes []string, table string) http.HandlerFunc {
 	type FildNames struct {
 		Name string
 		Type string
@@ -395,8 +386,8 @@ func DelFactory(title string, fildNames []string, fildTypes []string, table stri
 		Url       string
 	}{fnames, title}
 	buff := new(bytes.Buffer)
-	Txttmpl.ExecuteTemplate(buff, "magicDel.html.tmpl", args)
-	templ, err := Htmltmpl.Clone()
+	s.Txt.ExecuteTemplate(buff, "magicDel.html.tmpl", args)
+	templ, err := s.Html.Clone()
 	if err != nil {
 		panic(err)
 	}
@@ -406,99 +397,157 @@ func DelFactory(title string, fildNames []string, fildTypes []string, table stri
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.permitted(w, r, title, PermDelete) {
+			return
+		}
 		if r.Method == http.MethodPost {
 			r.ParseForm()
-			queryfilds := make([]string, 0, len(fildNames))
-			queryvalues := make([]any, 0, len(fildNames))
-			for k, v := range fildNames {
-				b := r.FormValue(v + "box")
-				if b != "" {
-					queryfilds = append(queryfilds, v)
-					value := r.FormValue(v)
-					switch fildTypes[k] {
-					case "number":
-						n, err := strconv.Atoi(value)
-						if err != nil {
-							fmt.Println(err)
-							return
-						}
-						queryvalues = append(queryvalues, n)
-					case "password":
-						queryvalues = append(queryvalues, ComputepwHash([]byte(value)))
-					default:
-						queryvalues = append(queryvalues, value)
-					}
-				}
+			where, err := formRow(r, fildNames, fildTypes)
+			if err != nil {
+				s.Log.WarnContext(r.Context(), "delete: bad field", "table", table, "err", err)
+				s.drawError(w, r, http.StatusBadRequest, err.Error())
+				return
 			}
-			query := "DELETE FROM " + table + " WHERE "
-			for _, v := range queryfilds {
-				query += v + " = ? AND"
+			if len(where) == 0 {
+				s.drawError(w, r, http.StatusBadRequest, "Feltétel nélkül nem lehet törölni, jelölj be legalább egy mezőt.")
+				return
 			}
-			query = query[:len(query)-3]
-			tx, err := Database.Begin()
-			if err != nil {
-				fmt.Println(err)
+			if r.PostFormValue("confirm") == "" {
+				before, err := s.Store.Rows(r.Context(), table, nil, where)
+				if err != nil {
+					s.Log.ErrorContext(r.Context(), "delete", "table", table, "err", err)
+					fmt.Fprintln(w, err)
+					return
+				}
+				type hidden struct {
+					Name  string
+					Value string
+				}
+				conds := make([]string, 0, len(where))
+				fields := make([]hidden, 0, 2*len(where))
+				for _, v := range fildNames {
+					if _, ok := where[v]; ok {
+						conds = append(conds, v+" = ?")
+						fields = append(fields, hidden{v + "box", "on"}, hidden{v, r.FormValue(v)})
+					}
+				}
+				err = s.Html.ExecuteTemplate(w, "deletepreview.html", struct {
+					Status    headerdata
+					Url       string
+					Where     string
+					FildNames []string
+					Rows      []map[string]any
+					Hidden    []hidden
+					Days      int
+				}{s.statusFromContext(r, title), title, strings.Join(conds, " AND "), fildNames, before, fields, s.Trash.Days})
+				if err != nil {
+					s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+				}
 				return
 			}
-			_, err = tx.Exec(query, queryvalues...)
-			if err != nil {
-				fmt.Fprintln(w, err)
-				tx.Rollback()
+			err = s.change(r.Context(), func(tx store.Tables) error {
+				before, err := tx.Rows(r.Context(), table, nil, where)
+				if err != nil {
+					return err
+				}
+				err = moveToTrash(tx, r, title, table, before)
+				if err != nil {
+					return err
+				}
+				_, err = tx.Delete(r.Context(), table, where)
+				if err != nil {
+					return err
+				}
+				if table == "admins" {
+					err = KeepSuperadmin(r.Context(), tx, before)
+					if err != nil {
+						return err
+					}
+				}
+				return audit(tx, r, "delete", table, before, nil)
+			})
+			if errors.Is(err, ErrLastSuperadmin) {
+				s.drawError(w, r, http.StatusConflict, "Az utolsó engedélyezett superadmint nem lehet törölni.")
 				return
 			}
-			err = tx.Commit()
 			if err != nil {
+				s.Log.ErrorContext(r.Context(), "delete", "table", table, "err", err)
 				fmt.Fprintln(w, err)
-				tx.Rollback()
 				return
 			}
 			http.Redirect(w, r, "/admin/"+title, http.StatusSeeOther)
 
 			return
 		}
-		cont := r.Context()
-		uname := cont.Value(contextkey("uname")).(string)
-		admintab := cont.Value(contextkey("adminTab")).(bool)
-		status := headerdata{Loggedin: true, Title: title, Uname: uname, AdminTab: admintab}
+		status := s.statusFromContext(r, title)
 		err = templ.ExecuteTemplate(w, "magicdel", status)
 	}
 }
 
-func AddEndpoints() {
-	http.HandleFunc("GET /{$}", RootHandler)
-	http.Handle("/admin", LoginNeeded(http.HandlerFunc(Admin), false))
-
-	http.Handle("/admin/logout", LoginNeeded(http.HandlerFunc(Logout), false))
-	http.HandleFunc("/admin/login", Login)
-
-	logHandler := TableFactory("logs", []string{"id", "card", "reader", "people", "allowed", "direction", "comment"}, "accessLog")
-	http.Handle("/admin/logs", LoginNeeded(http.HandlerFunc(logHandler), false))
-
-	cardsHandler := TableFactory("cards", []string{"serialNumber", "authtoken", "writeKey", "readKey", "owner"}, "cards")
-	cardsAdd := AddFactory("cards", []string{"serialNumber", "authtoken", "writeKey", "readKey", "owner"}, []string{"text", "text", "text", "text", "number"}, "cards")
-	cardsDel := DelFactory("cards", []string{"serialNumber", "authtoken", "writeKey", "readKey", "owner"}, []string{"text", "text", "text", "text", "number"}, "cards")
-	http.Handle("/admin/cards", LoginNeeded(http.HandlerFunc(cardsHandler), false))
-	http.Handle("/admin/cards/add", LoginNeeded(http.HandlerFunc(cardsAdd), false))
-	http.Handle("/admin/cards/delete", LoginNeeded(http.HandlerFunc(cardsDel), false))
-
-	readerHandler := TableFactory("readers", []string{"id", "apiKey", "addCard", "writeCard"}, "reader")
-	readerAdd := AddFactory("readers", []string{"id", "apiKey", "addCard", "writeCard"}, []string{"number", "text", "number", "number"}, "reader")
-	readerDel := DelFactory("readers", []string{"id", "apiKey", "addCard", "writeCard"}, []string{"number", "text", "number", "number"}, "reader")
-	http.Handle("/admin/readers", LoginNeeded(http.HandlerFunc(readerHandler), false))
-	http.Handle("/admin/readers/add", LoginNeeded(http.HandlerFunc(readerAdd), false))
-	http.Handle("/admin/readers/delete", LoginNeeded(http.HandlerFunc(readerDel), false))
-
-	peopleHandler := TableFactory("people", []string{"id", "name", "permission"}, "people")
-	peopleAdd := AddFactory("people", []string{"id", "name", "permission"}, []string{"number", "text", "text"}, "people")
-	peopleDel := DelFactory("people", []string{"id", "name", "permission"}, []string{"number", "text", "text"}, "people")
-	http.Handle("/admin/people", LoginNeeded(http.HandlerFunc(peopleHandler), false))
-	http.Handle("/admin/people/add", LoginNeeded(http.HandlerFunc(peopleAdd), false))
-	http.Handle("/admin/people/delete", LoginNeeded(http.HandlerFunc(peopleDel), false))
-
-	adminsHandler := TableFactory("admins", []string{"id", "username", "pwhash", "adminTab"}, "admins")
-	adminsAdd := AddFactory("admins", []string{"id", "username", "pwhash", "adminTab"}, []string{"number", "text", "password", "number"}, "admins")
-	adminsDel := DelFactory("admins", []string{"id", "username", "pwhash", "adminTab"}, []string{"number", "text", "password", "number"}, "admins")
-	http.Handle("/admin/admins", LoginNeeded(http.HandlerFunc(adminsHandler), true))
-	http.Handle("/admin/admins/add", LoginNeeded(http.HandlerFunc(adminsAdd), true))
-	http.Handle("/admin/admins/delete", LoginNeeded(http.HandlerFunc(adminsDel), true))
+// routes registers the pages on the mux of the server
+func (s *Server) routes() {
+	s.mux.HandleFunc("GET /{$}", RootHandler)
+	s.mux.Handle("/admin", s.LoginNeeded(http.HandlerFunc(s.Admin)))
+
+	s.mux.Handle("/admin/logout", s.LoginNeeded(http.HandlerFunc(s.Logout)))
+	s.mux.Handle("/admin/login", s.CsrfProtect(http.HandlerFunc(s.Login)))
+	if s.Feature("live") {
+		s.mux.Handle("/admin/live", s.LoginNeeded(http.HandlerFunc(s.LiveHandler)))
+		s.mux.Handle("/admin/live/stream", s.LoginNeeded(http.HandlerFunc(s.LiveStreamHandler)))
+	}
+	if s.Feature("blocks") {
+		s.mux.Handle("/admin/blocks", s.LoginNeeded(http.HandlerFunc(s.BlocksHandler)))
+		s.mux.Handle("/admin/blocks/unblock", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(s.UnblockHandler))))
+	}
+	logHandler := s.TableFactory("logs", []string{"id", "time", "card", "reader", "people", "allowed", "direction", "comment"}, "accessLog")
+	s.mux.Handle("/admin/logs", s.LoginNeeded(http.HandlerFunc(logHandler)))
+
+	cardsHandler := s.TableFactory("cards", []string{"serialNumber", "authtoken", "writeKey", "readKey", "owner", "suspended"}, "cards")
+	cardsAdd := s.AddFactory("cards", []string{"serialNumber", "authtoken", "writeKey", "readKey", "owner", "suspended"}, []string{"text", "text", "text", "text", "number", "number"}, "cards")
+	cardsDel := s.DelFactory("cards", []string{"serialNumber", "authtoken", "writeKey", "readKey", "owner", "suspended"}, []string{"text", "text", "text", "text", "number", "number"}, "cards")
+	s.mux.Handle("/admin/cards", s.LoginNeeded(http.HandlerFunc(cardsHandler)))
+	s.mux.Handle("/admin/cards/add", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(cardsAdd))))
+	s.mux.Handle("/admin/cards/delete", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(cardsDel))))
+
+	readerHandler := s.TableFactory("readers", []string{"id", "apiKey", "addCard", "writeCard", "zone", "direction"}, "reader")
+	readerAdd := s.AddFactory("readers", []string{"id", "apiKey", "addCard", "writeCard", "zone", "direction"}, []string{"number", "text", "number", "number", "text", "text"}, "reader")
+	readerDel := s.DelFactory("readers", []string{"id", "apiKey", "addCard", "writeCard", "zone", "direction"}, []string{"number", "text", "number", "number", "text", "text"}, "reader")
+	s.mux.Handle("/admin/readers", s.LoginNeeded(http.HandlerFunc(readerHandler)))
+	s.mux.Handle("/admin/readers/add", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(readerAdd))))
+	s.mux.Handle("/admin/readers/delete", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(readerDel))))
+
+	peopleHandler := s.TableFactory("people", []string{"id", "name", "permission"}, "people")
+	peopleAdd := s.AddFactory("people", []string{"id", "name", "permission"}, []string{"number", "text", "text"}, "people")
+	peopleDel := s.DelFactory("people", []string{"id", "name", "permission"}, []string{"number", "text", "text"}, "people")
+	s.mux.Handle("/admin/people", s.LoginNeeded(http.HandlerFunc(peopleHandler)))
+	s.mux.Handle("/admin/people/add", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(peopleAdd))))
+	s.mux.Handle("/admin/people/delete", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(peopleDel))))
+
+	adminsHandler := s.TableFactory("admins", []string{"id", "username", "pwhash", "role", "disabled"}, "admins")
+	adminsAdd := s.AddFactory("admins", []string{"id", "username", "pwhash", "role", "disabled"}, []string{"number", "text", "password", "text", "number"}, "admins")
+	adminsDel := s.DelFactory("admins", []string{"id", "username", "pwhash", "role", "disabled"}, []string{"number", "text", "password", "text", "number"}, "admins")
+	s.mux.Handle("/admin/admins", s.LoginNeeded(http.HandlerFunc(adminsHandler)))
+	s.mux.Handle("/admin/admins/add", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(adminsAdd))))
+	s.mux.Handle("/admin/admins/delete", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(adminsDel))))
+
+	if s.Feature("webhooks") {
+		webhooksHandler := s.TableFactory("webhooks", []string{"id", "url", "secret", "events", "enabled"}, "webhooks")
+		webhooksAdd := s.AddFactory("webhooks", []string{"id", "url", "secret", "events", "enabled"}, []string{"number", "url", "text", "text", "number"}, "webhooks")
+		webhooksDel := s.DelFactory("webhooks", []string{"id", "url", "secret", "events", "enabled"}, []string{"number", "url", "text", "text", "number"}, "webhooks")
+		webhookLogHandler := s.TableFactory("webhooklog", []string{"id", "time", "webhook", "delivery", "event", "attempt", "status", "error"}, "webhookLog")
+		s.mux.Handle("/admin/webhooks", s.LoginNeeded(http.HandlerFunc(webhooksHandler)))
+		s.mux.Handle("/admin/webhooks/add", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(webhooksAdd))))
+		s.mux.Handle("/admin/webhooks/delete", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(webhooksDel))))
+		s.mux.Handle("/admin/webhooklog", s.LoginNeeded(http.HandlerFunc(webhookLogHandler)))
+	}
+
+	s.mux.Handle("/admin/people/import", s.LoginNeeded(s.CsrfProtect(s.ImportFactory("people"))))
+	s.mux.Handle("/admin/cards/import", s.LoginNeeded(s.CsrfProtect(s.ImportFactory("cards"))))
+	s.mux.Handle("/admin/export/{page}", s.LoginNeeded(http.HandlerFunc(s.ExportHandler)))
+
+	s.mux.Handle("/admin/reports", s.LoginNeeded(http.HandlerFunc(s.ReportHandler)))
+	s.mux.Handle("/admin/attendance", s.LoginNeeded(http.HandlerFunc(s.AttendanceHandler)))
+	s.mux.Handle("/admin/audit", s.LoginNeeded(http.HandlerFunc(s.AuditHandler)))
+	s.mux.Handle("/admin/trash", s.LoginNeeded(http.HandlerFunc(s.TrashHandler)))
+	s.mux.Handle("/admin/trash/restore", s.LoginNeeded(s.CsrfProtect(http.HandlerFunc(s.RestoreHandler))))
 }
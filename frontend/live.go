@@ -0,0 +1,132 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"server/events"
+	"server/store"
+)
+
+type (
+	// livestore fans the access events out to the open live streams
+	livestore struct {
+		lock    sync.Mutex
+		streams map[chan []byte]bool
+		store   store.Store
+		log     *slog.Logger
+	}
+	liveEvent struct {
+		events.Event
+		Name  string `json:"name"`
+		Zone  string `json:"zone"`
+		Owner string `json:"owner"` // owner of the card when the tap was denied
+	}
+)
+
+// Broadcast is the events handler of the live view, slow streams skip
+// events instead of holding up addLog
+func (s *livestore) Broadcast(e events.Event) {
+	s.lock.Lock()
+	listening := len(s.streams) != 0
+	s.lock.Unlock()
+	if !listening {
+		return
+	}
+	le := liveEvent{Event: e}
+	ctx := context.Background()
+	if pid, ok := e.Person.(int64); ok {
+		p, _ := s.store.Person(ctx, pid)
+		le.Name = p.Name
+	}
+	if rid, ok := e.Reader.(int64); ok {
+		r, _ := s.store.Reader(ctx, rid)
+		le.Zone = r.Zone
+	}
+	if serial, ok := e.Card.(string); ok && e.Person == nil {
+		card, err := s.store.Card(ctx, serial)
+		if err == nil {
+			p, _ := s.store.Person(ctx, card.Owner)
+			le.Owner = p.Name
+		}
+	}
+	js, err := json.Marshal(le)
+	if err != nil {
+		s.log.Error("live: event", "err", err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for stream := range s.streams {
+		select {
+		case stream <- js:
+		default:
+		}
+	}
+}
+
+func (s *livestore) open() chan []byte {
+	stream := make(chan []byte, 16)
+	s.lock.Lock()
+	if s.streams == nil {
+		s.streams = make(map[chan []byte]bool)
+	}
+	s.streams[stream] = true
+	s.lock.Unlock()
+	return stream
+}
+
+func (s *livestore) close(stream chan []byte) {
+	s.lock.Lock()
+	delete(s.streams, stream)
+	s.lock.Unlock()
+}
+
+// LiveStreamHandler is the server-sent events stream of the access events,
+// one "access" event per logged event with the json as data
+func (s *Server) LiveStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.permitted(w, r, "logs", PermRead) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.drawError(w, r, http.StatusInternalServerError, "A szerver nem támogatja az élő nézetet.")
+		return
+	}
+	stream := s.Live.open()
+	defer s.Live.close(stream)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+	// keeps proxies from closing the idle connection
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case js := <-stream:
+			fmt.Fprintf(w, "event: access\ndata: %s\n\n", js)
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *Server) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.permitted(w, r, "logs", PermRead) {
+		return
+	}
+	err := s.Html.ExecuteTemplate(w, "live.html", struct{ Status headerdata }{s.statusFromContext(r, "élő")})
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+	}
+}
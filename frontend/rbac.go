@@ -0,0 +1,133 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"server/store"
+)
+
+type Perm uint8
+
+const (
+	PermRead Perm = 1 << iota
+	PermCreate
+	PermUpdate
+	PermDelete
+
+	PermAll = PermRead | PermCreate | PermUpdate | PermDelete
+)
+
+// per table permissions of the admin roles, the keys are the url names of
+// the tables (the title of the factories)
+var Roles = map[string]map[string]Perm{
+	"viewer": {
+		"logs": PermRead,
+	},
+	"operator": {
+		"logs":       PermRead,
+		"attendance": PermRead,
+		"people":     PermAll,
+		"cards":      PermAll,
+	},
+	"installer": {
+		"logs":    PermRead,
+		"readers": PermAll,
+		"blocks":  PermRead | PermDelete,
+	},
+	"superadmin": {
+		"logs":       PermAll,
+		"people":     PermAll,
+		"cards":      PermAll,
+		"readers":    PermAll,
+		"admins":     PermAll,
+		"audit":      PermRead,
+		"attendance": PermRead,
+		"webhooks":   PermAll,
+		"webhooklog": PermRead,
+		"blocks":     PermRead | PermDelete,
+	},
+}
+
+var permNames = map[string]Perm{
+	"read":   PermRead,
+	"create": PermCreate,
+	"update": PermUpdate,
+	"delete": PermDelete,
+}
+
+func ValidRole(role string) bool {
+	_, ok := Roles[role]
+	return ok
+}
+
+func allowed(role, table string, p Perm) bool {
+	return Roles[role][table]&p == p
+}
+
+// Can is for the templates: {{if .Can "cards" "delete"}}
+func (h headerdata) Can(table, action string) bool {
+	p, ok := permNames[action]
+	if !ok {
+		return false
+	}
+	return allowed(h.Role, table, p)
+}
+
+func feature(features map[string]bool, name string) bool {
+	on, ok := features[name]
+	return on || !ok
+}
+
+// Feature tells if the optional part of the ui is on
+func (s *Server) Feature(name string) bool {
+	return feature(s.features, name)
+}
+
+// Feature is for the templates: {{if .Feature "live"}}
+func (h headerdata) Feature(name string) bool {
+	return feature(h.features, name)
+}
+
+// statusFromContext builds the header of pages behind LoginNeeded
+func (s *Server) statusFromContext(r *http.Request, title string) headerdata {
+	cont := r.Context()
+	uname := cont.Value(contextkey("uname")).(string)
+	role := cont.Value(contextkey("role")).(string)
+	csrf := cont.Value(contextkey("csrf")).(string)
+	return headerdata{Loggedin: true, Title: title, Uname: uname, Role: role, Csrf: csrf, features: s.features}
+}
+
+// checks the permission of the logged in admin, draws the error page if it's missing
+func (s *Server) permitted(w http.ResponseWriter, r *http.Request, table string, p Perm) bool {
+	role, _ := r.Context().Value(contextkey("role")).(string)
+	if !allowed(role, table, p) {
+		s.drawError(w, r, http.StatusForbidden, "Nincs jogosultságod ehhez.")
+		return false
+	}
+	return true
+}
+
+// ErrLastSuperadmin is a change of the admins that would leave no enabled
+// superadmin, nobody could manage the admins then
+var ErrLastSuperadmin = errors.New("no enabled superadmin would be left")
+
+// KeepSuperadmin runs in the transaction after the admins rows before were
+// deleted or disabled: if one of them was an enabled superadmin, one has to
+// be left
+func KeepSuperadmin(ctx context.Context, tx store.Tables, before []store.Row) error {
+	for _, a := range before {
+		if a["role"] == "superadmin" && a["disabled"] != true {
+			left, err := tx.Rows(ctx, "admins", []string{"id"}, store.Row{"role": "superadmin", "disabled": false})
+			if err != nil {
+				return err
+			}
+			if len(left) == 0 {
+				return ErrLastSuperadmin
+			}
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"server/store"
+)
+
+func TestPermitted(t *testing.T) {
+	s := &Server{Html: template.Must(template.New("error.html").Parse("{{.Message}}"))}
+	for _, tc := range []struct {
+		role  string
+		table string
+		p     Perm
+		ok    bool
+	}{
+		{"viewer", "logs", PermRead, true},
+		{"viewer", "logs", PermDelete, false},
+		{"viewer", "people", PermRead, false},
+		{"operator", "people", PermAll, true},
+		{"operator", "readers", PermRead, false},
+		{"installer", "blocks", PermRead | PermDelete, true},
+		{"installer", "blocks", PermCreate, false},
+		{"superadmin", "admins", PermAll, true},
+		{"superadmin", "audit", PermUpdate, false},
+		{"", "logs", PermRead, false},
+		{"root", "logs", PermRead, false},
+	} {
+		t.Run(tc.role+" "+tc.table, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/"+tc.table, nil)
+			r = r.WithContext(context.WithValue(r.Context(), contextkey("role"), tc.role))
+			w := httptest.NewRecorder()
+			if ok := s.permitted(w, r, tc.table, tc.p); ok != tc.ok {
+				t.Errorf("permitted %v, want %v", ok, tc.ok)
+			}
+			if !tc.ok && w.Code != http.StatusForbidden {
+				t.Errorf("%d, want 403", w.Code)
+			}
+		})
+	}
+}
+
+func TestCan(t *testing.T) {
+	h := headerdata{Role: "installer"}
+	if !h.Can("readers", "delete") || h.Can("readers", "nuke") || h.Can("people", "read") {
+		t.Errorf("can of the installer")
+	}
+	if ValidRole("root") || !ValidRole("viewer") {
+		t.Errorf("valid roles")
+	}
+}
+
+// admins is the admins table for KeepSuperadmin
+type admins struct {
+	store.Tables
+	rows []store.Row
+}
+
+func (a admins) Rows(ctx context.Context, table string, cols []string, where store.Row) ([]store.Row, error) {
+	out := make([]store.Row, 0)
+	for _, r := range a.rows {
+		if r["role"] == where["role"] && r["disabled"] == where["disabled"] {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func TestKeepSuperadmin(t *testing.T) {
+	boss := store.Row{"role": "superadmin", "disabled": false}
+	off := store.Row{"role": "superadmin", "disabled": true}
+	viewer := store.Row{"role": "viewer", "disabled": false}
+	for _, tc := range []struct {
+		name   string
+		left   []store.Row
+		before []store.Row
+		err    error
+	}{
+		{"last superadmin", []store.Row{viewer}, []store.Row{boss}, ErrLastSuperadmin},
+		{"one more left", []store.Row{boss}, []store.Row{boss}, nil},
+		{"disabled superadmin", []store.Row{viewer}, []store.Row{off}, nil},
+		{"viewer", nil, []store.Row{viewer}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := KeepSuperadmin(t.Context(), admins{rows: tc.left}, tc.before)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
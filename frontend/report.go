@@ -0,0 +1,183 @@
+package frontend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"server/store"
+)
+
+type (
+	report struct {
+		Name   string
+		Title  string
+		Params []string // filters the report uses besides from and to
+		Cols   []string
+	}
+	reportParams struct {
+		From   string
+		To     string
+		Person string
+		Reader string
+	}
+)
+
+// the queries are the Report of the store
+var reports = []report{
+	{
+		Name:   "person",
+		Title:  "egy ember belépései",
+		Params: []string{"person"},
+		Cols:   []string{"time", "reader", "card", "allowed", "direction", "comment"},
+	},
+	{
+		Name:   "reader",
+		Title:  "olvasó forgalma naponta",
+		Params: []string{"reader"},
+		Cols:   []string{"day", "reader", "granted", "denied", "people"},
+	},
+	{
+		Name:  "denied",
+		Title: "elutasított próbálkozások",
+		Cols:  []string{"time", "reader", "card", "cardOwner", "comment"},
+	},
+	{
+		Name:  "presence",
+		Title: "első belépés és utolsó kilépés naponta",
+		Cols:  []string{"day", "person", "name", "firstIn", "lastOut", "taps"},
+	},
+}
+
+func findReport(name string) (report, bool) {
+	i := slices.IndexFunc(reports, func(r report) bool { return r.Name == name })
+	if i < 0 {
+		return report{}, false
+	}
+	return reports[i], true
+}
+
+// optionalId parses the id of a filter, empty is no filter
+func optionalId(s string) (sql.NullInt64, error) {
+	if s == "" {
+		return sql.NullInt64{}, nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	return store.Int(id), err
+}
+
+// filter is the store filter of the params, an error for a bad id
+func (p reportParams) filter() (store.LogFilter, error) {
+	f := store.LogFilter{From: p.From, To: p.To}
+	var err error
+	f.Person, err = optionalId(p.Person)
+	if err == nil {
+		f.Reader, err = optionalId(p.Reader)
+	}
+	return f, err
+}
+
+// runReport returns the rows of the report as strings, nil values are empty
+func (s *Server) runReport(ctx context.Context, rep report, f store.LogFilter) ([][]string, error) {
+	rows, err := s.Store.Report(ctx, rep.Name, f)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]string, 0, len(rows))
+	for _, values := range rows {
+		line := make([]string, len(values))
+		for k, v := range values {
+			switch v := v.(type) {
+			case nil:
+			case bool:
+				// as sqlite gives them
+				if v {
+					line[k] = "1"
+				} else {
+					line[k] = "0"
+				}
+			case time.Time:
+				line[k] = v.Local().Format(time.DateTime)
+			default:
+				line[k] = fmt.Sprint(v)
+			}
+		}
+		out = append(out, line)
+	}
+	return out, nil
+}
+
+// ReportHandler is /admin/reports?report=person&person=3&from=2025-01-01&format=csv
+// without a report it only draws the form
+func (s *Server) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.permitted(w, r, "logs", PermRead) {
+		return
+	}
+	params := reportParams{
+		From:   r.FormValue("from"),
+		To:     r.FormValue("to"),
+		Person: r.FormValue("person"),
+		Reader: r.FormValue("reader"),
+	}
+	query := r.URL.Query()
+	query.Del("format")
+	data := struct {
+		Status  headerdata
+		Reports []report
+		Report  report
+		Params  reportParams
+		Rows    [][]string
+		Query   htmltemplate.URL
+	}{Status: s.statusFromContext(r, "reports"), Reports: reports, Params: params, Query: htmltemplate.URL(query.Encode())}
+	rep, ok := findReport(r.FormValue("report"))
+	if ok {
+		f, err := params.filter()
+		if err != nil {
+			s.drawError(w, r, http.StatusBadRequest, "Hibás kérés.")
+			return
+		}
+		data.Report = rep
+		data.Rows, err = s.runReport(r.Context(), rep, f)
+		if err != nil {
+			s.Log.ErrorContext(r.Context(), "report query", "report", rep.Name, "err", err)
+			s.drawError(w, r, http.StatusInternalServerError, "Adatbázis hiba.")
+			return
+		}
+	}
+	filename := fmt.Sprintf("%s_%s_%s", rep.Name, params.From, params.To)
+	var err error
+	switch r.FormValue("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".csv"))
+		cw := csv.NewWriter(w)
+		cw.Write(rep.Cols)
+		cw.WriteAll(data.Rows)
+		err = cw.Error()
+	case "json":
+		out := make([]map[string]string, len(data.Rows))
+		for i, line := range data.Rows {
+			out[i] = make(map[string]string, len(line))
+			for k, v := range line {
+				out[i][rep.Cols[k]] = v
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		err = json.NewEncoder(w).Encode(out)
+	case "print":
+		err = s.Html.ExecuteTemplate(w, "reportprint.html", data)
+	default:
+		err = s.Html.ExecuteTemplate(w, "report.html", data)
+	}
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+	}
+}
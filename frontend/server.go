@@ -0,0 +1,138 @@
+package frontend
+
+import (
+	"context"
+	htmltemplate "html/template"
+	"log/slog"
+	"maps"
+	"net/http"
+	"text/template"
+	"time"
+
+	"server/events"
+	"server/metrics"
+	"server/ratelimit"
+	"server/store"
+)
+
+type (
+	// Server is the admin ui, an http.Handler of the /admin pages. Start
+	// runs its background jobs until Stop.
+	Server struct {
+		Store      store.Store
+		Html       *htmltemplate.Template
+		Txt        *template.Template
+		Log        *slog.Logger
+		Sessions   autstore
+		Trash      trashstore
+		Webhooks   webhookstore
+		Live       livestore
+		Attendance AttendanceRules
+		Limits     *ratelimit.Limiter
+
+		features     map[string]bool
+		cleanSession time.Duration
+		mux          *http.ServeMux
+		stop         []chan bool
+	}
+	Config struct {
+		Store store.Store
+		Html  *htmltemplate.Template
+		Txt   *template.Template
+		Log   *slog.Logger // slog.Default() if nil
+		// Events gets the handlers of the live view and the webhooks
+		Events *events.Bus
+
+		SessionLifetime time.Duration
+		// how often the expired sessions are dropped
+		SessionClean    time.Duration
+		TrashDays       int
+		WebhookAttempts int
+		Attendance      AttendanceRules
+		// Limits has the blocks of the reader api the blocks page shows,
+		// the page is off without it
+		Limits *ratelimit.Limiter
+		// optional parts of the ui, everything not in the map is on
+		Features map[string]bool
+	}
+)
+
+func New(c Config) *Server {
+	log := c.Log
+	if log == nil {
+		log = slog.Default()
+	}
+	s := &Server{
+		Store:        c.Store,
+		Html:         c.Html,
+		Txt:          c.Txt,
+		Log:          log,
+		Attendance:   c.Attendance,
+		Limits:       c.Limits,
+		features:     maps.Clone(c.Features),
+		cleanSession: c.SessionClean,
+		mux:          http.NewServeMux(),
+	}
+	if s.features == nil {
+		s.features = make(map[string]bool)
+	}
+	if c.Limits == nil {
+		s.features["blocks"] = false
+	}
+	s.Sessions.Lifetime = c.SessionLifetime
+	s.Trash = trashstore{Days: c.TrashDays, store: c.Store, log: log}
+	s.Webhooks = webhookstore{
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: c.WebhookAttempts,
+		Wake:        make(chan bool, 1),
+		store:       c.Store,
+		log:         log,
+	}
+	s.Live = livestore{store: c.Store, log: log}
+	if c.Events != nil {
+		if s.Feature("webhooks") {
+			c.Events.Handle(s.Webhooks.Enqueue)
+		}
+		if s.Feature("live") {
+			c.Events.Handle(s.Live.Broadcast)
+		}
+	}
+	s.routes()
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Start runs the session and the trash cleaners and the webhook sender
+func (s *Server) Start() {
+	s.Sessions.Ticker = *time.NewTicker(s.cleanSession)
+	s.Sessions.Done = make(chan bool)
+	go s.Sessions.Clean()
+	s.stop = append(s.stop, s.Sessions.Done)
+	s.Trash.Ticker = *time.NewTicker(1 * time.Hour)
+	s.Trash.Done = make(chan bool)
+	go s.Trash.Clean()
+	s.stop = append(s.stop, s.Trash.Done)
+	if s.Feature("webhooks") {
+		s.Webhooks.Ticker = *time.NewTicker(5 * time.Second)
+		s.Webhooks.Done = make(chan bool)
+		go s.Webhooks.Run()
+		s.stop = append(s.stop, s.Webhooks.Done)
+	}
+}
+
+func (s *Server) Stop() {
+	for _, done := range s.stop {
+		done <- true
+	}
+	s.stop = nil
+}
+
+// change runs fn in a transaction of the store
+func (s *Server) change(ctx context.Context, fn func(tx store.Tables) error) error {
+	err := s.Store.Change(ctx, fn)
+	metrics.TxError(err)
+	return err
+}
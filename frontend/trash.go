@@ -0,0 +1,172 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"server/store"
+)
+
+type (
+	// rows deleted through DelFactory are kept for Days days in the trash table
+	trashstore struct {
+		Days   int
+		Ticker time.Ticker
+		Done   chan bool
+		store  store.Store
+		log    *slog.Logger
+	}
+)
+
+// moveToTrash saves the rows before they get deleted, page is the url name
+// of the table (the factory title), that decides who can restore them
+func moveToTrash(tx store.Tables, r *http.Request, page, table string, rows []map[string]any) error {
+	uname, _ := r.Context().Value(contextkey("uname")).(string)
+	return MoveToTrash(r.Context(), tx, uname, page, table, rows)
+}
+
+// MoveToTrash is moveToTrash for the deletes made outside of a request
+func MoveToTrash(ctx context.Context, tx store.Tables, admin, page, table string, rows []map[string]any) error {
+	for _, row := range rows {
+		// []byte would become base64 in json and couldn't be restored as is
+		for k, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[k] = string(b)
+			}
+		}
+		js, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Insert(ctx, "trash", store.Row{"admin": admin, "page": page, "tableName": table, "data": string(js)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *trashstore) purge() {
+	_, err := t.store.PurgeTrash(context.Background(), time.Now().AddDate(0, 0, -t.Days))
+	if err != nil {
+		t.log.Error("trash purge", "err", err)
+	}
+}
+
+func (t *trashstore) Clean() {
+	t.purge()
+	for {
+		select {
+		case <-t.Done:
+			return
+		case <-t.Ticker.C:
+			t.purge()
+		}
+	}
+}
+
+// TrashHandler lists the deleted rows the admin could restore
+func (s *Server) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	status := s.statusFromContext(r, "trash")
+	all, err := s.Store.Trash(r.Context())
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "trash query", "err", err)
+		s.drawError(w, r, http.StatusInternalServerError, "Adatbázis hiba.")
+		return
+	}
+	entries := make([]store.TrashEntry, 0, len(all))
+	for _, e := range all {
+		if allowed(status.Role, e.Page, PermCreate) {
+			entries = append(entries, e)
+		}
+	}
+	err = s.Html.ExecuteTemplate(w, "trash.html", struct {
+		Status  headerdata
+		Days    int
+		Entries []store.TrashEntry
+	}{Status: status, Days: s.Trash.Days, Entries: entries})
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "rendering template", "err", err)
+	}
+}
+
+// RestoreHandler puts a row from the trash back into its table
+func (s *Server) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/admin/trash", http.StatusSeeOther)
+		return
+	}
+	id, err := strconv.Atoi(r.PostFormValue("id"))
+	if err != nil {
+		s.drawError(w, r, http.StatusBadRequest, "Hibás kérés.")
+		return
+	}
+	rows, err := s.Store.Rows(r.Context(), "trash", []string{"page", "tableName", "data"}, store.Row{"id": id})
+	if err != nil || len(rows) == 0 {
+		s.Log.WarnContext(r.Context(), "restore: no such trash entry", "id", id, "err", err)
+		s.drawError(w, r, http.StatusNotFound, "Nincs ilyen törölt sor.")
+		return
+	}
+	page, _ := rows[0]["page"].(string)
+	table, _ := rows[0]["tableName"].(string)
+	raw, _ := rows[0]["data"].(string)
+	if !s.permitted(w, r, page, PermCreate) {
+		return
+	}
+	data := make(map[string]any)
+	dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	dec.UseNumber()
+	err = dec.Decode(&data)
+	if err != nil {
+		s.Log.ErrorContext(r.Context(), "restore: bad trash entry", "id", id, "err", err)
+		s.drawError(w, r, http.StatusInternalServerError, "Sérült lomtár bejegyzés.")
+		return
+	}
+	row := make(store.Row, len(data))
+	for k, v := range data {
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else {
+				v = n.String()
+			}
+		}
+		row[k] = v
+	}
+	var restoreErr error
+	err = s.change(r.Context(), func(tx store.Tables) error {
+		// the entry goes first, a restore that came in between finds none
+		n, err := tx.Delete(r.Context(), "trash", store.Row{"id": id})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return store.ErrNotFound
+		}
+		_, restoreErr = tx.Insert(r.Context(), table, row)
+		if restoreErr != nil {
+			return restoreErr
+		}
+		return audit(tx, r, "restore", table, nil, []map[string]any{data})
+	})
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.drawError(w, r, http.StatusNotFound, "Nincs ilyen törölt sor.")
+		return
+	case restoreErr != nil:
+		s.Log.WarnContext(r.Context(), "restore failed", "id", id, "table", table, "err", restoreErr)
+		s.drawError(w, r, http.StatusConflict, "Nem sikerült visszaállítani: "+restoreErr.Error())
+		return
+	case err != nil:
+		s.Log.ErrorContext(r.Context(), "restore", "id", id, "err", err)
+		s.drawError(w, r, http.StatusInternalServerError, "Adatbázis hiba.")
+		return
+	}
+	http.Redirect(w, r, "/admin/"+page, http.StatusSeeOther)
+}
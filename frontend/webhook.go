@@ -0,0 +1,131 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"server/events"
+	"server/metrics"
+	"server/store"
+)
+
+// webhookstore delivers the queued events, the queue is in the store so
+// nothing is lost on restart
+type webhookstore struct {
+	Client      *http.Client
+	MaxAttempts int
+	Ticker      time.Ticker
+	Done        chan bool
+	Wake        chan bool
+	store       store.Webhooks
+	log         *slog.Logger
+}
+
+// Sign is the value of the X-Signature header, the scheme of the signed
+// reader requests: "sha256=" and the hex hmac-sha256 of the X-Timestamp (unix
+// seconds), a dot and the body. The receivers can refuse the old timestamps
+// and the signatures they have already seen.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff after the nth failed attempt: 10s, 20s, 40s... at most an hour
+func backoff(attempts int) time.Duration {
+	d := 10 * time.Second << min(attempts-1, 9)
+	return min(d, time.Hour)
+}
+
+// Enqueue is the events handler, it queues the event for every enabled
+// webhook subscribed to its type
+func (s *webhookstore) Enqueue(e events.Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		s.log.Error("webhook: event", "err", err)
+		return
+	}
+	n, err := s.store.QueueEvent(context.Background(), e.Type, payload)
+	metrics.TxError(err)
+	if err != nil {
+		s.log.Error("webhook: enqueue", "err", err)
+		return
+	}
+	if n == 0 {
+		return
+	}
+	select {
+	case s.Wake <- true:
+	default:
+	}
+}
+
+func (s *webhookstore) deliver(d store.Delivery) {
+	d.Attempts++
+	status := 0
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Event-Type", d.Event)
+		req.Header.Set("X-Delivery", strconv.FormatInt(d.Id, 10))
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Signature", Sign(d.Secret, ts, d.Payload))
+		var resp *http.Response
+		resp, err = s.Client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			status = resp.StatusCode
+			if status < 200 || status > 299 {
+				err = fmt.Errorf("status %d", status)
+			}
+		}
+	}
+	var errText string
+	var next time.Time
+	switch {
+	case err == nil:
+	case d.Attempts >= s.MaxAttempts:
+		s.log.Warn("webhook: giving up delivery", "delivery", d.Id, "webhook", d.Webhook, "attempts", d.Attempts)
+		errText = err.Error()
+	default:
+		s.log.Info("webhook: delivery failed", "delivery", d.Id, "webhook", d.Webhook, "attempt", d.Attempts, "err", err)
+		errText = err.Error()
+		next = time.Now().Add(backoff(d.Attempts))
+	}
+	err = s.store.Attempted(context.Background(), d, status, errText, next)
+	metrics.TxError(err)
+	if err != nil {
+		s.log.Error("webhook: delivery log", "delivery", d.Id, "err", err)
+	}
+}
+
+// Run delivers the queue until Done, it wakes up on the ticker and on
+// every enqueued event
+func (s *webhookstore) Run() {
+	for {
+		deliveries, err := s.store.DueDeliveries(context.Background(), 100)
+		if err != nil {
+			s.log.Error("webhook: queue", "err", err)
+		}
+		for _, d := range deliveries {
+			s.deliver(d)
+		}
+		select {
+		case <-s.Done:
+			return
+		case <-s.Ticker.C:
+		case <-s.Wake:
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package frontend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"server/store"
+)
+
+// attempts records the Attempted calls, the queue isn't used
+type attempts struct {
+	store.Webhooks
+	status []int
+}
+
+func (a *attempts) Attempted(ctx context.Context, d store.Delivery, status int, errText string, next time.Time) error {
+	a.status = append(a.status, status)
+	return nil
+}
+
+func TestDeliverSigned(t *testing.T) {
+	var header http.Header
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+	a := &attempts{}
+	s := &webhookstore{Client: receiver.Client(), MaxAttempts: 3, store: a, log: slog.Default()}
+	s.deliver(store.Delivery{Id: 7, Webhook: 1, URL: receiver.URL, Secret: "titok", Event: "granted", Payload: []byte(`{"type":"granted"}`)})
+	if len(a.status) != 1 || a.status[0] != http.StatusOK {
+		t.Fatalf("attempts %v, want one 200", a.status)
+	}
+	ts := header.Get("X-Timestamp")
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)) > time.Minute {
+		t.Errorf("timestamp %q", ts)
+	}
+	mac := hmac.New(sha256.New, []byte("titok"))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get("X-Signature") != want {
+		t.Errorf("signature %q, want %q", header.Get("X-Signature"), want)
+	}
+	if header.Get("X-Event-Type") != "granted" || header.Get("X-Delivery") != "7" {
+		t.Errorf("headers %v", header)
+	}
+}
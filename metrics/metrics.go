@@ -0,0 +1,144 @@
+// Package metrics holds the prometheus metrics of the server, they are
+// served by Handler.
+package metrics
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"server/events"
+	"server/store"
+)
+
+// results of the reader api requests
+const (
+	Ok         = "ok"
+	Denied     = "denied"
+	BadRequest = "bad_request"
+	Refused    = "refused" // over the rate limits or blocked
+)
+
+var Registry = prometheus.NewRegistry()
+
+var (
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cardreader_api_requests_total",
+		Help: "Reader api requests by transport (http, mqtt), endpoint and result.",
+	}, []string{"transport", "endpoint", "result"})
+	apiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cardreader_api_request_duration_seconds",
+		Help:    "Time spent answering the reader api requests.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"transport", "endpoint", "result"})
+	access = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cardreader_access_total",
+		Help: "Granted and denied taps per reader.",
+	}, []string{"reader", "result"})
+	txErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cardreader_db_tx_errors_total",
+		Help: "Failed database transaction begins and commits.",
+	}, []string{"op"})
+)
+
+func init() {
+	Registry.MustRegister(
+		apiRequests,
+		apiDuration,
+		access,
+		txErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Request counts a reader api request that started at start
+func Request(transport, endpoint, result string, start time.Time) {
+	apiRequests.WithLabelValues(transport, endpoint, result).Inc()
+	apiDuration.WithLabelValues(transport, endpoint, result).Observe(time.Since(start).Seconds())
+}
+
+// TxError counts err if it is a failed begin or commit of a transaction of
+// the store
+func TxError(err error) {
+	var txErr *store.TxError
+	if errors.As(err, &txErr) {
+		txErrors.WithLabelValues(txErr.Op).Inc()
+	}
+}
+
+// Access is the events handler counting the taps
+func Access(e events.Event) {
+	if e.Type != events.Granted && e.Type != events.Denied {
+		return
+	}
+	reader := "unknown"
+	if e.Reader != nil {
+		reader = fmt.Sprint(e.Reader)
+	}
+	access.WithLabelValues(reader, e.Type).Inc()
+}
+
+// Sessions exports the number of the logged in admins
+func Sessions(active func() int) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cardreader_admin_sessions",
+		Help: "Active admin sessions.",
+	}, func() float64 { return float64(active()) }))
+}
+
+// readers reads the last seen time of the readers on every scrape
+type readers struct {
+	list func(context.Context) ([]store.Reader, error)
+	desc *prometheus.Desc
+}
+
+func Readers(list func(context.Context) ([]store.Reader, error)) {
+	Registry.MustRegister(readers{list, prometheus.NewDesc(
+		"cardreader_reader_last_seen_timestamp_seconds",
+		"Unix time of the last request of the reader.",
+		[]string{"reader", "zone"}, nil,
+	)})
+}
+
+func (c readers) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c readers) Collect(ch chan<- prometheus.Metric) {
+	readers, err := c.list(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for _, r := range readers {
+		if r.LastSeen.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(r.LastSeen.Unix()), fmt.Sprint(r.Id), r.Zone)
+	}
+}
+
+// Handler serves the metrics, with basic auth when user is not empty
+func Handler(user, password string) http.Handler {
+	h := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	if user == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"server/api"
+	"server/events"
+	"server/logging"
+	"server/metrics"
+)
+
+// The readers publish the same json as the http api to
+// {prefix}/request/{reader id}/{verify|key|addCard}, the answer goes to
+// {prefix}/reply/{reader id}/{verify|key|addCard}. The reader id is the id of
+// the reader of the apikey in the request, not the one in the topic: a
+// request in the topic of another reader is dropped. The broker ACLs keep a
+// reader on its own topics, see config.example.yaml. Every access event goes
+// to {prefix}/events/{type}/{reader id}.
+
+// mqttHandler is the http handler of the api for mqtt: decodes the request,
+// runs fn and publishes the answer to the reply topic of the reader of the
+// api key. There are no status codes over mqtt, a request that is over the
+// rate limit, comes from a blocked reader or from a reader with a secret gets
+// the zero answer: there are no signatures over mqtt, the readers that sign
+// use https. One that
+// can't be decoded or has an unknown api key has no reader to answer to.
+func mqttHandler[Req api.Request, Ans api.Answer](readerAPI *api.Server, fn func(context.Context, Req) Ans) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		// net/http would recover a panic of the handler, paho doesn't
+		defer func() {
+			if v := recover(); v != nil {
+				readerAPI.Log.Error("mqtt: request panicked", "topic", msg.Topic(), "panic", v)
+			}
+		}()
+		start := time.Now()
+		parts := strings.Split(msg.Topic(), "/")
+		if len(parts) < 3 {
+			return
+		}
+		topicReader, kind := parts[len(parts)-2], parts[len(parts)-1]
+		ctx := logging.WithRequestID(context.Background(), logging.NewRequestID())
+		var ans Ans
+		var request Req
+		var err error
+		if len(msg.Payload()) > api.MaxBody {
+			err = fmt.Errorf("request of %d bytes, the limit is %d", len(msg.Payload()), api.MaxBody)
+		} else {
+			request, err = api.Decode[Req](bytes.NewReader(msg.Payload()))
+		}
+		result := metrics.BadRequest
+		reply := ""
+		if err == nil {
+			// fn denies the unknown api keys, they only get no answer
+			reader, rerr := readerAPI.Reader(ctx, request)
+			if rerr == nil {
+				reply = strconv.FormatInt(reader.Id, 10)
+			}
+			result = metrics.Refused
+			if reply != "" && reply != topicReader {
+				err = fmt.Errorf("api key of reader %s in the topic of %q", reply, topicReader)
+				reply = ""
+			}
+		}
+		if err == nil {
+			err = readerAPI.Admit(request, "")
+		}
+		if err == nil {
+			err = readerAPI.Unsigned(ctx, request)
+		}
+		if err == nil {
+			ans = fn(ctx, request)
+			result = api.Result(ans, nil)
+		} else {
+			readerAPI.Log.WarnContext(ctx, "mqtt: request refused", "topic", msg.Topic(), "err", err)
+		}
+		metrics.Request("mqtt", kind, result, start)
+		if reply != "" {
+			js, err := json.Marshal(ans)
+			if err != nil {
+				readerAPI.Log.ErrorContext(ctx, "mqtt: answer", "topic", msg.Topic(), "err", err)
+				return
+			}
+			client.Publish(config.MQTT.Prefix+"/reply/"+reply+"/"+kind, 1, false, js)
+		}
+		readerAPI.Log.DebugContext(ctx, "mqtt request", "topic", msg.Topic(), "duration", time.Since(start))
+	}
+}
+
+// publishEvent is the events handler of the bridge, it doesn't wait for the
+// broker
+func publishEvent(client mqtt.Client, log *slog.Logger) func(events.Event) {
+	return func(e events.Event) {
+		js, err := json.Marshal(e)
+		if err != nil {
+			log.Error("mqtt: event", "err", err)
+			return
+		}
+		reader := "unknown"
+		if e.Reader != nil {
+			reader = fmt.Sprint(e.Reader)
+		}
+		client.Publish(config.MQTT.Prefix+"/events/"+e.Type+"/"+reader, 0, false, js)
+	}
+}
+
+// startMqtt connects to the broker, the subscriptions are renewed on every
+// reconnect
+func startMqtt(readerAPI *api.Server, bus *events.Bus) (mqtt.Client, error) {
+	handlers := map[string]mqtt.MessageHandler{
+		config.MQTT.Prefix + "/request/+/verify":  mqttHandler(readerAPI, readerAPI.Verify),
+		config.MQTT.Prefix + "/request/+/key":     mqttHandler(readerAPI, readerAPI.Key),
+		config.MQTT.Prefix + "/request/+/addCard": mqttHandler(readerAPI, readerAPI.AddCard),
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.MQTT.Broker).
+		SetClientID(config.MQTT.ClientId).
+		SetUsername(config.MQTT.User).
+		SetPassword(config.MQTT.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		readerAPI.Log.Info("mqtt: connected", "broker", config.MQTT.Broker)
+		for topic, handler := range handlers {
+			token := client.Subscribe(topic, 1, handler)
+			if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+				readerAPI.Log.Error("mqtt: subscribe", "topic", topic, "err", token.Error())
+			}
+		}
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		readerAPI.Log.Warn("mqtt: connection lost", "err", err)
+	})
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	// with ConnectRetry the client keeps trying in the background
+	if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		return nil, token.Error()
+	}
+	bus.Handle(publishEvent(client, readerAPI.Log))
+	return client, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"server/api"
+	"server/store"
+	"server/store/sqlite"
+)
+
+// broker records what the server publishes
+type broker struct {
+	mqtt.Client
+	published map[string][]byte
+}
+
+func (b *broker) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	b.published[topic] = payload.([]byte)
+	return nil
+}
+
+type message struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m message) Topic() string   { return m.topic }
+func (m message) Payload() []byte { return m.payload }
+
+func TestMqttReplyTopic(t *testing.T) {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "test.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	readerAPI := api.New(api.Config{Store: db})
+	ctx := t.Context()
+	person, err := db.AddPerson(ctx, store.Person{Name: "Teszt Elek", Permission: "staff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, key := range []string{"key-1", "key-2", "key-3"} {
+		id, err := db.AddReader(ctx, store.Reader{ApiKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.AddCard(ctx, store.Card{SerialNumber: "04:a1:b2:c3", Authtoken: "token-1", WriteKey: "w", ReadKey: "r", Owner: person}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetReaderSecret(ctx, ids[2], "titok"); err != nil {
+		t.Fatal(err)
+	}
+	handler := mqttHandler(readerAPI, readerAPI.Verify)
+	request := func(apiKey string) []byte {
+		js, _ := json.Marshal(api.VerifyRequest{ApiKey: apiKey, SerialNumber: "04:a1:b2:c3", Authtoken: "token-1"})
+		return js
+	}
+	prefix := config.MQTT.Prefix
+	for _, tc := range []struct {
+		name    string
+		topic   string
+		payload []byte
+		reply   string // empty if there is no answer
+		ok      bool
+	}{
+		{"own topic", fmt.Sprintf("%s/request/%d/verify", prefix, ids[0]), request("key-1"), fmt.Sprintf("%s/reply/%d/verify", prefix, ids[0]), true},
+		{"topic of another reader", fmt.Sprintf("%s/request/%d/verify", prefix, ids[1]), request("key-1"), "", false},
+		{"topic of no reader", prefix + "/request/testreader/verify", request("key-1"), "", false},
+		{"unknown api key", fmt.Sprintf("%s/request/%d/verify", prefix, ids[1]), request("nope"), "", false},
+		{"reader with a secret", fmt.Sprintf("%s/request/%d/verify", prefix, ids[2]), request("key-3"), fmt.Sprintf("%s/reply/%d/verify", prefix, ids[2]), false},
+		{"too long", fmt.Sprintf("%s/request/%d/verify", prefix, ids[0]), append(request("key-1"), bytes.Repeat([]byte(" "), api.MaxBody)...), "", false},
+		{"not valid", fmt.Sprintf("%s/request/%d/verify", prefix, ids[0]), []byte("{"), "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &broker{published: make(map[string][]byte)}
+			handler(b, message{topic: tc.topic, payload: tc.payload})
+			if tc.reply == "" {
+				if len(b.published) != 0 {
+					t.Errorf("answered on %v", b.published)
+				}
+				return
+			}
+			js, ok := b.published[tc.reply]
+			if !ok || len(b.published) != 1 {
+				t.Fatalf("answered on %v, want %s", b.published, tc.reply)
+			}
+			var ans api.VerifyAnswer
+			if err := json.Unmarshal(js, &ans); err != nil || ans.Ok != tc.ok {
+				t.Errorf("answer %s %v, want ok %v", js, err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestMqttStoreDown(t *testing.T) {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "test.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readerAPI := api.New(api.Config{Store: db})
+	id, err := db.AddReader(t.Context(), store.Reader{ApiKey: "key-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// the failed access log write doesn't take the server down
+	js, _ := json.Marshal(api.VerifyRequest{ApiKey: "key-1", SerialNumber: "04:a1:b2:c3", Authtoken: "token-1"})
+	b := &broker{published: make(map[string][]byte)}
+	mqttHandler(readerAPI, readerAPI.Verify)(b, message{topic: fmt.Sprintf("%s/request/%d/verify", config.MQTT.Prefix, id), payload: js})
+	if len(b.published) != 0 {
+		t.Errorf("answered on %v", b.published)
+	}
+}
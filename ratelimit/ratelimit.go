@@ -0,0 +1,219 @@
+// Package ratelimit is the token buckets and the temporary blocks of the
+// reader api. Every key (an api key, an address) has a bucket of its kind,
+// and a key that fails too often is blocked for a while.
+package ratelimit
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// the kinds of keys of the reader api
+const (
+	ApiKey = "apikey"
+	IP     = "ip"
+)
+
+type (
+	// Rule is the bucket of a kind: Burst requests at once, then Rate per
+	// second
+	Rule struct {
+		Rate  float64
+		Burst int
+	}
+	Config struct {
+		// the kinds without a rule aren't limited
+		Rules map[string]Rule
+		// Failures within Window block the key for BlockFor, 0 never blocks
+		Failures int
+		Window   time.Duration
+		BlockFor time.Duration
+	}
+	Key struct {
+		Kind  string
+		Value string
+	}
+	Block struct {
+		Key
+		Reason string
+		Since  time.Time
+		Until  time.Time
+	}
+	// Limiter is safe for concurrent use
+	Limiter struct {
+		Config
+
+		lock     sync.Mutex
+		buckets  map[Key]*bucket
+		failures map[Key][]time.Time
+		blocks   map[Key]Block
+	}
+	bucket struct {
+		tokens float64
+		last   time.Time
+	}
+)
+
+// String is the key in the errors and the logs, an api key is a secret so
+// only a short hash of it shows
+func (k Key) String() string {
+	if k.Kind == ApiKey {
+		sum := sha256.Sum256([]byte(k.Value))
+		return k.Kind + " " + hex.EncodeToString(sum[:4])
+	}
+	return k.Kind + " " + k.Value
+}
+
+// Limited is the error of a key over the rate of its kind
+type Limited struct {
+	Key
+	RetryAfter time.Duration
+}
+
+func (e Limited) Error() string {
+	return fmt.Sprintf("%s: too many requests, retry after %v", e.Key, e.RetryAfter)
+}
+
+// Blocked is the error of a blocked key
+type Blocked struct {
+	Block
+}
+
+func (e Blocked) Error() string {
+	return fmt.Sprintf("%s: blocked until %s: %s", e.Key, e.Until.Format(time.DateTime), e.Reason)
+}
+
+func New(c Config) *Limiter {
+	return &Limiter{
+		Config:   c,
+		buckets:  make(map[Key]*bucket),
+		failures: make(map[Key][]time.Time),
+		blocks:   make(map[Key]Block),
+	}
+}
+
+// Allow takes a token of the key, the error is Blocked or Limited
+func (l *Limiter) Allow(k Key) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if b, ok := l.blocks[k]; ok {
+		if now.Before(b.Until) {
+			return Blocked{b}
+		}
+		delete(l.blocks, k)
+	}
+	rule, ok := l.Rules[k.Kind]
+	if !ok || rule.Rate <= 0 {
+		return nil
+	}
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &bucket{tokens: float64(rule.Burst), last: now}
+		l.buckets[k] = b
+	}
+	b.tokens = min(float64(rule.Burst), b.tokens+now.Sub(b.last).Seconds()*rule.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rule.Rate * float64(time.Second))
+		return Limited{k, wait}
+	}
+	b.tokens--
+	return nil
+}
+
+// Fail counts a failure of the key, the block is there if it made the key
+// blocked
+func (l *Limiter) Fail(k Key, reason string) (Block, bool) {
+	if l.Failures <= 0 {
+		return Block{}, false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	fails := append(recent(l.failures[k], now.Add(-l.Window)), now)
+	if len(fails) < l.Failures {
+		l.failures[k] = fails
+		return Block{}, false
+	}
+	delete(l.failures, k)
+	b := Block{Key: k, Reason: reason, Since: now, Until: now.Add(l.BlockFor)}
+	l.blocks[k] = b
+	return b, true
+}
+
+// recent are the times after since
+func recent(times []time.Time, since time.Time) []time.Time {
+	return slices.DeleteFunc(times, func(t time.Time) bool { return !t.After(since) })
+}
+
+// Blocks are the blocked keys, the oldest block first
+func (l *Limiter) Blocks() []Block {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	blocks := make([]Block, 0, len(l.blocks))
+	for _, b := range l.blocks {
+		if now.Before(b.Until) {
+			blocks = append(blocks, b)
+		}
+	}
+	slices.SortFunc(blocks, func(a, b Block) int {
+		return cmp.Or(a.Since.Compare(b.Since), cmp.Compare(a.Key.String(), b.Key.String()))
+	})
+	return blocks
+}
+
+// Unblock lifts the block of the key, it tells if there was one
+func (l *Limiter) Unblock(k Key) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, ok := l.blocks[k]
+	delete(l.blocks, k)
+	delete(l.failures, k)
+	return ok
+}
+
+// clean drops the full buckets, the old failures and the ended blocks, they
+// would be the same if they were made again
+func (l *Limiter) clean() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for k, b := range l.buckets {
+		rule := l.Rules[k.Kind]
+		if rule.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*rule.Rate >= float64(rule.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+	for k, fails := range l.failures {
+		fails = recent(fails, now.Add(-l.Window))
+		if len(fails) == 0 {
+			delete(l.failures, k)
+		} else {
+			l.failures[k] = fails
+		}
+	}
+	for k, b := range l.blocks {
+		if !now.Before(b.Until) {
+			delete(l.blocks, k)
+		}
+	}
+}
+
+// Clean keeps the memory of the limiter small until done
+func (l *Limiter) Clean(ticker *time.Ticker, done chan bool) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			l.clean()
+		}
+	}
+}
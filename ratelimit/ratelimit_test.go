@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowRefill(t *testing.T) {
+	l := New(Config{Rules: map[string]Rule{IP: {Rate: 50, Burst: 2}}})
+	k := Key{IP, "10.0.0.1"}
+	for i := range 2 {
+		if err := l.Allow(k); err != nil {
+			t.Fatalf("request %d of the burst: %v", i, err)
+		}
+	}
+	var limited Limited
+	if err := l.Allow(k); !errors.As(err, &limited) || limited.RetryAfter <= 0 || limited.RetryAfter > 20*time.Millisecond {
+		t.Fatalf("over the burst: got %v, want Limited within a token", err)
+	}
+	// the other keys have buckets of their own
+	if err := l.Allow(Key{IP, "10.0.0.2"}); err != nil {
+		t.Errorf("other key: %v", err)
+	}
+	time.Sleep(limited.RetryAfter + 5*time.Millisecond)
+	if err := l.Allow(k); err != nil {
+		t.Errorf("after the refill: %v", err)
+	}
+}
+
+func TestNoRule(t *testing.T) {
+	l := New(Config{Rules: map[string]Rule{IP: {Rate: 0, Burst: 1}}})
+	for range 100 {
+		if err := l.Allow(Key{ApiKey, "k"}); err != nil {
+			t.Fatalf("kind without a rule: %v", err)
+		}
+		if err := l.Allow(Key{IP, "10.0.0.1"}); err != nil {
+			t.Fatalf("rate 0: %v", err)
+		}
+	}
+}
+
+func TestBlockExpiry(t *testing.T) {
+	l := New(Config{Failures: 2, Window: time.Minute, BlockFor: 50 * time.Millisecond})
+	k := Key{ApiKey, "kulcs"}
+	if _, blocked := l.Fail(k, "bad token"); blocked {
+		t.Fatalf("blocked after one failure")
+	}
+	b, blocked := l.Fail(k, "bad token")
+	if !blocked || b.Reason != "bad token" || b.Until.Sub(b.Since) != 50*time.Millisecond {
+		t.Fatalf("second failure: %+v %v, want a block", b, blocked)
+	}
+	var berr Blocked
+	if err := l.Allow(k); !errors.As(err, &berr) || berr.Key != k {
+		t.Errorf("blocked key: got %v, want Blocked", err)
+	}
+	if got := l.Blocks(); len(got) != 1 || got[0].Key != k {
+		t.Errorf("blocks: %+v", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := l.Allow(k); err != nil {
+		t.Errorf("after the block: %v", err)
+	}
+	if got := l.Blocks(); len(got) != 0 {
+		t.Errorf("ended blocks listed: %+v", got)
+	}
+	// the failures start over after a block
+	if _, blocked := l.Fail(k, "bad token"); blocked {
+		t.Errorf("blocked again after one failure")
+	}
+}
+
+func TestUnblock(t *testing.T) {
+	l := New(Config{Failures: 1, Window: time.Minute, BlockFor: time.Hour})
+	k := Key{IP, "10.0.0.1"}
+	l.Fail(k, "x")
+	if !l.Unblock(k) {
+		t.Errorf("unblock: no block")
+	}
+	if err := l.Allow(k); err != nil {
+		t.Errorf("after unblock: %v", err)
+	}
+	if l.Unblock(k) {
+		t.Errorf("second unblock found a block")
+	}
+}
+
+func TestNeverBlocks(t *testing.T) {
+	l := New(Config{})
+	for range 10 {
+		if _, blocked := l.Fail(Key{IP, "10.0.0.1"}, "x"); blocked {
+			t.Fatal("blocked with Failures 0")
+		}
+	}
+}
+
+func TestClean(t *testing.T) {
+	l := New(Config{Rules: map[string]Rule{IP: {Rate: 1000, Burst: 1}}, Failures: 3, Window: 10 * time.Millisecond, BlockFor: 10 * time.Millisecond})
+	l.Allow(Key{IP, "a"})
+	l.Fail(Key{IP, "b"}, "x")
+	for range 3 {
+		l.Fail(Key{IP, "c"}, "x")
+	}
+	time.Sleep(20 * time.Millisecond)
+	l.clean()
+	if len(l.buckets) != 0 || len(l.failures) != 0 || len(l.blocks) != 0 {
+		t.Errorf("after clean: %d buckets, %d failures, %d blocks", len(l.buckets), len(l.failures), len(l.blocks))
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	if s := (Key{ApiKey, "titkos-kulcs"}).String(); strings.Contains(s, "titkos") || !strings.HasPrefix(s, ApiKey+" ") {
+		t.Errorf("api key shown: %q", s)
+	}
+	if s := (Key{IP, "10.0.0.1"}).String(); s != "ip 10.0.0.1" {
+		t.Errorf("ip: %q", s)
+	}
+}
@@ -0,0 +1,446 @@
+package servertest
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"server/store"
+)
+
+func TestLogin(t *testing.T) {
+	e := newEnv(t)
+	if err := e.Admin(t.Context(), "aktiv", "operator", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Admin(t.Context(), "tiltott", "operator", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		username string
+		password string
+		ok       bool
+	}{
+		{"right password", "aktiv", Password, true},
+		{"wrong password", "aktiv", "rossz", false},
+		{"empty password", "aktiv", "", false},
+		{"unknown admin", "senki", Password, false},
+		{"disabled admin", "tiltott", Password, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := e.Browser()
+			ok, err := b.Login(t.Context(), tc.username, tc.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.ok {
+				t.Errorf("logged in %v, want %v", ok, tc.ok)
+			}
+			p, err := b.Get(t.Context(), "/admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (p.Code == http.StatusOK) != tc.ok {
+				t.Errorf("/admin answered %d", p.Code)
+			}
+		})
+	}
+}
+
+func TestLoginNeeded(t *testing.T) {
+	e := newEnv(t)
+	b := e.Browser()
+	for _, path := range []string{"/admin", "/admin/logs", "/admin/people", "/admin/people/add", "/admin/live", "/admin/trash", "/admin/audit"} {
+		t.Run(path, func(t *testing.T) {
+			p, err := b.Get(t.Context(), path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Code != http.StatusSeeOther || p.Location != "/admin/login" {
+				t.Errorf("%d to %q, want the login page", p.Code, p.Location)
+			}
+		})
+	}
+	p, err := b.Post(t.Context(), "/admin/people/add", url.Values{"namebox": {"on"}, "name": {"Betörő"}})
+	if err != nil || p.Code != http.StatusSeeOther {
+		t.Errorf("post without session: %d %v, want the login page", p.Code, err)
+	}
+	// a cookie the server didn't give out
+	u, _ := url.Parse(e.URL)
+	b.http.Jar.SetCookies(u, []*http.Cookie{{Name: "AUTH", Value: "hamis", Path: "/"}})
+	p, err = b.Get(t.Context(), "/admin")
+	if err != nil || p.Code != http.StatusSeeOther {
+		t.Errorf("forged cookie: %d %v, want the login page", p.Code, err)
+	}
+}
+
+func TestLoginCsrf(t *testing.T) {
+	e := newEnv(t)
+	if err := e.Admin(t.Context(), "aktiv", "operator", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		csrf func(t *testing.T, b *Browser) string
+	}{
+		{"no form loaded", func(*testing.T, *Browser) string { return "" }},
+		{"wrong token", func(t *testing.T, b *Browser) string {
+			b.Csrf(t.Context(), "/admin/login")
+			return "hamis"
+		}},
+		{"token of an other browser", func(t *testing.T, b *Browser) string {
+			token, _ := e.Browser().Csrf(t.Context(), "/admin/login")
+			return token
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := e.Browser()
+			p, err := b.Post(t.Context(), "/admin/login", url.Values{"username": {"aktiv"}, "password": {Password}, "csrf": {tc.csrf(t, b)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Code != http.StatusForbidden {
+				t.Errorf("%d, want 403", p.Code)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	e := newEnv(t)
+	b, err := e.LoggedIn(t.Context(), "aktiv", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(e.URL)
+	var session []*http.Cookie
+	for _, cookie := range b.http.Jar.Cookies(u) {
+		if cookie.Name == "AUTH" {
+			session = append(session, cookie)
+		}
+	}
+	p, err := b.Get(t.Context(), "/admin/logout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Code != http.StatusSeeOther || p.Location != "/admin/login" {
+		t.Errorf("logout: %d to %q, want the login page", p.Code, p.Location)
+	}
+	p, err = b.Get(t.Context(), "/admin")
+	if err != nil || p.Code != http.StatusSeeOther {
+		t.Errorf("after logout: %d %v, want the login page", p.Code, err)
+	}
+	// a copy of the cookie must not work either
+	b = e.Browser()
+	b.http.Jar.SetCookies(u, session)
+	p, err = b.Get(t.Context(), "/admin")
+	if err != nil || p.Code != http.StatusSeeOther {
+		t.Errorf("old cookie after logout: %d %v, want the login page", p.Code, err)
+	}
+}
+
+func TestSessionOfChangedAdmin(t *testing.T) {
+	e := newEnv(t)
+	ctx := t.Context()
+	for _, tc := range []struct {
+		name   string
+		change func(username string) error
+		ok     bool
+	}{
+		{"unchanged", func(string) error { return nil }, true},
+		{"disabled", func(username string) error { return e.Store.SetDisabled(ctx, username, true) }, false},
+		{"deleted", func(username string) error { return e.Store.DeleteAdmin(ctx, username) }, false},
+		{"demoted", func(username string) error {
+			_, err := e.Store.Update(ctx, "admins", store.Row{"role": "viewer"}, store.Row{"username": username})
+			return err
+		}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			username := "valtozo-" + tc.name
+			b, err := e.LoggedIn(ctx, username, "superadmin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.change(username); err != nil {
+				t.Fatal(err)
+			}
+			p, err := b.Get(ctx, "/admin/admins")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (p.Code == http.StatusOK) != tc.ok || (!tc.ok && p.Location != "/admin/login") {
+				t.Errorf("%d to %q, ok %v", p.Code, p.Location, tc.ok)
+			}
+		})
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	e := newEnv(t)
+	browsers := make(map[string]*Browser)
+	for _, role := range []string{"viewer", "operator", "installer", "superadmin"} {
+		b, err := e.LoggedIn(t.Context(), role, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		browsers[role] = b
+	}
+	for _, tc := range []struct {
+		path    string
+		allowed []string
+	}{
+		{"/admin", []string{"viewer", "operator", "installer", "superadmin"}},
+		{"/admin/logs", []string{"viewer", "operator", "installer", "superadmin"}},
+		{"/admin/people", []string{"operator", "superadmin"}},
+		{"/admin/people/add", []string{"operator", "superadmin"}},
+		{"/admin/people/delete", []string{"operator", "superadmin"}},
+		{"/admin/cards", []string{"operator", "superadmin"}},
+		{"/admin/readers", []string{"installer", "superadmin"}},
+		{"/admin/readers/add", []string{"installer", "superadmin"}},
+		{"/admin/admins", []string{"superadmin"}},
+		{"/admin/admins/add", []string{"superadmin"}},
+		{"/admin/audit", []string{"superadmin"}},
+		{"/admin/attendance", []string{"operator", "superadmin"}},
+		{"/admin/webhooks", []string{"superadmin"}},
+		{"/admin/blocks", []string{"installer", "superadmin"}},
+	} {
+		for role, b := range browsers {
+			t.Run(tc.path+" as "+role, func(t *testing.T) {
+				p, err := b.Get(t.Context(), tc.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := http.StatusForbidden
+				if slices.Contains(tc.allowed, role) {
+					want = http.StatusOK
+				}
+				if p.Code != want {
+					t.Errorf("%d, want %d", p.Code, want)
+				}
+			})
+		}
+	}
+}
+
+func TestAddFactory(t *testing.T) {
+	e := newEnv(t)
+	operator, err := e.LoggedIn(t.Context(), "operator", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	installer, err := e.LoggedIn(t.Context(), "installer", "installer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := operator.Csrf(t.Context(), "/admin/people/add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the installer has a form of its own, only not on the people page
+	installerToken, err := installer.Csrf(t.Context(), "/admin/readers/add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	person := func(name, csrf string) url.Values {
+		return url.Values{"namebox": {"on"}, "name": {name}, "permissionbox": {"on"}, "permission": {"staff"}, "csrf": {csrf}}
+	}
+	for _, tc := range []struct {
+		name    string
+		browser *Browser
+		form    url.Values
+		code    int
+		added   bool
+	}{
+		{"added", operator, person("Új Ember", token), http.StatusSeeOther, true},
+		{"no csrf", operator, person("Csrf Nélkül", ""), http.StatusForbidden, false},
+		{"wrong csrf", operator, person("Rossz Csrf", "hamis"), http.StatusForbidden, false},
+		{"csrf of an other session", operator, person("Más Csrf", installerToken), http.StatusForbidden, false},
+		{"no permission", installer, person("Szerelő Embere", installerToken), http.StatusForbidden, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := tc.browser.Post(t.Context(), "/admin/people/add", tc.form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Code != tc.code {
+				t.Errorf("%d, want %d", p.Code, tc.code)
+			}
+			if added := hasPerson(t, e, tc.form.Get("name")); added != tc.added {
+				t.Errorf("added %v, want %v", added, tc.added)
+			}
+		})
+	}
+	if n := auditCount(t, e, "action = 'add' AND tableName = 'people' AND admin = 'operator'"); n != 1 {
+		t.Errorf("%d audit entries of the add, want 1", n)
+	}
+}
+
+func TestAddAdminLongPassword(t *testing.T) {
+	e := newEnv(t)
+	ctx := t.Context()
+	b, err := e.LoggedIn(ctx, "fonok", "superadmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := b.Csrf(ctx, "/admin/admins/add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		password string
+		code     int
+	}{
+		{"72 bytes", strings.Repeat("é", 36), http.StatusSeeOther},
+		{"73 bytes", strings.Repeat("é", 36) + "x", http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			username := "uj-" + strings.ReplaceAll(tc.name, " ", "-")
+			form := url.Values{"usernamebox": {"on"}, "username": {username}, "pwhashbox": {"on"}, "pwhash": {tc.password}, "rolebox": {"on"}, "role": {"viewer"}, "disabledbox": {"on"}, "disabled": {"0"}, "csrf": {token}}
+			p, err := b.Post(ctx, "/admin/admins/add", form)
+			if err != nil || p.Code != tc.code {
+				t.Fatalf("%d %v, want %d", p.Code, err, tc.code)
+			}
+			_, err = e.Store.Admin(ctx, username)
+			if added := err == nil; added != (tc.code == http.StatusSeeOther) {
+				t.Errorf("added %v: %v", added, err)
+			}
+		})
+	}
+}
+
+func TestDeleteFactory(t *testing.T) {
+	e := newEnv(t)
+	operator, err := e.LoggedIn(t.Context(), "operator", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Store.AddPerson(t.Context(), store.Person{Name: "Törlendő", Permission: "staff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := operator.Csrf(t.Context(), "/admin/people/delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"namebox": {"on"}, "name": {"Törlendő"}, "csrf": {token}}
+	// without confirm it is only the preview
+	p, err := operator.Post(t.Context(), "/admin/people/delete", form)
+	if err != nil || p.Code != http.StatusOK {
+		t.Errorf("preview: %d %v, want 200", p.Code, err)
+	}
+	if !hasPerson(t, e, "Törlendő") {
+		t.Errorf("the preview deleted the person")
+	}
+	p, err = operator.Post(t.Context(), "/admin/people/delete", url.Values{"csrf": {token}, "confirm": {"1"}})
+	if err != nil || p.Code != http.StatusBadRequest {
+		t.Errorf("delete without condition: %d %v, want 400", p.Code, err)
+	}
+	form.Set("confirm", "1")
+	p, err = operator.Post(t.Context(), "/admin/people/delete", form)
+	if err != nil || p.Code != http.StatusSeeOther || p.Location != "/admin/people" {
+		t.Errorf("delete: %d to %q %v, want the people page", p.Code, p.Location, err)
+	}
+	if hasPerson(t, e, "Törlendő") {
+		t.Errorf("the person wasn't deleted")
+	}
+	var n int
+	err = e.Store.QueryRow("SELECT COUNT(*) FROM trash WHERE page = 'people' AND admin = 'operator' AND data LIKE '%Törlendő%'").Scan(&n)
+	if err != nil || n != 1 {
+		t.Errorf("%d rows in the trash %v, want 1", n, err)
+	}
+}
+
+func TestDeleteLastSuperadmin(t *testing.T) {
+	e := newEnv(t)
+	ctx := t.Context()
+	b, err := e.LoggedIn(ctx, "fonok", "superadmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Admin(ctx, "masik", "superadmin", false); err != nil {
+		t.Fatal(err)
+	}
+	token, err := b.Csrf(ctx, "/admin/admins/delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"usernamebox": {"on"}, "username": {"masik"}, "confirm": {"1"}, "csrf": {token}}
+	p, err := b.Post(ctx, "/admin/admins/delete", form)
+	if err != nil || p.Code != http.StatusSeeOther {
+		t.Errorf("delete of another superadmin: %d %v, want 303", p.Code, err)
+	}
+	form = url.Values{"rolebox": {"on"}, "role": {"superadmin"}, "confirm": {"1"}, "csrf": {token}}
+	p, err = b.Post(ctx, "/admin/admins/delete", form)
+	if err != nil || p.Code != http.StatusConflict {
+		t.Errorf("delete of the last superadmin: %d %v, want 409", p.Code, err)
+	}
+	if _, err := e.Store.Admin(ctx, "fonok"); err != nil {
+		t.Errorf("the last superadmin is gone: %v", err)
+	}
+}
+
+func TestAuditRedacted(t *testing.T) {
+	e := newEnv(t)
+	operator, err := e.LoggedIn(t.Context(), "operator", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := []string{"titkos-token", "titkos-iro", "titkos-olvaso"}
+	add, err := operator.Csrf(t.Context(), "/admin/cards/add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"csrf": {add}}
+	for _, field := range []struct{ name, value string }{
+		{"serialNumber", "04:0a:0b:0c"}, {"authtoken", secrets[0]}, {"writeKey", secrets[1]}, {"readKey", secrets[2]}, {"owner", "0"},
+	} {
+		form.Set(field.name+"box", "on")
+		form.Set(field.name, field.value)
+	}
+	p, err := operator.Post(t.Context(), "/admin/cards/add", form)
+	if err != nil || p.Code != http.StatusSeeOther {
+		t.Fatalf("add card: %d %v", p.Code, err)
+	}
+	del, err := operator.Csrf(t.Context(), "/admin/cards/delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = operator.Post(t.Context(), "/admin/cards/delete", url.Values{"csrf": {del}, "serialNumberbox": {"on"}, "serialNumber": {"04:0a:0b:0c"}, "confirm": {"1"}})
+	if err != nil || p.Code != http.StatusSeeOther {
+		t.Fatalf("delete card: %d %v", p.Code, err)
+	}
+	rows, err := e.Store.Query("SELECT action, COALESCE(before, ''), COALESCE(after, '') FROM adminAudit WHERE tableName = 'cards'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var action, before, after string
+		if err := rows.Scan(&action, &before, &after); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		for _, secret := range secrets {
+			if strings.Contains(before+after, secret) {
+				t.Errorf("%s audit has the key %q: %s %s", action, secret, before, after)
+			}
+		}
+		if !strings.Contains(before+after, "04:0a:0b:0c") {
+			t.Errorf("%s audit without the card: %s %s", action, before, after)
+		}
+	}
+	if n != 2 {
+		t.Errorf("%d audit entries of the card, want the add and the delete", n)
+	}
+	// the trash keeps the keys, the card can be restored
+	var data string
+	err = e.Store.QueryRow("SELECT data FROM trash WHERE tableName = 'cards'").Scan(&data)
+	if err != nil || !strings.Contains(data, secrets[1]) {
+		t.Errorf("trash %q %v, want the keys of the card", data, err)
+	}
+}
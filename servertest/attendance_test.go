@@ -0,0 +1,66 @@
+package servertest
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttendance(t *testing.T) {
+	e := newEnv(t)
+	f := newFixture(t, e)
+	e.UI.Attendance.DayStart = 8 * time.Hour
+	e.UI.Attendance.DayEnd = 16 * time.Hour
+	operator, err := e.LoggedIn(t.Context(), "operator", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type tap struct {
+		clock     string
+		direction string
+	}
+	for i, tc := range []struct {
+		name  string
+		taps  []tap
+		hours string
+	}{
+		{"in and out", []tap{{"9:00", "in"}, {"17:00", "out"}}, "8.00"},
+		{"missing in", []tap{{"12:00", "out"}}, "4.00"},
+		{"missing out", []tap{{"9:00", "in"}}, "7.00"},
+		// the filled in entry starts at the end of the session before
+		{"missing in after a session", []tap{{"9:00", "in"}, {"12:00", "out"}, {"17:00", "out"}}, "8.00"},
+		{"missing in after a lunch", []tap{{"9:00", "in"}, {"10:00", "out"}, {"11:00", "in"}, {"12:00", "out"}, {"14:00", "out"}}, "4.00"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// a day of its own for every case, a monday
+			day := time.Date(2026, 3, 2+7*i, 0, 0, 0, 0, time.Local)
+			for _, tp := range tc.taps {
+				clock, err := time.Parse("15:04", tp.clock)
+				if err != nil {
+					t.Fatal(err)
+				}
+				at := day.Add(time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute)
+				_, err = e.Store.Exec("INSERT INTO accessLog (card, reader, people, allowed, direction, time) VALUES (?, ?, ?, 1, ?, ?)",
+					f.card.SerialNumber, f.full.Id, f.person, tp.direction, at.UTC().Format(time.DateTime))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			date := day.Format(time.DateOnly)
+			p, err := operator.Get(t.Context(), fmt.Sprintf("/admin/attendance?from=%s&to=%s&person=%d&format=csv", date, date, f.person))
+			if err != nil || p.Code != http.StatusOK {
+				t.Fatalf("payroll: %d %v", p.Code, err)
+			}
+			records, err := csv.NewReader(strings.NewReader(p.Body)).ReadAll()
+			if err != nil || len(records) != 2 {
+				t.Fatalf("payroll %q %v, want one week", p.Body, err)
+			}
+			if got := records[1][4]; got != tc.hours {
+				t.Errorf("%s hours, want %s", got, tc.hours)
+			}
+		})
+	}
+}
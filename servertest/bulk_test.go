@@ -0,0 +1,68 @@
+package servertest
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// upload posts the file as the import form does
+func upload(t *testing.T, b *Browser, path, csrf, name string, content []byte) Page {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("csrf", csrf)
+	w, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	form.Close()
+	r, err := http.NewRequestWithContext(t.Context(), http.MethodPost, b.env.URL+path, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	p, err := b.do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestImportFile(t *testing.T) {
+	e := newEnv(t)
+	operator, err := e.LoggedIn(t.Context(), "operator", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrf, err := operator.Csrf(t.Context(), "/admin/people/import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := []byte("name,permission\nImport Elek,staff\n")
+	// the limit of the import files is 8 MB
+	big := append(bytes.Repeat([]byte("Nagy Fájl,staff\n"), 8<<20/16), '\n')
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		code    int
+		want    string
+	}{
+		{"fits", small, http.StatusOK, "Import Elek"},
+		{"too big", big, http.StatusRequestEntityTooLarge, "túl nagy"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := upload(t, operator, "/admin/people/import", csrf, "people.csv", tc.content)
+			if p.Code != tc.code || !strings.Contains(p.Body, tc.want) {
+				t.Errorf("%d, want %d with %q:\n%.500s", p.Code, tc.code, tc.want, p.Body)
+			}
+		})
+	}
+	// without commit it was a dry run
+	if hasPerson(t, e, "Import Elek") {
+		t.Errorf("the dry run imported")
+	}
+}
@@ -0,0 +1,178 @@
+package servertest
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"server/api"
+	"server/client"
+	"server/events"
+)
+
+// flaky answers code to the first fail requests, then hands them to next
+type flaky struct {
+	next     http.Handler
+	code     int
+	fail     int32
+	requests atomic.Int32
+	header   http.Header // of the last request
+	body     []byte
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := f.requests.Add(1)
+	f.header = r.Header.Clone()
+	f.body, _ = io.ReadAll(r.Body)
+	r.Body = io.NopCloser(strings.NewReader(string(f.body)))
+	if n <= f.fail {
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, "busy", f.code)
+		return
+	}
+	f.next.ServeHTTP(w, r)
+}
+
+func TestClientRetries(t *testing.T) {
+	e := newEnv(t)
+	f := newFixture(t, e)
+	request := client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken}
+	for _, tc := range []struct {
+		name     string
+		code     int
+		fail     int32
+		retries  int
+		ok       bool
+		requests int32
+	}{
+		{"no failure", http.StatusOK, 0, 2, true, 1},
+		{"retried", http.StatusServiceUnavailable, 2, 2, true, 3},
+		{"too many failures", http.StatusServiceUnavailable, 3, 2, false, 3},
+		{"rate limited", http.StatusTooManyRequests, 1, 1, true, 2},
+		{"not retryable", http.StatusBadRequest, 1, 2, false, 1},
+		{"no retries", http.StatusBadGateway, 1, 0, false, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			front := &flaky{next: e.API, code: tc.code, fail: tc.fail}
+			server := httptest.NewServer(front)
+			defer server.Close()
+			api := client.New(server.URL)
+			api.Retries = tc.retries
+			api.Backoff = time.Millisecond
+			ans, err := api.Verify(t.Context(), request)
+			if tc.ok && (err != nil || !ans.Ok) {
+				t.Errorf("answer %+v %v, want granted", ans, err)
+			}
+			var status client.StatusError
+			if !tc.ok && (!errors.As(err, &status) || status.Code != tc.code) {
+				t.Errorf("error %v, want http %d", err, tc.code)
+			}
+			if n := front.requests.Load(); n != tc.requests {
+				t.Errorf("%d requests, want %d", n, tc.requests)
+			}
+		})
+	}
+	// the context stops the retries
+	front := &flaky{next: e.API, code: http.StatusServiceUnavailable, fail: 100}
+	server := httptest.NewServer(front)
+	defer server.Close()
+	api := client.New(server.URL)
+	api.Retries = 100
+	api.Backoff = 10 * time.Millisecond
+	timeout, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	_, err := api.Verify(timeout, request)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("canceled retries: %v, want the deadline", err)
+	}
+}
+
+func TestClientSign(t *testing.T) {
+	e := newEnv(t)
+	f := newFixture(t, e)
+	ctx := t.Context()
+	if err := e.Store.SetReaderSecret(ctx, f.full.Id, "titok"); err != nil {
+		t.Fatal(err)
+	}
+	front := &flaky{next: e.API}
+	server := httptest.NewServer(front)
+	defer server.Close()
+	signed := client.New(server.URL)
+	signed.Sign = client.HMAC("titok")
+	request := client.KeyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber}
+	ans, err := signed.GetKey(ctx, request)
+	if err != nil || !ans.Ok {
+		t.Fatalf("signed request: %+v %v", ans, err)
+	}
+	ts := front.header.Get("X-Timestamp")
+	mac := hmac.New(sha256.New, []byte("titok"))
+	mac.Write([]byte(ts + "."))
+	mac.Write(front.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); ts == "" || front.header.Get("X-Signature") != want {
+		t.Errorf("signature %q at %q, want %q", front.header.Get("X-Signature"), ts, want)
+	}
+	// the readers without a secret don't need the signature
+	ans, err = e.Client.GetKey(ctx, client.KeyRequest{ApiKey: f.plain.ApiKey, SerialNumber: f.card.SerialNumber})
+	if err != nil || !ans.Ok {
+		t.Errorf("unsigned request of a reader without secret: %+v %v", ans, err)
+	}
+
+	js, _ := json.Marshal(request)
+	sign := func(secret string, at time.Time) http.Header {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(js)
+		return http.Header{"X-Timestamp": {ts}, "X-Signature": {"sha256=" + hex.EncodeToString(mac.Sum(nil))}}
+	}
+	replayed := sign("titok", time.Now().Add(-time.Minute))
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		code   int
+	}{
+		{"not signed", nil, http.StatusUnauthorized},
+		{"other secret", sign("masik", time.Now()), http.StatusUnauthorized},
+		{"old timestamp", sign("titok", time.Now().Add(-2*api.SignatureWindow)), http.StatusUnauthorized},
+		{"future timestamp", sign("titok", time.Now().Add(2*api.SignatureWindow)), http.StatusUnauthorized},
+		{"no sha256 prefix", http.Header{"X-Timestamp": {replayed.Get("X-Timestamp")}, "X-Signature": {strings.TrimPrefix(replayed.Get("X-Signature"), "sha256=")}}, http.StatusUnauthorized},
+		{"signed a minute ago", replayed, http.StatusOK},
+		{"replayed", replayed, http.StatusUnauthorized},
+		{"replayed in upper case", http.Header{"X-Timestamp": {replayed.Get("X-Timestamp")}, "X-Signature": {"sha256=" + strings.ToUpper(strings.TrimPrefix(replayed.Get("X-Signature"), "sha256="))}}, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := http.NewRequestWithContext(t.Context(), http.MethodPost, e.URL+"/api/request/key", bytes.NewReader(js))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Content-Type", "application/json")
+			for k, v := range tc.header {
+				r.Header[k] = v
+			}
+			res, err := e.Client.HTTP.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.code {
+				t.Errorf("%d, want %d", res.StatusCode, tc.code)
+			}
+			ev := e.LastEvent()
+			if tc.code != http.StatusOK && (ev.Type != events.Alarm || ev.Reader != f.full.Id) {
+				t.Errorf("event %+v, want an alarm of the reader", ev)
+			}
+		})
+	}
+}
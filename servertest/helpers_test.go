@@ -0,0 +1,103 @@
+package servertest
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"server/client"
+	"server/store"
+)
+
+// newEnv is a NewEnv that is closed at the end of the test
+func newEnv(t *testing.T) *Env {
+	t.Helper()
+	e, err := NewEnv()
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	t.Cleanup(e.Close)
+	return e
+}
+
+// fixture is a person with a card and two readers, full can add cards and
+// hand out write keys, plain can't
+type fixture struct {
+	person int64
+	full   store.Reader
+	plain  store.Reader
+	card   store.Card
+}
+
+func newFixture(t *testing.T, e *Env) fixture {
+	t.Helper()
+	ctx := t.Context()
+	var f fixture
+	var err error
+	f.person, err = e.Store.AddPerson(ctx, store.Person{Name: "Teszt Elek", Permission: "staff"})
+	if err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+	f.full = store.Reader{ApiKey: "full-key", AddCard: true, WriteCard: true, Zone: "A", Direction: "in"}
+	f.full.Id, err = e.Store.AddReader(ctx, f.full)
+	if err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+	f.plain = store.Reader{ApiKey: "plain-key", Zone: "A", Direction: "out"}
+	f.plain.Id, err = e.Store.AddReader(ctx, f.plain)
+	if err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+	f.card = store.Card{SerialNumber: "04:a1:b2:c3", Authtoken: "token-1", WriteKey: "write-1", ReadKey: "read-1", Owner: f.person}
+	err = e.Store.AddCard(ctx, f.card)
+	if err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+	return f
+}
+
+// lastLog checks the newest access log entry
+func lastLog(t *testing.T, e *Env, reader int64, allowed bool) {
+	t.Helper()
+	logs, err := e.Store.RecentLogs(t.Context(), 1)
+	if err != nil {
+		t.Errorf("logs: %v", err)
+		return
+	}
+	if len(logs) != 1 {
+		t.Errorf("no log entry")
+		return
+	}
+	l := logs[0]
+	if l.Allowed != allowed || l.Reader.Valid != (reader != 0) || l.Reader.Int64 != reader {
+		t.Errorf("log entry %+v, want reader %d allowed %v", l, reader, allowed)
+	}
+}
+
+// refused tells if err is the StatusError code of a refused request with a
+// Retry-After
+func refused(err error, code int) bool {
+	var status client.StatusError
+	return errors.As(err, &status) && status.Code == code && status.RetryAfter > 0 && status.Message != ""
+}
+
+// hasPerson tells if there is a person with the name
+func hasPerson(t *testing.T, e *Env, name string) bool {
+	t.Helper()
+	people, err := e.Store.ListPeople(t.Context())
+	if err != nil {
+		t.Errorf("people: %v", err)
+	}
+	return slices.ContainsFunc(people, func(p store.Person) bool { return p.Name == name })
+}
+
+// auditCount is the number of the admin audit entries that match where
+func auditCount(t *testing.T, e *Env, where string) int {
+	t.Helper()
+	var n int
+	err := e.Store.QueryRow("SELECT COUNT(*) FROM adminAudit WHERE " + where).Scan(&n)
+	if err != nil {
+		t.Errorf("audit: %v", err)
+	}
+	return n
+}
@@ -0,0 +1,138 @@
+package servertest
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"server/client"
+	"server/events"
+	"server/ratelimit"
+)
+
+func TestRateLimits(t *testing.T) {
+	e := newEnv(t)
+	// the buckets don't fill up during the test
+	e.Limits.Config = ratelimit.Config{Rules: map[string]ratelimit.Rule{
+		ratelimit.ApiKey: {Rate: 0.01, Burst: 3},
+		ratelimit.IP:     {Rate: 0.01, Burst: 5},
+	}}
+	f := newFixture(t, e)
+	ctx := t.Context()
+	full := client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken}
+	for i := range 3 {
+		ans, err := e.Client.Verify(ctx, full)
+		if err != nil || !ans.Ok {
+			t.Errorf("request %d of the burst: %+v %v", i, ans, err)
+		}
+	}
+	_, err := e.Client.Verify(ctx, full)
+	if !refused(err, http.StatusTooManyRequests) {
+		t.Errorf("over the api key limit: %v, want 429", err)
+	}
+	// the other reader has its own bucket, the address has 1 request left
+	plain := client.VerifyRequest{ApiKey: f.plain.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken}
+	ans, err := e.Client.Verify(ctx, plain)
+	if err != nil || !ans.Ok {
+		t.Errorf("other reader: %+v %v", ans, err)
+	}
+	if ev := e.LastEvent(); ev.Type != events.Granted || ev.Reader != f.plain.Id {
+		t.Errorf("last event %+v, want the grant of the other reader", ev)
+	}
+	_, err = e.Client.Verify(ctx, plain)
+	if !refused(err, http.StatusTooManyRequests) {
+		t.Errorf("over the address limit: %v, want 429", err)
+	}
+	// the refused requests aren't logged
+	if ev := e.LastEvent(); ev.Type != events.Granted || ev.Reader != f.plain.Id {
+		t.Errorf("refused request published %+v", ev)
+	}
+	lastLog(t, e, f.plain.Id, true)
+}
+
+func TestBadTokenBlock(t *testing.T) {
+	e := newEnv(t)
+	e.Limits.Config = ratelimit.Config{Failures: 3, Window: time.Minute, BlockFor: time.Minute}
+	f := newFixture(t, e)
+	ctx := t.Context()
+	good := client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken}
+	bad := client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: "token-2"}
+	// unknown cards are taps of strangers, they don't count
+	for range 5 {
+		_, err := e.Client.Verify(ctx, client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: "ff:ff:ff:ff", Authtoken: "x"})
+		if err != nil {
+			t.Fatalf("unknown card: %v", err)
+		}
+	}
+	for i := range 3 {
+		ans, err := e.Client.Verify(ctx, bad)
+		if err != nil || ans.Ok {
+			t.Errorf("bad authtoken %d: %+v %v", i, ans, err)
+		}
+		if ev := e.LastEvent(); i < 2 && ev.Type != events.Denied {
+			t.Errorf("bad authtoken %d: event %q, want denied", i, ev.Type)
+		}
+	}
+	ev := e.LastEvent()
+	if comment, _ := ev.Comment.(string); ev.Type != events.Alarm || ev.Reader != f.full.Id || !strings.Contains(comment, "blocked") {
+		t.Errorf("block event %+v, want an alarm", ev)
+	}
+	lastLog(t, e, f.full.Id, false)
+	_, err := e.Client.Verify(ctx, good)
+	if !refused(err, http.StatusForbidden) {
+		t.Errorf("blocked reader: %v, want 403", err)
+	}
+	_, err = e.Client.GetKey(ctx, client.KeyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber})
+	if !refused(err, http.StatusForbidden) {
+		t.Errorf("key of the blocked reader: %v, want 403", err)
+	}
+	ans, err := e.Client.Verify(ctx, client.VerifyRequest{ApiKey: f.plain.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken})
+	if err != nil || !ans.Ok {
+		t.Errorf("other reader: %+v %v", ans, err)
+	}
+	// the error goes to the logs, the api key must not
+	err = e.Limits.Allow(ratelimit.Key{Kind: ratelimit.ApiKey, Value: f.full.ApiKey})
+	if err == nil || strings.Contains(err.Error(), f.full.ApiKey) {
+		t.Errorf("block error %q, want one without the api key", err)
+	}
+
+	// the installer sees the block and lifts it
+	installer, err := e.LoggedIn(ctx, "installer", "installer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := installer.Get(ctx, "/admin/blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Code != http.StatusOK || !strings.Contains(p.Body, f.full.ApiKey) || !strings.Contains(p.Body, "bad authtokens") {
+		t.Errorf("blocks page %d without the block:\n%s", p.Code, p.Body)
+	}
+	csrf, err := installer.Csrf(ctx, "/admin/blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unblock := url.Values{"kind": {ratelimit.ApiKey}, "value": {f.full.ApiKey}, "csrf": {csrf}}
+	p, err = installer.Post(ctx, "/admin/blocks/unblock", unblock)
+	if err != nil || p.Code != http.StatusSeeOther {
+		t.Errorf("unblock: %d %v", p.Code, err)
+	}
+	p, err = installer.Post(ctx, "/admin/blocks/unblock", unblock)
+	if err != nil || p.Code != http.StatusNotFound {
+		t.Errorf("unblock again: %d %v, want 404", p.Code, err)
+	}
+	ans, err = e.Client.Verify(ctx, good)
+	if err != nil || !ans.Ok {
+		t.Errorf("unblocked reader: %+v %v", ans, err)
+	}
+	if n := auditCount(t, e, "action = 'unblock' AND tableName = 'blocks' AND admin = 'installer'"); n != 1 {
+		t.Errorf("%d audit entries of the unblock, want 1", n)
+	}
+	var before string
+	err = e.Store.QueryRow("SELECT before FROM adminAudit WHERE action = 'unblock'").Scan(&before)
+	if err != nil || strings.Contains(before, f.full.ApiKey) || !strings.Contains(before, `"reader":`) {
+		t.Errorf("unblock audit %q %v, want the reader without the api key", before, err)
+	}
+}
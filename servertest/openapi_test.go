@@ -0,0 +1,327 @@
+package servertest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"server/api"
+	"server/client"
+	"server/ratelimit"
+	"server/store"
+)
+
+// validate checks value, a decoded json, against the schema. It knows the
+// part of json schema the openapi document uses.
+func validate(spec *api.Spec, schema api.Schema, value any, path string) []error {
+	schema = spec.Schema(schema)
+	var errs []error
+	switch schema.Type {
+	case "object":
+		m, ok := value.(map[string]any)
+		if !ok {
+			return []error{fmt.Errorf("%s: %v isn't an object", path, value)}
+		}
+		for _, name := range schema.Required {
+			if _, ok := m[name]; !ok {
+				errs = append(errs, fmt.Errorf("%s: no %s", path, name))
+			}
+		}
+		for name, v := range m {
+			p, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					errs = append(errs, fmt.Errorf("%s: %s isn't in the schema", path, name))
+				}
+				continue
+			}
+			errs = append(errs, validate(spec, p, v, path+"."+name)...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %v isn't a string", path, value))
+			break
+		}
+		if len(str) < schema.MinLength {
+			errs = append(errs, fmt.Errorf("%s: %q is shorter than %d", path, str, schema.MinLength))
+		}
+		if schema.Pattern != "" && !regexp.MustCompile(schema.Pattern).MatchString(str) {
+			errs = append(errs, fmt.Errorf("%s: %q doesn't match %s", path, str, schema.Pattern))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Errorf("%s: %v isn't a boolean", path, value))
+		}
+	case "integer", "number":
+		if _, ok := value.(float64); !ok {
+			errs = append(errs, fmt.Errorf("%s: %v isn't a number", path, value))
+		}
+	}
+	return errs
+}
+
+// validateJSON is validate of a json text
+func validateJSON(spec *api.Spec, schema api.Schema, js []byte, path string) []error {
+	var v any
+	err := json.Unmarshal(js, &v)
+	if err != nil {
+		return []error{fmt.Errorf("%s: %q isn't json: %w", path, js, err)}
+	}
+	return validate(spec, schema, v, path)
+}
+
+// fieldNames are the json names of the fields of a struct
+func fieldNames(v any) []string {
+	js, _ := json.Marshal(v)
+	var m map[string]any
+	json.Unmarshal(js, &m)
+	return slices.Sorted(maps.Keys(m))
+}
+
+// reply is an http answer of the api
+type reply struct {
+	code   int
+	header http.Header
+	body   []byte
+}
+
+func send(ctx context.Context, e *Env, method, path, contentType, body string) (reply, error) {
+	r, err := http.NewRequestWithContext(ctx, method, e.URL+path, strings.NewReader(body))
+	if err != nil {
+		return reply{}, err
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	res, err := e.Client.HTTP.Do(r)
+	if err != nil {
+		return reply{}, err
+	}
+	defer res.Body.Close()
+	ans := reply{code: res.StatusCode, header: res.Header}
+	ans.body, err = io.ReadAll(res.Body)
+	return ans, err
+}
+
+// blocked is the answer of endpoint to a new reader that got blocked by a bad
+// authtoken
+func blocked(ctx context.Context, e *Env, f fixture, endpoint string) (reply, error) {
+	apiKey := "blocked-" + endpoint
+	_, err := e.Store.AddReader(ctx, store.Reader{ApiKey: apiKey})
+	if err != nil {
+		return reply{}, err
+	}
+	_, err = e.Client.Verify(ctx, client.VerifyRequest{ApiKey: apiKey, SerialNumber: f.card.SerialNumber, Authtoken: "bad"})
+	if err != nil {
+		return reply{}, err
+	}
+	return send(ctx, e, http.MethodPost, "/api/request/"+endpoint, "application/json", requestJSON(endpoint, apiKey, f.card.SerialNumber))
+}
+
+// unsigned is the answer of endpoint to a request of a new reader with a
+// secret that isn't signed
+func unsigned(ctx context.Context, e *Env, f fixture, endpoint string) (reply, error) {
+	apiKey := "signed-" + endpoint
+	_, err := e.Store.AddReader(ctx, store.Reader{ApiKey: apiKey, Secret: "titok"})
+	if err != nil {
+		return reply{}, err
+	}
+	return send(ctx, e, http.MethodPost, "/api/request/"+endpoint, "application/json", requestJSON(endpoint, apiKey, f.card.SerialNumber))
+}
+
+// requestJSON is a valid request of the endpoint
+func requestJSON(endpoint, apiKey, serial string) string {
+	if endpoint == "verify" {
+		return fmt.Sprintf(`{"apikey":%q,"serialnumber":%q,"authtoken":"t"}`, apiKey, serial)
+	}
+	return fmt.Sprintf(`{"apikey":%q,"serialnumber":%q}`, apiKey, serial)
+}
+
+// limitedBurst is the burst of the api keys in the openapi test
+const limitedBurst = 10
+
+func TestOpenAPI(t *testing.T) {
+	e := newEnv(t)
+	ctx := t.Context()
+	spec, err := api.LoadSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one bad authtoken blocks, the 429 is after a few requests
+	e.Limits.Config = ratelimit.Config{
+		Rules:    map[string]ratelimit.Rule{ratelimit.ApiKey: {Rate: 0.01, Burst: limitedBurst}},
+		Failures: 1,
+		Window:   time.Minute,
+		BlockFor: time.Minute,
+	}
+	f := newFixture(t, e)
+	// a granted and a denied request of every endpoint, with the client types
+	requests := map[string][]any{
+		"verify": {
+			client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken},
+			client.VerifyRequest{ApiKey: "nope", SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken},
+		},
+		"key": {
+			client.KeyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Write: true},
+			client.KeyRequest{ApiKey: f.plain.ApiKey, SerialNumber: f.card.SerialNumber, Write: true},
+		},
+		"addCard": {
+			client.AddCardRequest{ApiKey: f.full.ApiKey, SerialNumber: "04:00:00:01"},
+			client.AddCardRequest{ApiKey: f.plain.ApiKey, SerialNumber: "04:00:00:02"},
+		},
+	}
+	paths := make([]string, 0, len(api.Endpoints))
+	for _, endpoint := range api.Endpoints {
+		paths = append(paths, "/api/request/"+endpoint)
+	}
+	if got := slices.Sorted(maps.Keys(spec.Paths)); !slices.Equal(got, slices.Sorted(slices.Values(paths))) {
+		t.Errorf("the spec has the paths %v, the server %v", got, paths)
+	}
+	for _, endpoint := range api.Endpoints {
+		t.Run(endpoint, func(t *testing.T) {
+			path := "/api/request/" + endpoint
+			op, ok := spec.Paths[path]["post"]
+			if !ok {
+				t.Fatalf("%s isn't in the spec", path)
+			}
+			if op.OperationId != endpoint {
+				t.Errorf("%s: operationId %q", path, op.OperationId)
+			}
+			request := op.RequestBody.Content["application/json"]
+			answer := spec.Response(op.Responses["200"]).Content["application/json"]
+			if names := fieldNames(requests[endpoint][0]); !slices.Equal(names, slices.Sorted(maps.Keys(spec.Schema(request.Schema).Properties))) {
+				t.Errorf("%s: the request has the fields %v, the spec %v", path, names, slices.Sorted(maps.Keys(spec.Schema(request.Schema).Properties)))
+			}
+			// the examples of the docs must be right too
+			for _, err := range validate(spec, request.Schema, request.Example, path+" request example") {
+				t.Errorf("%v", err)
+			}
+			for name, ex := range answer.Examples {
+				for _, err := range validate(spec, answer.Schema, ex.Value, path+" example "+name) {
+					t.Errorf("%v", err)
+				}
+			}
+			for i, r := range requests[endpoint] {
+				js, _ := json.Marshal(r)
+				code, body, err := e.Client.Post(ctx, endpoint, "application/json", js)
+				if err != nil {
+					t.Errorf("%s: %v", path, err)
+					continue
+				}
+				if code != http.StatusOK {
+					t.Errorf("%s: %d, want 200", path, code)
+					continue
+				}
+				var ok struct{ Ok bool }
+				json.Unmarshal(body, &ok)
+				if ok.Ok != (i == 0) {
+					t.Errorf("%s: request %d answered %s", path, i, body)
+				}
+				for _, err := range validateJSON(spec, answer.Schema, body, path+" answer") {
+					t.Errorf("%v", err)
+				}
+			}
+			// every error the spec has must be there, with its headers and body
+			for code, res := range op.Responses {
+				var r reply
+				var err error
+				switch code {
+				case "200":
+					continue
+				case "400":
+					r, err = send(ctx, e, http.MethodPost, path, "application/json", "{")
+				case "401":
+					r, err = unsigned(ctx, e, f, endpoint)
+				case "403":
+					r, err = blocked(ctx, e, f, endpoint)
+				case "405":
+					r, err = send(ctx, e, http.MethodGet, path, "", "")
+				case "413":
+					r, err = send(ctx, e, http.MethodPost, path, "application/json", `{"apikey":"`+strings.Repeat("a", api.MaxBody)+`"}`)
+				case "415":
+					r, err = send(ctx, e, http.MethodPost, path, "text/plain", "{}")
+				case "429":
+					// the bucket of a new key runs out after the burst
+					request := requestJSON(endpoint, "limited-"+endpoint, f.card.SerialNumber)
+					for range limitedBurst + 1 {
+						r, err = send(ctx, e, http.MethodPost, path, "application/json", request)
+						if err != nil || r.code != http.StatusOK {
+							break
+						}
+					}
+				default:
+					t.Errorf("%s: the test doesn't know how to get a %s", path, code)
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s %s: %v", path, code, err)
+					continue
+				}
+				if fmt.Sprint(r.code) != code {
+					t.Errorf("%s: %d %s, want %s", path, r.code, r.body, code)
+				}
+				for name := range spec.Response(res).Headers {
+					if r.header.Get(name) == "" {
+						t.Errorf("%s %s: no %s header", path, code, name)
+					}
+				}
+				for contentType, media := range spec.Response(res).Content {
+					if contentType != "application/json" {
+						continue
+					}
+					for _, err := range validate(spec, media.Schema, media.Example, path+" "+code+" example") {
+						t.Errorf("%v", err)
+					}
+					for _, err := range validateJSON(spec, media.Schema, r.body, path+" "+code+" answer") {
+						t.Errorf("%v", err)
+					}
+				}
+			}
+		})
+	}
+	// the served documents
+	for _, page := range []struct {
+		path, contentType string
+		parse             func([]byte) error
+	}{
+		{"/api/openapi.yaml", "application/yaml", func(b []byte) error { var v any; return yaml.Unmarshal(b, &v) }},
+		{"/api/openapi.json", "application/json", func(b []byte) error { var v any; return json.Unmarshal(b, &v) }},
+		{"/api/docs", "text/html; charset=utf-8", func(b []byte) error {
+			for _, path := range paths {
+				if !strings.Contains(string(b), path) {
+					return fmt.Errorf("no %s on the page", path)
+				}
+			}
+			return nil
+		}},
+	} {
+		res, err := e.Client.HTTP.Get(e.URL + page.path)
+		if err != nil {
+			t.Errorf("%s: %v", page.path, err)
+			continue
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Errorf("%s: %v", page.path, err)
+			continue
+		}
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != page.contentType {
+			t.Errorf("%s: %d %s", page.path, res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		if err := page.parse(body); err != nil {
+			t.Errorf("%s: %v", page.path, err)
+		}
+	}
+}
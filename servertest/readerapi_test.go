@@ -0,0 +1,211 @@
+package servertest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"server/api"
+	"server/client"
+	"server/events"
+	"server/store"
+)
+
+func TestVerify(t *testing.T) {
+	e := newEnv(t)
+	f := newFixture(t, e)
+	granted := client.VerifyAnswer{Ok: true, Name: "Teszt Elek", Permission: "staff"}
+	for _, tc := range []struct {
+		name    string
+		request client.VerifyRequest
+		want    client.VerifyAnswer
+		event   string
+		reader  int64
+	}{
+		{"granted", client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken}, granted, events.Granted, f.full.Id},
+		{"granted on a plain reader", client.VerifyRequest{ApiKey: f.plain.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken}, granted, events.Granted, f.plain.Id},
+		{"bad api key", client.VerifyRequest{ApiKey: "nope", SerialNumber: f.card.SerialNumber, Authtoken: f.card.Authtoken}, client.VerifyAnswer{}, events.Alarm, 0},
+		{"unknown card", client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: "ff:ff:ff:ff", Authtoken: f.card.Authtoken}, client.VerifyAnswer{}, events.Denied, f.full.Id},
+		{"bad authtoken", client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: "token-2"}, client.VerifyAnswer{}, events.Denied, f.full.Id},
+		{"authtoken prefix", client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: "token"}, client.VerifyAnswer{}, events.Denied, f.full.Id},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ans, err := e.Client.Verify(t.Context(), tc.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ans != tc.want {
+				t.Errorf("answer %+v, want %+v", ans, tc.want)
+			}
+			if ev := e.LastEvent(); ev.Type != tc.event {
+				t.Errorf("event %q, want %q", ev.Type, tc.event)
+			}
+			lastLog(t, e, tc.reader, tc.want.Ok)
+		})
+	}
+	// the reader gets seen on every request
+	r, err := e.Store.Reader(t.Context(), f.full.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LastSeen.IsZero() {
+		t.Errorf("lastSeen of the reader wasn't set")
+	}
+}
+
+func TestKey(t *testing.T) {
+	e := newEnv(t)
+	f := newFixture(t, e)
+	for _, tc := range []struct {
+		name    string
+		request client.KeyRequest
+		want    client.KeyAnswer
+		event   string
+		reader  int64
+	}{
+		{"read key", client.KeyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber}, client.KeyAnswer{Ok: true, Key: f.card.ReadKey}, events.Key, f.full.Id},
+		{"read key on a plain reader", client.KeyRequest{ApiKey: f.plain.ApiKey, SerialNumber: f.card.SerialNumber}, client.KeyAnswer{Ok: true, Key: f.card.ReadKey}, events.Key, f.plain.Id},
+		{"write key", client.KeyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Write: true}, client.KeyAnswer{Ok: true, Key: f.card.WriteKey}, events.Key, f.full.Id},
+		{"write key on a plain reader", client.KeyRequest{ApiKey: f.plain.ApiKey, SerialNumber: f.card.SerialNumber, Write: true}, client.KeyAnswer{}, events.Denied, f.plain.Id},
+		{"unknown card", client.KeyRequest{ApiKey: f.full.ApiKey, SerialNumber: "ff:ff:ff:ff"}, client.KeyAnswer{}, events.Denied, f.full.Id},
+		{"bad api key", client.KeyRequest{ApiKey: "nope", SerialNumber: f.card.SerialNumber, Write: true}, client.KeyAnswer{}, events.Alarm, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ans, err := e.Client.GetKey(t.Context(), tc.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ans != tc.want {
+				t.Errorf("answer %+v, want %+v", ans, tc.want)
+			}
+			if ev := e.LastEvent(); ev.Type != tc.event {
+				t.Errorf("event %q, want %q", ev.Type, tc.event)
+			}
+			lastLog(t, e, tc.reader, tc.want.Ok)
+		})
+	}
+}
+
+func TestAddCard(t *testing.T) {
+	e := newEnv(t)
+	f := newFixture(t, e)
+	for _, tc := range []struct {
+		name    string
+		request client.AddCardRequest
+		ok      bool
+		event   string
+		reader  int64
+	}{
+		{"added", client.AddCardRequest{ApiKey: f.full.ApiKey, SerialNumber: "04:00:00:01"}, true, events.Enrolled, f.full.Id},
+		{"reader can't add", client.AddCardRequest{ApiKey: f.plain.ApiKey, SerialNumber: "04:00:00:02"}, false, events.Denied, f.plain.Id},
+		{"existing card", client.AddCardRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber}, false, events.Denied, f.full.Id},
+		{"bad api key", client.AddCardRequest{ApiKey: "nope", SerialNumber: "04:00:00:03"}, false, events.Alarm, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ans, err := e.Client.AddCard(t.Context(), tc.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ev := e.LastEvent(); ev.Type != tc.event {
+				t.Errorf("event %q, want %q", ev.Type, tc.event)
+			}
+			lastLog(t, e, tc.reader, tc.ok)
+			card, err := e.Store.Card(t.Context(), tc.request.SerialNumber)
+			if !tc.ok {
+				if ans != (client.AddCardAnswer{}) {
+					t.Errorf("answer %+v, want the zero answer", ans)
+				}
+				if tc.request.SerialNumber != f.card.SerialNumber && !errors.Is(err, store.ErrNotFound) {
+					t.Errorf("the card was stored: %v", err)
+				}
+				if tc.request.SerialNumber == f.card.SerialNumber && card != f.card {
+					t.Errorf("the card changed to %+v", card)
+				}
+				return
+			}
+			if !ans.Ok {
+				t.Fatalf("not ok")
+			}
+			// the sizes of the keys come from api.KeySizes of the env
+			for _, k := range []struct {
+				name  string
+				value string
+				size  int
+			}{{"authtoken", ans.Authtoken, 16}, {"writekey", ans.WriteKey, 6}, {"readkey", ans.ReadKey, 6}} {
+				b, err := base64.RawStdEncoding.DecodeString(k.value)
+				if err != nil || len(b) != k.size {
+					t.Errorf("%s %q isn't %d bytes of base64", k.name, k.value, k.size)
+				}
+			}
+			if err != nil {
+				t.Fatalf("stored card: %v", err)
+			}
+			want := store.Card{SerialNumber: tc.request.SerialNumber, Authtoken: ans.Authtoken, WriteKey: ans.WriteKey, ReadKey: ans.ReadKey, Owner: 0}
+			if card != want {
+				t.Errorf("stored %+v, want %+v", card, want)
+			}
+		})
+	}
+}
+
+// TestBadRequests are the requests the handler doesn't get to
+func TestBadRequests(t *testing.T) {
+	e := newEnv(t)
+	valid := `{"apikey":"nope","serialnumber":"04:a1:b2:c3","authtoken":"t"}`
+	for _, tc := range []struct {
+		name        string
+		endpoint    string
+		contentType string
+		body        string
+		code        int
+		want        string // in the error
+	}{
+		{"broken json", "verify", "application/json", `{"apikey":`, http.StatusBadRequest, "unexpected EOF"},
+		{"wrong types", "key", "application/json", `{"apikey":1}`, http.StatusBadRequest, "cannot unmarshal"},
+		{"not json", "addCard", "application/json", `apikey=x`, http.StatusBadRequest, "invalid character"},
+		{"unknown field", "verify", "application/json", `{"apikey":"nope","serialnumber":"04:a1:b2:c3","authtoken":"t","pin":1}`, http.StatusBadRequest, `unknown field "pin"`},
+		{"two requests", "verify", "application/json", valid + valid, http.StatusBadRequest, "data after"},
+		{"no apikey", "key", "application/json", `{"serialnumber":"04:a1:b2:c3"}`, http.StatusBadRequest, "no apikey"},
+		{"no authtoken", "verify", "application/json", `{"apikey":"nope","serialnumber":"04:a1:b2:c3"}`, http.StatusBadRequest, "no authtoken"},
+		{"bad serial number", "addCard", "application/json", `{"apikey":"nope","serialnumber":"04:a1:b2"}`, http.StatusBadRequest, "bad serialnumber"},
+		{"everything wrong", "verify", "application/json", `{}`, http.StatusBadRequest, "no apikey; bad serialnumber \"\"; no authtoken"},
+		{"too long", "verify", "application/json", `{"apikey":"` + strings.Repeat("a", api.MaxBody) + `"}`, http.StatusRequestEntityTooLarge, "too large"},
+		{"no content type", "verify", "", valid, http.StatusUnsupportedMediaType, "no media type"},
+		{"form content type", "verify", "application/x-www-form-urlencoded", valid, http.StatusUnsupportedMediaType, "isn't application/json"},
+		{"latin2", "verify", "application/json; charset=iso-8859-2", valid, http.StatusUnsupportedMediaType, "isn't utf-8"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, body, err := e.Client.Post(t.Context(), tc.endpoint, tc.contentType, []byte(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ans api.ErrorAnswer
+			err = json.Unmarshal(body, &ans)
+			if code != tc.code || err != nil || !strings.Contains(ans.Error, tc.want) {
+				t.Errorf("%d %q, want %d with %q", code, body, tc.code, tc.want)
+			}
+		})
+	}
+	code, _, err := e.Client.Post(t.Context(), "unknown", "application/json", []byte(valid))
+	if err != nil || code != http.StatusNotFound {
+		t.Errorf("unknown endpoint: %d %v, want 404", code, err)
+	}
+	if ev := e.LastEvent(); ev.Type != "" {
+		t.Errorf("the bad requests published %+v", ev)
+	}
+	// the media type is parsed, not compared
+	for _, contentType := range []string{"application/json; charset=utf-8", "Application/JSON;charset=UTF-8", "application/json; v=1"} {
+		t.Run(contentType, func(t *testing.T) {
+			code, body, err := e.Client.Post(t.Context(), "verify", contentType, []byte(valid))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != http.StatusOK || string(body) != `{"ok":false,"name":"","perm":""}` {
+				t.Errorf("%d %q, want the denied answer", code, body)
+			}
+		})
+	}
+}
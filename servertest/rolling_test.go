@@ -0,0 +1,117 @@
+package servertest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"server/client"
+	"server/events"
+	"server/ratelimit"
+)
+
+func TestRollingTokens(t *testing.T) {
+	e := newEnv(t)
+	e.API.Rolling = true
+	e.API.Grace = time.Minute
+	// only a bad authtoken may block the reader, the old tokens don't count
+	e.Limits.Config = ratelimit.Config{Failures: 1, Window: time.Minute, BlockFor: time.Minute}
+	f := newFixture(t, e)
+	ctx := t.Context()
+	tap := func(name, authtoken string, ok bool, event string) client.VerifyAnswer {
+		t.Helper()
+		ans, err := e.Client.Verify(ctx, client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: authtoken})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if ans.Ok != ok || ok != (ans.Authtoken != "") {
+			t.Errorf("%s: answer %+v, want ok %v", name, ans, ok)
+		}
+		if ev := e.LastEvent(); ev.Type != event {
+			t.Errorf("%s: event %q, want %q", name, ev.Type, event)
+		}
+		return ans
+	}
+	first := tap("first tap", f.card.Authtoken, true, events.Granted)
+	if first.Authtoken == f.card.Authtoken {
+		t.Errorf("first tap: the authtoken didn't change")
+	}
+	// the reader couldn't write the new token, it comes again
+	again := tap("previous token", f.card.Authtoken, true, events.Granted)
+	if again.Authtoken != first.Authtoken {
+		t.Errorf("previous token: got %q, want the same new token %q", again.Authtoken, first.Authtoken)
+	}
+	second := tap("second tap", first.Authtoken, true, events.Granted)
+	if second.Authtoken == first.Authtoken {
+		t.Errorf("second tap: the authtoken didn't change")
+	}
+	third := tap("third tap", second.Authtoken, true, events.Granted)
+	card, err := e.Store.Card(ctx, f.card.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.Authtoken != third.Authtoken || card.PrevAuthtoken != second.Authtoken {
+		t.Errorf("card after three taps: %+v", card)
+	}
+
+	// the first token is on a copy of the card, made before the first tap
+	tap("copy", f.card.Authtoken, false, events.Alarm)
+	ev := e.LastEvent()
+	if comment, _ := ev.Comment.(string); ev.Reader != f.full.Id || !strings.Contains(comment, "cloned") {
+		t.Errorf("clone event %+v", ev)
+	}
+	lastLog(t, e, f.full.Id, false)
+	card, err = e.Store.Card(ctx, f.card.SerialNumber)
+	if err != nil || !card.Suspended {
+		t.Errorf("copy: the card isn't suspended: %v", err)
+	}
+	tap("suspended card", third.Authtoken, false, events.Denied)
+	key, err := e.Client.GetKey(ctx, client.KeyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Write: true})
+	if err != nil || key.Ok || key.Key != "" {
+		t.Errorf("key of the suspended card: %+v %v, want denied", key, err)
+	}
+	if ev := e.LastEvent(); ev.Type != events.Denied {
+		t.Errorf("key of the suspended card: event %q, want denied", ev.Type)
+	}
+	if len(e.Limits.Blocks()) != 0 {
+		t.Errorf("the old tokens blocked the reader: %+v", e.Limits.Blocks())
+	}
+
+	// lifted, the current token works again, the previous one only within
+	// the grace time, the older ones suspend again
+	lift := func() {
+		t.Helper()
+		if err := e.Store.SetSuspended(ctx, f.card.SerialNumber, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lift()
+	fourth := tap("lifted", third.Authtoken, true, events.Granted)
+	key, err = e.Client.GetKey(ctx, client.KeyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber})
+	if err != nil || !key.Ok || key.Key != f.card.ReadKey {
+		t.Errorf("key of the lifted card: %+v %v", key, err)
+	}
+	e.API.Grace = 0
+	tap("previous token after the grace time", third.Authtoken, false, events.Denied)
+	card, err = e.Store.Card(ctx, f.card.SerialNumber)
+	if err != nil || card.Suspended || card.Authtoken != fourth.Authtoken {
+		t.Errorf("after the grace time: %+v %v", card, err)
+	}
+	tap("second copy", first.Authtoken, false, events.Alarm)
+	card, err = e.Store.Card(ctx, f.card.SerialNumber)
+	if err != nil || !card.Suspended {
+		t.Errorf("second copy: the card isn't suspended: %v", err)
+	}
+	lift()
+
+	// without rolling the token stays, the old ones are just bad
+	e.API.Rolling = false
+	ans, err := e.Client.Verify(ctx, client.VerifyRequest{ApiKey: f.full.ApiKey, SerialNumber: f.card.SerialNumber, Authtoken: fourth.Authtoken})
+	if err != nil || !ans.Ok || ans.Authtoken != "" {
+		t.Errorf("not rolling: %+v %v", ans, err)
+	}
+	card, err = e.Store.Card(ctx, f.card.SerialNumber)
+	if err != nil || card.Authtoken != fourth.Authtoken {
+		t.Errorf("not rolling: the authtoken changed: %v", err)
+	}
+}
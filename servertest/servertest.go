@@ -0,0 +1,232 @@
+// Package servertest is the end to end tests of the reader api and the admin
+// ui: every test gets a new server on a temporary sqlite db behind httptest
+// and talks to it over https. The simulator runs its server with it too.
+package servertest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"server/api"
+	"server/client"
+	"server/events"
+	"server/frontend"
+	"server/ratelimit"
+	"server/store"
+	"server/store/sqlite"
+	"server/store/sqlstore"
+	"server/templates"
+)
+
+// Password is the password of the admins made by Admin
+const Password = "pw"
+
+// Env is a server on a new sqlite db
+type Env struct {
+	URL    string
+	Store  *sqlstore.DB
+	UI     *frontend.Server
+	API    *api.Server
+	Client *client.Client
+	// Limits of the api and the blocks page limit nothing, the tests of
+	// the limits set its Config before their first request
+	Limits *ratelimit.Limiter
+
+	server *httptest.Server
+	dir    string
+	lock   sync.Mutex
+	events []events.Event
+}
+
+// NewEnv starts a server with every feature on, the logs are dropped
+func NewEnv() (*Env, error) {
+	dir, err := os.MkdirTemp("", "servertest")
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqlite.Open(filepath.Join(dir, "test.db"), 5*time.Second)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	html, txt, err := templates.Parse()
+	if err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	e := &Env{Store: db, dir: dir, Limits: ratelimit.New(ratelimit.Config{})}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bus := &events.Bus{}
+	bus.Handle(func(ev events.Event) {
+		e.lock.Lock()
+		e.events = append(e.events, ev)
+		e.lock.Unlock()
+	})
+	e.UI = frontend.New(frontend.Config{
+		Store:           db,
+		Html:            html,
+		Txt:             txt,
+		Log:             log,
+		Events:          bus,
+		SessionLifetime: time.Hour,
+		TrashDays:       30,
+		WebhookAttempts: 1,
+		Attendance:      frontend.AttendanceRules{MissingIn: frontend.MissingDefault, MissingOut: frontend.MissingDefault},
+		Limits:          e.Limits,
+	})
+	e.API = api.New(api.Config{
+		Store:  db,
+		Events: bus,
+		Log:    log,
+		Keys:   api.KeySizes{ReadKey: 6, WriteKey: 6, Authtoken: 16},
+		Limits: e.Limits,
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", e.UI)
+	mux.Handle("/api/", e.API)
+	// the session cookies are Secure, the cookie jars only send them over https
+	e.server = httptest.NewTLSServer(mux)
+	e.URL = e.server.URL
+	e.Client = client.New(e.URL)
+	e.Client.HTTP = e.server.Client()
+	return e, nil
+}
+
+func (e *Env) Close() {
+	e.server.Close()
+	e.Store.Close()
+	os.RemoveAll(e.dir)
+}
+
+// LastEvent is the last published event, the type is empty if there was none
+func (e *Env) LastEvent() events.Event {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.events) == 0 {
+		return events.Event{}
+	}
+	return e.events[len(e.events)-1]
+}
+
+// Admin adds an admin with Password
+func (e *Env) Admin(ctx context.Context, username, role string, disabled bool) error {
+	// the lowest cost keeps the tests quick, login takes any cost
+	hash, err := bcrypt.GenerateFromPassword([]byte(Password), bcrypt.MinCost)
+	if err != nil {
+		return err
+	}
+	_, err = e.Store.AddAdmin(ctx, store.Admin{Username: username, Pwhash: string(hash), Role: role, Disabled: disabled})
+	return err
+}
+
+// Browser is an admin ui user with its own cookies, it doesn't follow the
+// redirects so the tests see them
+type Browser struct {
+	env  *Env
+	http *http.Client
+}
+
+func (e *Env) Browser() *Browser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	return &Browser{env: e, http: &http.Client{
+		Transport: e.server.Client().Transport,
+		Jar:       jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// Page is an answer of the admin ui
+type Page struct {
+	Code     int
+	Location string
+	Body     string
+}
+
+func (b *Browser) do(r *http.Request) (Page, error) {
+	res, err := b.http.Do(r)
+	if err != nil {
+		return Page{}, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return Page{res.StatusCode, res.Header.Get("Location"), string(body)}, err
+}
+
+func (b *Browser) Get(ctx context.Context, path string) (Page, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, b.env.URL+path, nil)
+	if err != nil {
+		return Page{}, err
+	}
+	return b.do(r)
+}
+
+func (b *Browser) Post(ctx context.Context, path string, form url.Values) (Page, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, b.env.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Page{}, err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(r)
+}
+
+var csrfInput = regexp.MustCompile(`name="csrf" value="([^"]*)"`)
+
+// Csrf is the token of the form on the page at path
+func (b *Browser) Csrf(ctx context.Context, path string) (string, error) {
+	p, err := b.Get(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	m := csrfInput.FindStringSubmatch(p.Body)
+	if m == nil {
+		return "", fmt.Errorf("no csrf token on %s (%d)", path, p.Code)
+	}
+	return m[1], nil
+}
+
+// Login fills in the login form, it tells if there is a session after it
+func (b *Browser) Login(ctx context.Context, username, password string) (bool, error) {
+	csrf, err := b.Csrf(ctx, "/admin/login")
+	if err != nil {
+		return false, err
+	}
+	p, err := b.Post(ctx, "/admin/login", url.Values{"username": {username}, "password": {password}, "csrf": {csrf}})
+	if err != nil {
+		return false, err
+	}
+	return p.Code == http.StatusSeeOther && p.Location == "/admin", nil
+}
+
+// LoggedIn is a Browser of a new admin with the role
+func (e *Env) LoggedIn(ctx context.Context, username, role string) (*Browser, error) {
+	err := e.Admin(ctx, username, role, false)
+	if err != nil {
+		return nil, err
+	}
+	b := e.Browser()
+	ok, err := b.Login(ctx, username, Password)
+	if err == nil && !ok {
+		err = fmt.Errorf("%s can't log in", username)
+	}
+	return b, err
+}
@@ -0,0 +1,65 @@
+// Package postgres is the PostgreSQL backend, the tables are created on
+// start if they don't exist.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"time"
+
+	"server/store/sqlstore"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+//go:embed schema.sql
+var schemaSQL string
+
+var dialect = sqlstore.Dialect{
+	Rebind: sqlstore.Dollar,
+	Unique: func(err error) bool {
+		var e *pgconn.PgError
+		return errors.As(err, &e) && e.Code == "23505"
+	},
+	Time: func(t time.Time) any { return t },
+	// to_char gives the time in the TimeZone of the session
+	Local: func(expr, layout string) string {
+		return fmt.Sprintf("to_char(%s, '%s')", expr, localLayouts[layout])
+	},
+	// an identity isn't moved by an insert with an id, the import and the
+	// restore from the trash give one
+	Identity: func(table string) string {
+		return fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), (SELECT MAX(id) FROM %s))", table, table)
+	},
+}
+
+var localLayouts = map[string]string{
+	"date":     "YYYY-MM-DD",
+	"datetime": "YYYY-MM-DD HH24:MI:SS",
+	"time":     "HH24:MI:SS",
+}
+
+// Open connects to the database of the dsn, a postgres:// url or a
+// key=value string, and creates the missing tables. The reports count the
+// days in the TimeZone of the session, timezone=Europe/Budapest in the dsn
+// sets it.
+func Open(ctx context.Context, dsn string) (*sqlstore.DB, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.PingContext(ctx)
+	if err == nil {
+		// without arguments pgx runs it as one multi statement query
+		_, err = db.ExecContext(ctx, schemaSQL)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sqlstore.New(db, dialect), nil
+}
@@ -0,0 +1,23 @@
+package postgres
+
+import (
+	"os"
+	"testing"
+
+	"server/store/storetest"
+)
+
+// TestStore needs a postgres db to play with, e.g.
+// CARDREADER_TEST_DSN=postgres://cardreader@localhost/cardreader_test
+func TestStore(t *testing.T) {
+	dsn := os.Getenv("CARDREADER_TEST_DSN")
+	if dsn == "" {
+		t.Skip("no CARDREADER_TEST_DSN")
+	}
+	s, err := Open(t.Context(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	storetest.Run(t, s)
+}
@@ -0,0 +1,117 @@
+-- runs on every start so it has to stay idempotent, unquoted names fold to
+-- lower case so the queries of sqlstore work unchanged
+
+CREATE TABLE IF NOT EXISTS reader (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	apiKey VARCHAR(255) not NULL,
+	addCard BOOLEAN not NULL,
+	writeCard BOOLEAN not NULL,
+	zone VARCHAR(255),
+	direction VARCHAR(16) CHECK (direction IN ('in', 'out')),
+	lastSeen TIMESTAMPTZ
+);
+-- hmac key of the signed requests
+ALTER TABLE reader ADD COLUMN IF NOT EXISTS secret VARCHAR(255);
+
+CREATE TABLE IF NOT EXISTS people (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	name VARCHAR(255) not NULL,
+	permission VARCHAR(255) not NULL
+);
+
+CREATE TABLE IF NOT EXISTS cards (
+	serialNumber VARCHAR(255) PRIMARY KEY,
+	authtoken VARCHAR(255) not NULL,
+	writeKey VARCHAR(255) not NULL,
+	readKey VARCHAR(255) not NULL,
+	owner BIGINT not NULL REFERENCES people(id) ON DELETE RESTRICT
+);
+-- the rolling authtokens, the token before the current one
+ALTER TABLE cards ADD COLUMN IF NOT EXISTS prevAuthtoken VARCHAR(255);
+ALTER TABLE cards ADD COLUMN IF NOT EXISTS rolled TIMESTAMPTZ;
+ALTER TABLE cards ADD COLUMN IF NOT EXISTS suspended BOOLEAN not NULL DEFAULT FALSE;
+-- hashes of the replaced rolling authtokens, one of them on a tap is a copy
+-- of the card
+CREATE TABLE IF NOT EXISTS cardTokens (
+	serialNumber VARCHAR(255) not NULL REFERENCES cards(serialNumber) ON DELETE CASCADE,
+	hash VARCHAR(64) not NULL,
+	replaced TIMESTAMPTZ not NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (serialNumber, hash)
+);
+
+CREATE TABLE IF NOT EXISTS accessLog (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	card VARCHAR(255),
+	reader BIGINT REFERENCES reader(id) ON DELETE SET NULL,
+	people BIGINT REFERENCES people(id) ON DELETE SET NULL,
+	allowed BOOLEAN not NULL,
+	direction TEXT,
+	comment TEXT,
+	time TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS accessLogTime ON accessLog (time);
+CREATE INDEX IF NOT EXISTS accessLogPeople ON accessLog (people, time);
+
+CREATE TABLE IF NOT EXISTS admins (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	username VARCHAR(255) not NULL UNIQUE,
+	pwhash TEXT not NULL,
+	role VARCHAR(255) not NULL CHECK (role IN ('viewer', 'operator', 'installer', 'superadmin')),
+	disabled BOOLEAN not NULL DEFAULT FALSE
+);
+
+-- the trail of the admin changes, before and after are json
+CREATE TABLE IF NOT EXISTS adminAudit (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	time TIMESTAMPTZ not NULL DEFAULT CURRENT_TIMESTAMP,
+	admin VARCHAR(255) not NULL,
+	action VARCHAR(255) not NULL,
+	tableName VARCHAR(255) not NULL,
+	before TEXT,
+	after TEXT,
+	ip VARCHAR(255)
+);
+CREATE INDEX IF NOT EXISTS adminAuditTime ON adminAudit (time);
+
+-- the deleted rows as json until they are restored or purged
+CREATE TABLE IF NOT EXISTS trash (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	time TIMESTAMPTZ not NULL DEFAULT CURRENT_TIMESTAMP,
+	admin VARCHAR(255) not NULL,
+	page VARCHAR(255) not NULL,
+	tableName VARCHAR(255) not NULL,
+	data TEXT not NULL
+);
+
+-- events is a comma separated list of event types, empty is all
+CREATE TABLE IF NOT EXISTS webhooks (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	url TEXT not NULL,
+	secret VARCHAR(255) not NULL,
+	events TEXT not NULL DEFAULT '',
+	enabled BOOLEAN not NULL DEFAULT TRUE
+);
+CREATE TABLE IF NOT EXISTS webhookQueue (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	webhook BIGINT not NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+	event VARCHAR(255) not NULL,
+	payload TEXT not NULL,
+	attempts INTEGER not NULL DEFAULT 0,
+	nextTry TIMESTAMPTZ not NULL,
+	created TIMESTAMPTZ not NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS webhookQueueNext ON webhookQueue (nextTry);
+-- status is the http status, 0 if there was no answer
+CREATE TABLE IF NOT EXISTS webhookLog (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	time TIMESTAMPTZ not NULL DEFAULT CURRENT_TIMESTAMP,
+	webhook BIGINT not NULL,
+	delivery BIGINT not NULL,
+	event VARCHAR(255) not NULL,
+	attempt INTEGER not NULL,
+	status INTEGER not NULL,
+	error TEXT
+);
+
+-- the owner of the cards added by readers
+INSERT INTO people (id, name, permission) VALUES (0, 'nobody', '') ON CONFLICT DO NOTHING;
@@ -0,0 +1,62 @@
+/*
+--sqlite dont support this
+CREATE DATABASE cards;
+USE cards;
+*/
+
+CREATE TABLE reader (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	apiKey VARCHAR(255) not NULL,
+	addCard BOOL not NULL,
+	writeCard BOOL not NULL,
+	zone VARCHAR(255),
+	direction VARCHAR(16) CHECK (direction IN ('in', 'out')),
+	lastSeen DATETIME,
+	secret VARCHAR(255) -- hmac key of the signed requests
+);
+
+CREATE TABLE people (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	name VARCHAR(255) not NULL,
+	permission VARCHAR(255) not NULL
+);
+
+CREATE TABLE cards (
+	serialNumber VARCHAR(255) not NULL UNIQUE,
+	authtoken VARCHAR(255) not NULL,
+	writeKey VARCHAR(255) not NULL,
+	readKey VARCHAR(255) not NULL,
+	owner INTEGER not NULL,
+	-- the rolling authtokens, the token before the current one
+	prevAuthtoken VARCHAR(255),
+	rolled DATETIME,
+	suspended BOOL not NULL DEFAULT 0,
+	PRIMARY KEY (serialNumber),
+	-- a person with cards can't be deleted, revoke the cards first
+	FOREIGN KEY (owner) REFERENCES people(id) ON DELETE RESTRICT
+);
+CREATE TABLE accessLog (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	card varchar(255),
+	reader INTEGER,
+	people INTEGER,
+	allowed BOOL not NULL,
+	direction TEXT, 
+	comment TEXT,
+	time DATETIME DEFAULT CURRENT_TIMESTAMP,
+	-- card is the serial as it was read, unknown cards are logged too so it
+	-- has no foreign key. The log outlives the readers and the people.
+	FOREIGN KEY (reader) REFERENCES reader(id) ON DELETE SET NULL,
+	FOREIGN KEY (people) REFERENCES people(id) ON DELETE SET NULL
+);
+
+CREATE TABLE admins (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	username VARCHAR(255) not NULL UNIQUE,
+	pwhash TEXT not NULL, --idq the type right now
+	role VARCHAR(255) not NULL CHECK (role IN ('viewer', 'operator', 'installer', 'superadmin')),
+	disabled BOOLEAN not NULL DEFAULT 0
+);
+
+-- the owner of the cards added by readers
+INSERT INTO people (id, name, permission) VALUES (0, 'nobody', '');
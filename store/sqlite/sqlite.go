@@ -0,0 +1,257 @@
+// Package sqlite is the default backend, one database file that is created
+// on the first start and migrated on every start.
+package sqlite
+
+import (
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"server/store/sqlstore"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SchemaVersion is the user_version of a migrated db, bump it with every
+// migrate change so restore can tell a backup of a newer server apart
+const SchemaVersion = 4
+
+var (
+	//go:embed create.sql
+	createSQL string
+	//go:embed upgrade.sql
+	upgradeSQL string
+)
+
+var dialect = sqlstore.Dialect{
+	Unique: func(err error) bool {
+		var e sqlite3.Error
+		return errors.As(err, &e) && (e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+	},
+}
+
+// Open opens the db file, creates it if it doesn't exist and migrates it.
+// The connections have the foreign keys on, WAL mode lets the readers work
+// while a write is going on and the writers wait up to busyTimeout for each
+// other.
+func Open(path string, busyTimeout time.Duration) (*sqlstore.DB, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		err = create(path)
+		if err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+	}
+	// the migrations rebuild tables, that needs the foreign keys off
+	db, err := sql.Open("sqlite3", dsn(path, busyTimeout, false))
+	if err != nil {
+		return nil, err
+	}
+	err = migrate(db)
+	db.Close()
+	if err != nil {
+		return nil, err
+	}
+	db, err = sql.Open("sqlite3", dsn(path, busyTimeout, true))
+	if err != nil {
+		return nil, err
+	}
+	return sqlstore.New(db, dialect), nil
+}
+
+func dsn(path string, busyTimeout time.Duration, foreignKeys bool) string {
+	v := url.Values{}
+	v.Set("_journal_mode", "WAL")
+	v.Set("_busy_timeout", strconv.FormatInt(busyTimeout.Milliseconds(), 10))
+	v.Set("_foreign_keys", strconv.FormatBool(foreignKeys))
+	return "file:" + path + "?" + v.Encode()
+}
+
+// Orphans returns the number of rows per table that point to a missing row,
+// the foreign keys only guard the changes made since they are on
+func Orphans(db *sql.DB) (map[string]int, error) {
+	rows, err := db.Query("SELECT \"table\", COUNT(*) FROM pragma_foreign_key_check GROUP BY \"table\"")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orphans := make(map[string]int)
+	for rows.Next() {
+		var table string
+		var n int
+		err = rows.Scan(&table, &n)
+		if err != nil {
+			return nil, err
+		}
+		orphans[table] = n
+	}
+	return orphans, rows.Err()
+}
+
+func create(path string) error {
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	fd.Close()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(createSQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// databases created before roles only have the adminTab flag, those admins
+// become superadmins and operators
+func migrateAdminRoles(db *sql.DB) error {
+	row := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('admins') WHERE name = 'role'")
+	var n int
+	err := row.Scan(&n)
+	if err != nil || n != 0 {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"ALTER TABLE admins ADD COLUMN role VARCHAR(255) not NULL DEFAULT 'operator' CHECK (role IN ('viewer', 'operator', 'installer', 'superadmin'))",
+		"UPDATE admins SET role = 'superadmin' WHERE adminTab",
+		"ALTER TABLE admins DROP COLUMN adminTab",
+	} {
+		_, err = tx.Exec(q)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// the accessLog of the first versions has a foreign key to the missing
+// cards.id, with the foreign keys on no log could be written. The table is
+// rebuilt with the keys of create.sql and the references to deleted readers
+// and people are cleared.
+func migrateAccessLogKeys(db *sql.DB) error {
+	row := db.QueryRow("SELECT COUNT(*) FROM pragma_foreign_key_list('accessLog') WHERE \"table\" = 'cards'")
+	var n int
+	err := row.Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		`CREATE TABLE accessLogNew (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	card varchar(255),
+	reader INTEGER,
+	people INTEGER,
+	allowed BOOL not NULL,
+	direction TEXT,
+	comment TEXT,
+	time DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (reader) REFERENCES reader(id) ON DELETE SET NULL,
+	FOREIGN KEY (people) REFERENCES people(id) ON DELETE SET NULL
+)`,
+		`INSERT INTO accessLogNew (id, card, reader, people, allowed, direction, comment, time)
+	SELECT id, card,
+		CASE WHEN reader IN (SELECT id FROM reader) THEN reader END,
+		CASE WHEN people IN (SELECT id FROM people) THEN people END,
+		allowed, direction, comment, time
+	FROM accessLog`,
+		"DROP TABLE accessLog",
+		"ALTER TABLE accessLogNew RENAME TO accessLog",
+	} {
+		_, err = tx.Exec(q)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// addColumn adds the column if the table doesn't have it yet, sqlite has no
+// ADD COLUMN IF NOT EXISTS
+func addColumn(db *sql.DB, table, column, definition string) error {
+	row := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column)
+	var n int
+	err := row.Scan(&n)
+	if err != nil || n != 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// migrate brings databases made by older versions up to date
+func migrate(db *sql.DB) error {
+	err := migrateAdminRoles(db)
+	if err != nil {
+		return err
+	}
+	// the default of an added column can't be CURRENT_TIMESTAMP, AddLog sets it
+	err = addColumn(db, "accessLog", "time", "DATETIME")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "reader", "zone", "VARCHAR(255)")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "reader", "direction", "VARCHAR(16) CHECK (direction IN ('in', 'out'))")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "reader", "lastSeen", "DATETIME")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "reader", "secret", "VARCHAR(255)")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "admins", "disabled", "BOOLEAN not NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct{ name, definition string }{
+		{"prevAuthtoken", "VARCHAR(255)"},
+		{"rolled", "DATETIME"},
+		{"suspended", "BOOL not NULL DEFAULT 0"},
+	} {
+		err = addColumn(db, "cards", c.name, c.definition)
+		if err != nil {
+			return err
+		}
+	}
+	// after the time column, the rebuild copies it
+	err = migrateAccessLogKeys(db)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(upgradeSQL)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion))
+	return err
+}
@@ -0,0 +1,65 @@
+-- tables added after the first release, this runs on every start so it has
+-- to stay idempotent
+
+CREATE TABLE IF NOT EXISTS adminAudit (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	time DATETIME not NULL DEFAULT CURRENT_TIMESTAMP,
+	admin VARCHAR(255) not NULL,
+	action VARCHAR(255) not NULL,
+	tableName VARCHAR(255) not NULL,
+	before TEXT, --json
+	after TEXT, --json
+	ip VARCHAR(255)
+);
+CREATE INDEX IF NOT EXISTS adminAuditTime ON adminAudit (time);
+
+CREATE TABLE IF NOT EXISTS trash (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	time DATETIME not NULL DEFAULT CURRENT_TIMESTAMP,
+	admin VARCHAR(255) not NULL,
+	page VARCHAR(255) not NULL,
+	tableName VARCHAR(255) not NULL,
+	data TEXT not NULL --json of the deleted row
+);
+
+CREATE INDEX IF NOT EXISTS accessLogTime ON accessLog (time);
+CREATE INDEX IF NOT EXISTS accessLogPeople ON accessLog (people, time);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	url TEXT not NULL,
+	secret VARCHAR(255) not NULL,
+	events TEXT not NULL DEFAULT '', --comma separated event types, empty is all
+	enabled BOOL not NULL DEFAULT 1
+);
+CREATE TABLE IF NOT EXISTS webhookQueue (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	webhook INTEGER not NULL,
+	event VARCHAR(255) not NULL,
+	payload TEXT not NULL,
+	attempts INTEGER not NULL DEFAULT 0,
+	nextTry DATETIME not NULL,
+	created DATETIME not NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (webhook) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS webhookQueueNext ON webhookQueue (nextTry);
+CREATE TABLE IF NOT EXISTS webhookLog (
+	id INTEGER PRIMARY KEY not NULL UNIQUE,
+	time DATETIME not NULL DEFAULT CURRENT_TIMESTAMP,
+	webhook INTEGER not NULL,
+	delivery INTEGER not NULL,
+	event VARCHAR(255) not NULL,
+	attempt INTEGER not NULL,
+	status INTEGER not NULL, --http status, 0 if there was no answer
+	error TEXT
+);
+
+-- hashes of the replaced rolling authtokens of the cards, one of them on a
+-- tap is a copy of the card
+CREATE TABLE IF NOT EXISTS cardTokens (
+	serialNumber VARCHAR(255) not NULL,
+	hash VARCHAR(64) not NULL,
+	replaced DATETIME not NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (serialNumber, hash),
+	FOREIGN KEY (serialNumber) REFERENCES cards(serialNumber) ON DELETE CASCADE
+);
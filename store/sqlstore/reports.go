@@ -0,0 +1,171 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"server/store"
+)
+
+// the access log with everything it points to
+const reportFrom = ` FROM accessLog l
+	LEFT JOIN people p ON l.people = p.id
+	LEFT JOIN reader r ON l.reader = r.id
+	LEFT JOIN cards c ON l.card = c.serialNumber
+	LEFT JOIN people o ON c.owner = o.id`
+
+// where joins the conditions, empty without any
+func where(conds ...string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// logConds are the conditions of the dates, the reader and the zone of f,
+// the person differs between the queries
+func (db *DB) logConds(f store.LogFilter) ([]string, []any) {
+	conds := make([]string, 0)
+	args := make([]any, 0)
+	day := db.local("l.time", "date")
+	if f.From != "" {
+		conds = append(conds, day+" >= ?")
+		args = append(args, f.From)
+	}
+	if f.To != "" {
+		conds = append(conds, day+" <= ?")
+		args = append(args, f.To)
+	}
+	if f.Reader.Valid {
+		conds = append(conds, "l.reader = ?")
+		args = append(args, f.Reader)
+	}
+	if f.Zone != "" {
+		conds = append(conds, "r.zone = ?")
+		args = append(args, f.Zone)
+	}
+	return conds, args
+}
+
+func (db *DB) Report(ctx context.Context, name string, f store.LogFilter) ([][]any, error) {
+	conds, args := db.logConds(f)
+	day := db.local("l.time", "date")
+	var query string
+	switch name {
+	case "person":
+		if !f.Person.Valid {
+			return [][]any{}, nil
+		}
+		conds = append(conds, "(l.people = ? OR (l.people IS NULL AND c.owner = ?))")
+		args = append(args, f.Person, f.Person)
+		query = "SELECT " + db.local("l.time", "datetime") + ", l.reader, l.card, l.allowed, l.direction, l.comment" +
+			reportFrom + where(conds...) + " ORDER BY l.time"
+	case "reader":
+		query = "SELECT " + day + " AS day, l.reader, SUM(CASE WHEN l.allowed THEN 1 ELSE 0 END), SUM(CASE WHEN l.allowed THEN 0 ELSE 1 END), COUNT(DISTINCT l.people)" +
+			reportFrom + where(conds...) + " GROUP BY day, l.reader ORDER BY day, l.reader"
+	case "denied":
+		conds = append(conds, "NOT l.allowed")
+		query = "SELECT " + db.local("l.time", "datetime") + ", l.reader, l.card, o.name, l.comment" +
+			reportFrom + where(conds...) + " ORDER BY l.time"
+	case "presence":
+		conds = append(conds, "l.allowed", "l.people IS NOT NULL")
+		query = "SELECT " + day + " AS day, l.people, p.name, " +
+			db.local("MIN(CASE WHEN l.direction IS NULL OR l.direction = 'in' THEN l.time END)", "time") + ", " +
+			db.local("MAX(CASE WHEN l.direction IS NULL OR l.direction = 'out' THEN l.time END)", "time") + ", COUNT(*)" +
+			reportFrom + where(conds...) + " GROUP BY day, l.people, p.name ORDER BY day, p.name"
+	default:
+		return nil, store.ErrNotFound
+	}
+	rows, err := db.QueryContext(ctx, db.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]any, 0)
+	for rows.Next() {
+		values := make([]any, len(cols))
+		pointers := make([]any, len(cols))
+		for k := range values {
+			pointers[k] = &values[k]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[k] = string(b)
+			}
+		}
+		out = append(out, values)
+	}
+	return out, rows.Err()
+}
+
+func (db *DB) Taps(ctx context.Context, f store.LogFilter) ([]store.Tap, error) {
+	conds, args := db.logConds(f)
+	conds = append(conds, "l.allowed", "l.time IS NOT NULL")
+	if f.Person.Valid {
+		conds = append(conds, "l.people = ?")
+		args = append(args, f.Person)
+	}
+	return list(ctx, db, func(rows *sql.Rows) (store.Tap, error) {
+		var t store.Tap
+		err := rows.Scan(&t.Person, &t.Name, &t.Time, &t.Direction)
+		return t, err
+	}, `SELECT l.people, p.name, l.time, COALESCE(l.direction, r.direction, '')
+		FROM accessLog l
+		INNER JOIN people p ON l.people = p.id
+		LEFT JOIN reader r ON l.reader = r.id`+where(conds...)+`
+		ORDER BY l.people, l.time`, args...)
+}
+
+func (db *DB) AuditLog(ctx context.Context, f store.AuditFilter, n int) ([]store.AuditEntry, error) {
+	conds := make([]string, 0)
+	args := make([]any, 0)
+	for _, c := range []struct{ cond, value string }{
+		{"admin = ?", f.Admin},
+		{"action = ?", f.Action},
+		{"tableName = ?", f.Table},
+		{db.local("time", "date") + " >= ?", f.From},
+		{db.local("time", "date") + " <= ?", f.To},
+	} {
+		if c.value != "" {
+			conds = append(conds, c.cond)
+			args = append(args, c.value)
+		}
+	}
+	if f.Text != "" {
+		conds = append(conds, "(before LIKE ? OR after LIKE ?)")
+		args = append(args, "%"+f.Text+"%", "%"+f.Text+"%")
+	}
+	return list(ctx, db, func(rows *sql.Rows) (store.AuditEntry, error) {
+		var e store.AuditEntry
+		var before, after, ip sql.NullString
+		err := rows.Scan(&e.Id, &e.Time, &e.Admin, &e.Action, &e.Table, &before, &after, &ip)
+		e.Before, e.After, e.IP = before.String, after.String, ip.String
+		return e, err
+	}, "SELECT id, time, admin, action, tableName, before, after, ip FROM adminAudit"+where(conds...)+" ORDER BY id DESC LIMIT ?", append(args, n)...)
+}
+
+func (db *DB) Trash(ctx context.Context) ([]store.TrashEntry, error) {
+	return list(ctx, db, func(rows *sql.Rows) (store.TrashEntry, error) {
+		var e store.TrashEntry
+		err := rows.Scan(&e.Id, &e.Time, &e.Admin, &e.Page, &e.Table, &e.Data)
+		return e, err
+	}, "SELECT id, time, admin, page, tableName, data FROM trash ORDER BY id DESC")
+}
+
+func (db *DB) PurgeTrash(ctx context.Context, t time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, db.q("DELETE FROM trash WHERE time < ?"), db.time(t))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,342 @@
+// Package sqlstore is the store.Store of the database/sql backends, the
+// queries are written for sqlite and rebound by the dialect of the others.
+package sqlstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"server/store"
+)
+
+// Dialect is what differs between the backends
+type Dialect struct {
+	// Rebind rewrites the ? placeholders of a query, nil keeps them
+	Rebind func(query string) string
+	// Unique tells if err is a violated unique or primary key constraint
+	Unique func(err error) bool
+	// Time is the parameter compared to the time columns, nil is the utc
+	// text of the CURRENT_TIMESTAMP of sqlite
+	Time func(t time.Time) any
+	// Local is the expression of a time as local text, layout is date,
+	// datetime or time. nil is the functions of sqlite.
+	Local func(expr, layout string) string
+	// Identity is the statement that moves the id sequence of table past
+	// the ids inserted by hand, nil if the new ids follow the largest one
+	Identity func(table string) string
+}
+
+type DB struct {
+	*sql.DB
+	dialect Dialect
+}
+
+var _ store.Store = (*DB)(nil)
+
+func New(db *sql.DB, dialect Dialect) *DB {
+	return &DB{db, dialect}
+}
+
+// Dollar rebinds ? to $1, $2... for postgres
+func Dollar(query string) string {
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (db *DB) q(query string) string {
+	if db.dialect.Rebind == nil {
+		return query
+	}
+	return db.dialect.Rebind(query)
+}
+
+func (db *DB) time(t time.Time) any {
+	if db.dialect.Time == nil {
+		return t.UTC().Format(time.DateTime)
+	}
+	return db.dialect.Time(t)
+}
+
+func (db *DB) local(expr, layout string) string {
+	if db.dialect.Local == nil {
+		return fmt.Sprintf("%s(%s, 'localtime')", layout, expr)
+	}
+	return db.dialect.Local(expr, layout)
+}
+
+func (db *DB) err(err error) error {
+	if err != nil && db.dialect.Unique != nil && db.dialect.Unique(err) {
+		return fmt.Errorf("%w: %v", store.ErrExists, err)
+	}
+	return store.NotFound(err)
+}
+
+// exec runs a query that has to change a row
+func (db *DB) exec(ctx context.Context, query string, args ...any) error {
+	res, err := db.ExecContext(ctx, db.q(query), args...)
+	if err != nil {
+		return db.err(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func (db *DB) insert(ctx context.Context, query string, args ...any) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, db.q(query+" RETURNING id"), args...).Scan(&id)
+	return id, db.err(err)
+}
+
+// list scans every row of the query with scan
+func list[T any](ctx context.Context, db *DB, scan func(*sql.Rows) (T, error), query string, args ...any) ([]T, error) {
+	rows, err := db.QueryContext(ctx, db.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]T, 0)
+	for rows.Next() {
+		v, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, rows.Err()
+}
+
+// scanner is *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+const readerCols = "id, apiKey, addCard, writeCard, zone, direction, lastSeen, secret"
+
+func scanReader(row scanner) (store.Reader, error) {
+	var r store.Reader
+	var zone, direction, secret sql.NullString
+	var lastSeen sql.NullTime
+	err := row.Scan(&r.Id, &r.ApiKey, &r.AddCard, &r.WriteCard, &zone, &direction, &lastSeen, &secret)
+	r.Zone, r.Direction, r.LastSeen, r.Secret = zone.String, direction.String, lastSeen.Time, secret.String
+	return r, err
+}
+
+func (db *DB) Reader(ctx context.Context, id int64) (store.Reader, error) {
+	r, err := scanReader(db.QueryRowContext(ctx, db.q("SELECT "+readerCols+" FROM reader WHERE id = ?"), id))
+	return r, db.err(err)
+}
+
+func (db *DB) ReaderByKey(ctx context.Context, apiKey string) (store.Reader, error) {
+	r, err := scanReader(db.QueryRowContext(ctx, db.q("SELECT "+readerCols+" FROM reader WHERE apiKey = ?"), apiKey))
+	return r, db.err(err)
+}
+
+func (db *DB) ListReaders(ctx context.Context) ([]store.Reader, error) {
+	return list(ctx, db, func(rows *sql.Rows) (store.Reader, error) { return scanReader(rows) }, "SELECT "+readerCols+" FROM reader ORDER BY id")
+}
+
+func (db *DB) AddReader(ctx context.Context, r store.Reader) (int64, error) {
+	return db.insert(ctx, "INSERT INTO reader (apiKey, addCard, writeCard, zone, direction, secret) VALUES (?, ?, ?, ?, ?, ?)", r.ApiKey, r.AddCard, r.WriteCard, store.Null(r.Zone), store.Null(r.Direction), store.Null(r.Secret))
+}
+
+func (db *DB) SetReaderKey(ctx context.Context, id int64, apiKey string) error {
+	return db.exec(ctx, "UPDATE reader SET apiKey = ? WHERE id = ?", apiKey, id)
+}
+
+func (db *DB) SetReaderSecret(ctx context.Context, id int64, secret string) error {
+	return db.exec(ctx, "UPDATE reader SET secret = ? WHERE id = ?", store.Null(secret), id)
+}
+
+func (db *DB) DeleteReader(ctx context.Context, id int64) error {
+	return db.exec(ctx, "DELETE FROM reader WHERE id = ?", id)
+}
+
+const cardCols = "serialNumber, authtoken, writeKey, readKey, owner, prevAuthtoken, rolled, suspended"
+
+func scanCard(row scanner) (store.Card, error) {
+	var c store.Card
+	var prev sql.NullString
+	var rolled sql.NullTime
+	err := row.Scan(&c.SerialNumber, &c.Authtoken, &c.WriteKey, &c.ReadKey, &c.Owner, &prev, &rolled, &c.Suspended)
+	c.PrevAuthtoken, c.Rolled = prev.String, rolled.Time
+	return c, err
+}
+
+func (db *DB) Card(ctx context.Context, serialNumber string) (store.Card, error) {
+	c, err := scanCard(db.QueryRowContext(ctx, db.q("SELECT "+cardCols+" FROM cards WHERE serialNumber = ?"), serialNumber))
+	return c, db.err(err)
+}
+
+func (db *DB) ListCards(ctx context.Context) ([]store.Card, error) {
+	return list(ctx, db, func(rows *sql.Rows) (store.Card, error) { return scanCard(rows) }, "SELECT "+cardCols+" FROM cards ORDER BY serialNumber")
+}
+
+func (db *DB) AddCard(ctx context.Context, c store.Card) error {
+	_, err := db.ExecContext(ctx, db.q("INSERT INTO cards (serialNumber, authtoken, writeKey, readKey, owner) VALUES (?, ?, ?, ?, ?)"), c.SerialNumber, c.Authtoken, c.WriteKey, c.ReadKey, c.Owner)
+	return db.err(err)
+}
+
+// tokenHash is what the history of a card keeps of an authtoken
+func tokenHash(authtoken string) string {
+	sum := sha256.Sum256([]byte(authtoken))
+	return hex.EncodeToString(sum[:])
+}
+
+func (db *DB) RollAuthtoken(ctx context.Context, serialNumber, current, next string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return &store.TxError{Op: "begin", Err: err}
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, db.q(`UPDATE cards SET prevAuthtoken = authtoken, authtoken = ?, rolled = CURRENT_TIMESTAMP
+		WHERE serialNumber = ? AND authtoken = ?`), next, serialNumber, current)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	_, err = tx.ExecContext(ctx, db.q("INSERT INTO cardTokens (serialNumber, hash) VALUES (?, ?) ON CONFLICT DO NOTHING"), serialNumber, tokenHash(current))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return &store.TxError{Op: "commit", Err: err}
+	}
+	return nil
+}
+
+func (db *DB) UsedAuthtoken(ctx context.Context, serialNumber, authtoken string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, db.q("SELECT COUNT(*) FROM cardTokens WHERE serialNumber = ? AND hash = ?"), serialNumber, tokenHash(authtoken)).Scan(&n)
+	return n > 0, err
+}
+
+func (db *DB) SetSuspended(ctx context.Context, serialNumber string, suspended bool) error {
+	return db.exec(ctx, "UPDATE cards SET suspended = ? WHERE serialNumber = ?", suspended, serialNumber)
+}
+
+func (db *DB) DeleteCard(ctx context.Context, serialNumber string) error {
+	return db.exec(ctx, "DELETE FROM cards WHERE serialNumber = ?", serialNumber)
+}
+
+func scanPerson(row scanner) (store.Person, error) {
+	var p store.Person
+	err := row.Scan(&p.Id, &p.Name, &p.Permission)
+	return p, err
+}
+
+func (db *DB) Person(ctx context.Context, id int64) (store.Person, error) {
+	p, err := scanPerson(db.QueryRowContext(ctx, db.q("SELECT id, name, permission FROM people WHERE id = ?"), id))
+	return p, db.err(err)
+}
+
+func (db *DB) ListPeople(ctx context.Context) ([]store.Person, error) {
+	return list(ctx, db, func(rows *sql.Rows) (store.Person, error) { return scanPerson(rows) }, "SELECT id, name, permission FROM people ORDER BY id")
+}
+
+func (db *DB) AddPerson(ctx context.Context, p store.Person) (int64, error) {
+	return db.insert(ctx, "INSERT INTO people (name, permission) VALUES (?, ?)", p.Name, p.Permission)
+}
+
+func (db *DB) DeletePerson(ctx context.Context, id int64) error {
+	return db.exec(ctx, "DELETE FROM people WHERE id = ?", id)
+}
+
+func (db *DB) AddLog(ctx context.Context, e store.LogEntry) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, &store.TxError{Op: "begin", Err: err}
+	}
+	defer tx.Rollback()
+	var id int64
+	// the time column of old sqlite dbs has no default, so it is set here
+	err = tx.QueryRowContext(ctx, db.q("INSERT INTO accessLog (card, reader, people, allowed, direction, comment, time) VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP) RETURNING id"),
+		e.Card, e.Reader, e.Person, e.Allowed, e.Direction, e.Comment).Scan(&id)
+	if err != nil {
+		return 0, db.err(err)
+	}
+	if e.Reader.Valid {
+		_, err = tx.ExecContext(ctx, db.q("UPDATE reader SET lastSeen = CURRENT_TIMESTAMP WHERE id = ?"), e.Reader)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, &store.TxError{Op: "commit", Err: err}
+	}
+	return id, nil
+}
+
+func (db *DB) RecentLogs(ctx context.Context, n int) ([]store.LogEntry, error) {
+	return list(ctx, db, func(rows *sql.Rows) (store.LogEntry, error) {
+		var e store.LogEntry
+		var t sql.NullTime
+		err := rows.Scan(&e.Id, &t, &e.Card, &e.Reader, &e.Person, &e.Allowed, &e.Direction, &e.Comment)
+		e.Time = t.Time
+		return e, err
+	}, "SELECT id, time, card, reader, people, allowed, direction, comment FROM accessLog ORDER BY id DESC LIMIT ?", n)
+}
+
+const adminCols = "id, username, pwhash, role, disabled"
+
+func scanAdmin(row scanner) (store.Admin, error) {
+	var a store.Admin
+	err := row.Scan(&a.Id, &a.Username, &a.Pwhash, &a.Role, &a.Disabled)
+	return a, err
+}
+
+func (db *DB) Admin(ctx context.Context, username string) (store.Admin, error) {
+	a, err := scanAdmin(db.QueryRowContext(ctx, db.q("SELECT "+adminCols+" FROM admins WHERE username = ?"), username))
+	return a, db.err(err)
+}
+
+func (db *DB) ListAdmins(ctx context.Context) ([]store.Admin, error) {
+	return list(ctx, db, func(rows *sql.Rows) (store.Admin, error) { return scanAdmin(rows) }, "SELECT "+adminCols+" FROM admins ORDER BY username")
+}
+
+func (db *DB) AddAdmin(ctx context.Context, a store.Admin) (int64, error) {
+	return db.insert(ctx, "INSERT INTO admins (username, pwhash, role, disabled) VALUES (?, ?, ?, ?)", a.Username, a.Pwhash, a.Role, a.Disabled)
+}
+
+func (db *DB) SetPassword(ctx context.Context, username, pwhash string) error {
+	return db.exec(ctx, "UPDATE admins SET pwhash = ? WHERE username = ?", pwhash, username)
+}
+
+func (db *DB) SetDisabled(ctx context.Context, username string, disabled bool) error {
+	return db.exec(ctx, "UPDATE admins SET disabled = ? WHERE username = ?", disabled, username)
+}
+
+func (db *DB) DeleteAdmin(ctx context.Context, username string) error {
+	return db.exec(ctx, "DELETE FROM admins WHERE username = ?", username)
+}
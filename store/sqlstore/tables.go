@@ -0,0 +1,320 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/store"
+)
+
+// schema is the columns of the tables the Tables methods reach, the rows
+// are ordered by the first one. The names are also the keys of the rows,
+// postgres would give them in lower case.
+var schema = map[string][]string{
+	"reader":     {"id", "apiKey", "addCard", "writeCard", "zone", "direction", "lastSeen", "secret"},
+	"cards":      {"serialNumber", "authtoken", "writeKey", "readKey", "owner", "prevAuthtoken", "rolled", "suspended"},
+	"people":     {"id", "name", "permission"},
+	"admins":     {"id", "username", "pwhash", "role", "disabled"},
+	"accessLog":  {"id", "time", "card", "reader", "people", "allowed", "direction", "comment"},
+	"webhooks":   {"id", "url", "secret", "events", "enabled"},
+	"webhookLog": {"id", "time", "webhook", "delivery", "event", "attempt", "status", "error"},
+	"adminAudit": {"id", "time", "admin", "action", "tableName", "before", "after", "ip"},
+	"trash":      {"id", "time", "admin", "page", "tableName", "data"},
+}
+
+// the boolean columns, the forms and sqlite give them as numbers
+var boolCols = map[string]bool{
+	"addCard":   true,
+	"writeCard": true,
+	"suspended": true,
+	"disabled":  true,
+	"allowed":   true,
+	"enabled":   true,
+}
+
+// querier is *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// tables runs the Tables methods on the db or in a transaction, in the
+// transaction every statement has a savepoint: a failed statement aborts
+// the whole transaction of postgres
+type tables struct {
+	db *DB
+	q  querier
+	tx bool
+}
+
+func (db *DB) Rows(ctx context.Context, table string, cols []string, where store.Row) ([]store.Row, error) {
+	return (&tables{db: db, q: db.DB}).Rows(ctx, table, cols, where)
+}
+
+func (db *DB) Insert(ctx context.Context, table string, row store.Row) (store.Row, error) {
+	return (&tables{db: db, q: db.DB}).Insert(ctx, table, row)
+}
+
+func (db *DB) Update(ctx context.Context, table string, set, where store.Row) (int64, error) {
+	return (&tables{db: db, q: db.DB}).Update(ctx, table, set, where)
+}
+
+func (db *DB) Delete(ctx context.Context, table string, where store.Row) (int64, error) {
+	return (&tables{db: db, q: db.DB}).Delete(ctx, table, where)
+}
+
+func (db *DB) Change(ctx context.Context, fn func(tx store.Tables) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return &store.TxError{Op: "begin", Err: err}
+	}
+	defer tx.Rollback()
+	err = fn(&tables{db: db, q: tx, tx: true})
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return &store.TxError{Op: "commit", Err: err}
+	}
+	return nil
+}
+
+// statement runs fn in a savepoint if t is a transaction
+func (t *tables) statement(ctx context.Context, fn func() error) error {
+	if !t.tx {
+		return fn()
+	}
+	_, err := t.q.ExecContext(ctx, "SAVEPOINT stmt")
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err != nil {
+		t.q.ExecContext(ctx, "ROLLBACK TO SAVEPOINT stmt")
+	}
+	_, rerr := t.q.ExecContext(ctx, "RELEASE SAVEPOINT stmt")
+	if err != nil {
+		return err
+	}
+	return rerr
+}
+
+// columns checks the names against the schema of table
+func columns(table string, names []string) error {
+	cols, ok := schema[table]
+	if !ok {
+		return fmt.Errorf("unknown table %q", table)
+	}
+	for _, name := range names {
+		if !slices.Contains(cols, name) {
+			return fmt.Errorf("no column %q in %s", name, table)
+		}
+	}
+	return nil
+}
+
+// value is the parameter of v in column col
+func (t *tables) value(col string, v any) any {
+	if tm, ok := v.(time.Time); ok {
+		return t.db.time(tm)
+	}
+	if !boolCols[col] {
+		return v
+	}
+	switch v := v.(type) {
+	case int:
+		return v != 0
+	case int64:
+		return v != 0
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return v
+}
+
+// sorted returns the keys of the row in order, so the queries are the same
+// for the same columns
+func sorted(row store.Row) []string {
+	keys := make([]string, 0, len(row))
+	for k := range row {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// condition is the WHERE of the where row
+func (t *tables) condition(table string, where store.Row) (string, []any, error) {
+	keys := sorted(where)
+	err := columns(table, keys)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(keys) == 0 {
+		return "", nil, nil
+	}
+	conds := make([]string, len(keys))
+	args := make([]any, 0, len(keys))
+	for k, col := range keys {
+		if where[col] == nil {
+			conds[k] = col + " IS NULL"
+			continue
+		}
+		conds[k] = col + " = ?"
+		args = append(args, t.value(col, where[col]))
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+// scanRows reads the rows into maps with the names as keys
+func scanRows(rows *sql.Rows, names []string) ([]store.Row, error) {
+	out := make([]store.Row, 0)
+	for rows.Next() {
+		values := make([]any, len(names))
+		pointers := make([]any, len(names))
+		for k := range values {
+			pointers[k] = &values[k]
+		}
+		err := rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		row := make(store.Row, len(names))
+		for k, name := range names {
+			switch v := values[k].(type) {
+			case []byte:
+				row[name] = string(v)
+			case int64:
+				if boolCols[name] {
+					row[name] = v != 0
+				} else {
+					row[name] = v
+				}
+			default:
+				row[name] = v
+			}
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+func (t *tables) Rows(ctx context.Context, table string, cols []string, where store.Row) ([]store.Row, error) {
+	err := columns(table, cols)
+	if err != nil {
+		return nil, err
+	}
+	if cols == nil {
+		cols = schema[table]
+	}
+	cond, args, err := t.condition(table, where)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT " + strings.Join(cols, ", ") + " FROM " + table + cond + " ORDER BY " + schema[table][0]
+	var out []store.Row
+	err = t.statement(ctx, func() error {
+		rows, err := t.q.QueryContext(ctx, t.db.q(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		out, err = scanRows(rows, cols)
+		return err
+	})
+	return out, err
+}
+
+func (t *tables) Insert(ctx context.Context, table string, row store.Row) (store.Row, error) {
+	keys := sorted(row)
+	err := columns(table, keys)
+	if err != nil {
+		return nil, err
+	}
+	query := "INSERT INTO " + table + " DEFAULT VALUES"
+	args := make([]any, len(keys))
+	if len(keys) != 0 {
+		for k, col := range keys {
+			args[k] = t.value(col, row[col])
+		}
+		query = "INSERT INTO " + table + " (" + strings.Join(keys, ", ") + ") VALUES (?" + strings.Repeat(", ?", len(keys)-1) + ")"
+	}
+	query += " RETURNING " + strings.Join(schema[table], ", ")
+	var out []store.Row
+	err = t.statement(ctx, func() error {
+		rows, err := t.q.QueryContext(ctx, t.db.q(query), args...)
+		if err != nil {
+			return err
+		}
+		out, err = scanRows(rows, schema[table])
+		rows.Close()
+		if err != nil || row["id"] == nil || schema[table][0] != "id" || t.db.dialect.Identity == nil {
+			return err
+		}
+		_, err = t.q.ExecContext(ctx, t.db.dialect.Identity(table))
+		return err
+	})
+	if err != nil {
+		return nil, t.db.err(err)
+	}
+	if len(out) != 1 {
+		return nil, errors.New("insert returned no row")
+	}
+	return out[0], nil
+}
+
+// change runs an update or a delete, it has to have a condition
+func (t *tables) change(ctx context.Context, query, cond string, args []any) (int64, error) {
+	if cond == "" {
+		return 0, errors.New("no condition")
+	}
+	var n int64
+	err := t.statement(ctx, func() error {
+		res, err := t.q.ExecContext(ctx, t.db.q(query+cond), args...)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return n, t.db.err(err)
+}
+
+func (t *tables) Update(ctx context.Context, table string, set, where store.Row) (int64, error) {
+	keys := sorted(set)
+	err := columns(table, keys)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, errors.New("nothing to set")
+	}
+	cond, condArgs, err := t.condition(table, where)
+	if err != nil {
+		return 0, err
+	}
+	sets := make([]string, len(keys))
+	args := make([]any, 0, len(keys)+len(condArgs))
+	for k, col := range keys {
+		sets[k] = col + " = ?"
+		args = append(args, t.value(col, set[col]))
+	}
+	return t.change(ctx, "UPDATE "+table+" SET "+strings.Join(sets, ", "), cond, append(args, condArgs...))
+}
+
+func (t *tables) Delete(ctx context.Context, table string, where store.Row) (int64, error) {
+	cond, args, err := t.condition(table, where)
+	if err != nil {
+		return 0, err
+	}
+	return t.change(ctx, "DELETE FROM "+table, cond, args)
+}
@@ -0,0 +1,91 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+
+	"server/store"
+)
+
+func (db *DB) QueueEvent(ctx context.Context, event string, payload []byte) (int, error) {
+	type webhook struct {
+		id     int64
+		events string
+	}
+	webhooks, err := list(ctx, db, func(rows *sql.Rows) (webhook, error) {
+		var w webhook
+		err := rows.Scan(&w.id, &w.events)
+		return w, err
+	}, "SELECT id, events FROM webhooks WHERE enabled")
+	if err != nil {
+		return 0, err
+	}
+	targets := make([]int64, 0)
+	for _, w := range webhooks {
+		filter := strings.FieldsFunc(w.events, func(r rune) bool { return r == ',' || r == ' ' })
+		if len(filter) == 0 || slices.Contains(filter, event) {
+			targets = append(targets, w.id)
+		}
+	}
+	if len(targets) == 0 {
+		return 0, nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, &store.TxError{Op: "begin", Err: err}
+	}
+	defer tx.Rollback()
+	for _, id := range targets {
+		_, err = tx.ExecContext(ctx, db.q("INSERT INTO webhookQueue (webhook, event, payload, nextTry) VALUES (?, ?, ?, CURRENT_TIMESTAMP)"), id, event, string(payload))
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, &store.TxError{Op: "commit", Err: err}
+	}
+	return len(targets), nil
+}
+
+func (db *DB) DueDeliveries(ctx context.Context, n int) ([]store.Delivery, error) {
+	return list(ctx, db, func(rows *sql.Rows) (store.Delivery, error) {
+		var d store.Delivery
+		var payload string
+		err := rows.Scan(&d.Id, &d.Webhook, &d.URL, &d.Secret, &d.Event, &payload, &d.Attempts)
+		d.Payload = []byte(payload)
+		return d, err
+	}, `SELECT q.id, q.webhook, w.url, w.secret, q.event, q.payload, q.attempts
+		FROM webhookQueue q INNER JOIN webhooks w ON q.webhook = w.id
+		WHERE q.nextTry <= CURRENT_TIMESTAMP AND w.enabled
+		ORDER BY q.id LIMIT ?`, n)
+}
+
+func (db *DB) Attempted(ctx context.Context, d store.Delivery, status int, errText string, next time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return &store.TxError{Op: "begin", Err: err}
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, db.q("INSERT INTO webhookLog (webhook, delivery, event, attempt, status, error) VALUES (?, ?, ?, ?, ?, ?)"),
+		d.Webhook, d.Id, d.Event, d.Attempts, status, store.Null(errText))
+	if err != nil {
+		return err
+	}
+	if next.IsZero() {
+		_, err = tx.ExecContext(ctx, db.q("DELETE FROM webhookQueue WHERE id = ?"), d.Id)
+	} else {
+		_, err = tx.ExecContext(ctx, db.q("UPDATE webhookQueue SET attempts = ?, nextTry = ? WHERE id = ?"), d.Attempts, db.time(next), d.Id)
+	}
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return &store.TxError{Op: "commit", Err: err}
+	}
+	return nil
+}
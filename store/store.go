@@ -0,0 +1,273 @@
+// Package store is the storage of readers, cards, people, the access log and
+// the admins. The sqlite package is the default backend, postgres is the
+// other one, both have to pass storetest.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+)
+
+type (
+	Reader struct {
+		Id        int64
+		ApiKey    string
+		AddCard   bool
+		WriteCard bool
+		Zone      string    // empty if the reader has no zone
+		Direction string    // in, out or empty
+		LastSeen  time.Time // zero if the reader was never seen
+		// Secret is the hmac key of the signed http requests, the requests
+		// of a reader without a secret don't need a signature
+		Secret string
+	}
+	Card struct {
+		SerialNumber string
+		Authtoken    string
+		WriteKey     string
+		ReadKey      string
+		Owner        int64
+		// the rolling authtokens: the token before the last roll and the
+		// time of the last roll. AddCard ignores them.
+		PrevAuthtoken string
+		Rolled        time.Time // zero if the token was never rolled
+		Suspended     bool      // a suspended card is denied
+	}
+	Person struct {
+		Id         int64
+		Name       string
+		Permission string
+	}
+	LogEntry struct {
+		Id        int64
+		Time      time.Time
+		Card      sql.NullString
+		Reader    sql.NullInt64
+		Person    sql.NullInt64
+		Allowed   bool
+		Direction sql.NullString
+		Comment   sql.NullString
+	}
+	Admin struct {
+		Id       int64
+		Username string
+		Pwhash   string
+		Role     string
+		Disabled bool
+	}
+	// Row is a row of the Tables methods, column name -> value
+	Row = map[string]any
+	// LogFilter selects access log entries, the dates are local days
+	// (2006-01-02) and inclusive, the empty fields don't filter
+	LogFilter struct {
+		From   string
+		To     string
+		Person sql.NullInt64
+		Reader sql.NullInt64
+		Zone   string // zone of the reader
+	}
+	// Tap is a granted tap of a person, the direction is the one of the
+	// reader if the log has none
+	Tap struct {
+		Person    int64
+		Name      string
+		Time      time.Time
+		Direction string
+	}
+	AuditEntry struct {
+		Id     int64
+		Time   time.Time
+		Admin  string
+		Action string
+		Table  string
+		Before string // json of the rows, empty if there were none
+		After  string
+		IP     string
+	}
+	// AuditFilter selects audit entries, the dates are local days and
+	// inclusive, Text is looked for in the rows, the empty fields don't filter
+	AuditFilter struct {
+		Admin  string
+		Action string
+		Table  string
+		From   string
+		To     string
+		Text   string
+	}
+	TrashEntry struct {
+		Id    int64
+		Time  time.Time
+		Admin string
+		Page  string // the admin page the row was deleted on
+		Table string
+		Data  string // json of the row
+	}
+	// Delivery is a queued event of a webhook
+	Delivery struct {
+		Id       int64
+		Webhook  int64
+		URL      string
+		Secret   string
+		Event    string
+		Payload  []byte
+		Attempts int
+	}
+)
+
+type Readers interface {
+	Reader(ctx context.Context, id int64) (Reader, error)
+	ReaderByKey(ctx context.Context, apiKey string) (Reader, error)
+	ListReaders(ctx context.Context) ([]Reader, error)
+	// AddReader ignores Id and LastSeen and returns the new id
+	AddReader(ctx context.Context, r Reader) (int64, error)
+	SetReaderKey(ctx context.Context, id int64, apiKey string) error
+	// SetReaderSecret sets the secret of the signed requests, empty clears it
+	SetReaderSecret(ctx context.Context, id int64, secret string) error
+	DeleteReader(ctx context.Context, id int64) error
+}
+
+type Cards interface {
+	Card(ctx context.Context, serialNumber string) (Card, error)
+	ListCards(ctx context.Context) ([]Card, error)
+	AddCard(ctx context.Context, c Card) error
+	DeleteCard(ctx context.Context, serialNumber string) error
+	// RollAuthtoken makes next the authtoken of the card if its authtoken
+	// is still current, current moves to PrevAuthtoken and the history of
+	// the card. ErrNotFound if the card or current doesn't match.
+	RollAuthtoken(ctx context.Context, serialNumber, current, next string) error
+	// UsedAuthtoken tells if authtoken was an authtoken of the card before,
+	// the history only keeps hashes of the tokens
+	UsedAuthtoken(ctx context.Context, serialNumber, authtoken string) (bool, error)
+	SetSuspended(ctx context.Context, serialNumber string, suspended bool) error
+}
+
+type People interface {
+	Person(ctx context.Context, id int64) (Person, error)
+	ListPeople(ctx context.Context) ([]Person, error)
+	// AddPerson ignores Id and returns the new id
+	AddPerson(ctx context.Context, p Person) (int64, error)
+	DeletePerson(ctx context.Context, id int64) error
+}
+
+type Logs interface {
+	// AddLog writes the entry with the current time and marks its reader as
+	// seen, Id and Time are ignored
+	AddLog(ctx context.Context, e LogEntry) (int64, error)
+	// RecentLogs returns the last n entries, newest first
+	RecentLogs(ctx context.Context, n int) ([]LogEntry, error)
+}
+
+type Admins interface {
+	Admin(ctx context.Context, username string) (Admin, error)
+	ListAdmins(ctx context.Context) ([]Admin, error)
+	// AddAdmin ignores Id and returns the new id
+	AddAdmin(ctx context.Context, a Admin) (int64, error)
+	SetPassword(ctx context.Context, username, pwhash string) error
+	SetDisabled(ctx context.Context, username string, disabled bool) error
+	DeleteAdmin(ctx context.Context, username string) error
+}
+
+// Tables are the generic row methods of the table pages, the import, the
+// trash and the cli. The table and column names are the ones of the sqlite
+// schema, unknown ones are an error. A nil value of where matches NULL.
+type Tables interface {
+	// Rows returns cols of the rows matching where, every column if cols is
+	// nil, in the order of the first column of the table
+	Rows(ctx context.Context, table string, cols []string, where Row) ([]Row, error)
+	// Insert returns the new row with every column, the defaults too
+	Insert(ctx context.Context, table string, row Row) (Row, error)
+	// Update and Delete return the number of changed rows, they need a where
+	Update(ctx context.Context, table string, set, where Row) (int64, error)
+	Delete(ctx context.Context, table string, where Row) (int64, error)
+}
+
+type Reports interface {
+	// Report runs a report of the access log: person, reader, denied or
+	// presence, ErrNotFound for other names. The values come in the order
+	// of the columns of the report, the times as local text.
+	Report(ctx context.Context, name string, f LogFilter) ([][]any, error)
+	// Taps returns the granted taps of people, ordered by person and time
+	Taps(ctx context.Context, f LogFilter) ([]Tap, error)
+}
+
+// History is the audit trail and the trash of the admin changes, Tables
+// writes them in the transaction of the change
+type History interface {
+	// AuditLog returns the last n matching entries, newest first
+	AuditLog(ctx context.Context, f AuditFilter, n int) ([]AuditEntry, error)
+	// Trash returns the deleted rows, newest first
+	Trash(ctx context.Context) ([]TrashEntry, error)
+	// PurgeTrash drops the rows deleted before t
+	PurgeTrash(ctx context.Context, t time.Time) (int64, error)
+}
+
+type Webhooks interface {
+	// QueueEvent queues the event for every enabled webhook that takes its
+	// type and returns how many. The events of a webhook are a comma
+	// separated list of types, empty is every type.
+	QueueEvent(ctx context.Context, event string, payload []byte) (int, error)
+	// DueDeliveries returns at most n deliveries whose next try has come,
+	// oldest first
+	DueDeliveries(ctx context.Context, n int) ([]Delivery, error)
+	// Attempted logs an attempt of d, Attempts counts it. With a zero next
+	// d leaves the queue, otherwise it is tried again at next.
+	Attempted(ctx context.Context, d Delivery, status int, errText string, next time.Time) error
+}
+
+// TxError is a failed begin or commit of Change or of the methods that write
+// more than one row: AddLog, RollAuthtoken and the webhook queue
+type TxError struct {
+	Op  string // begin or commit
+	Err error
+}
+
+func (e *TxError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+// Store is a backend. The methods return ErrNotFound for a missing row and
+// ErrExists for a duplicate key, wrapped or as they are.
+type Store interface {
+	Readers
+	Cards
+	People
+	Logs
+	Admins
+	Tables
+	Reports
+	History
+	Webhooks
+	// Change runs fn in a transaction that is committed only if fn returns
+	// nil. A failed statement of tx doesn't spoil the rest, fn may go on.
+	Change(ctx context.Context, fn func(tx Tables) error) error
+	Close() error
+}
+
+// Null turns the empty string into NULL
+func Null(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Int is a non NULL sql.NullInt64
+func Int(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: true}
+}
+
+// NotFound maps sql.ErrNoRows to ErrNotFound
+func NotFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
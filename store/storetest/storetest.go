@@ -0,0 +1,755 @@
+// Package storetest is the conformance suite every store backend has to
+// pass, the tests of the backends run it.
+package storetest
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"server/store"
+)
+
+// unique makes the keys of a run unique, so the suite can run against a db
+// that has data
+type unique string
+
+func (u unique) name(s string) string {
+	return s + "-" + string(u)
+}
+
+// Run runs every check against s, each as a subtest of t
+func Run(t *testing.T, s store.Store) {
+	for _, check := range []struct {
+		name string
+		run  func(t *testing.T, s store.Store, u unique)
+	}{
+		{"readers", readers},
+		{"reader not found", readerNotFound},
+		{"cards", cards},
+		{"duplicate card", duplicateCard},
+		{"rolling authtoken", rollingAuthtoken},
+		{"people", people},
+		{"nobody", nobody},
+		{"person with cards", personWithCards},
+		{"logs", logs},
+		{"log outlives reader", logOutlivesReader},
+		{"admins", admins},
+		{"duplicate admin", duplicateAdmin},
+		{"tables", tables},
+		{"change", change},
+		{"insert with id", insertWithId},
+		{"reports", reports},
+		{"history", history},
+		{"webhooks", webhooks},
+	} {
+		t.Run(check.name, func(t *testing.T) {
+			check.run(t, s, unique(rand.Text()[:8]))
+		})
+	}
+}
+
+func readers(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	in := store.Reader{ApiKey: u.name("key"), AddCard: true, Zone: u.name("zone"), Direction: "in"}
+	id, err := s.AddReader(ctx, in)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	defer s.DeleteReader(ctx, id)
+	got, err := s.ReaderByKey(ctx, in.ApiKey)
+	if err != nil {
+		t.Fatalf("by key: %v", err)
+	}
+	in.Id = id
+	if got != in {
+		t.Errorf("by key: got %+v, want %+v", got, in)
+	}
+	got, err = s.Reader(ctx, id)
+	if err != nil {
+		t.Errorf("by id: %v", err)
+	} else if got != in {
+		t.Errorf("by id: got %+v, want %+v", got, in)
+	}
+	bare, err := s.AddReader(ctx, store.Reader{ApiKey: u.name("bare"), WriteCard: true})
+	if err != nil {
+		t.Errorf("add without zone: %v", err)
+	} else {
+		defer s.DeleteReader(ctx, bare)
+		got, err = s.Reader(ctx, bare)
+		if err != nil {
+			t.Errorf("by id: %v", err)
+		} else if got.Zone != "" || got.Direction != "" || !got.WriteCard || got.AddCard {
+			t.Errorf("without zone: got %+v", got)
+		}
+	}
+	all, err := s.ListReaders(ctx)
+	if err != nil {
+		t.Errorf("list: %v", err)
+	} else {
+		found := 0
+		for _, r := range all {
+			if r.Id == id || r.Id == bare {
+				found++
+			}
+		}
+		if found != 2 {
+			t.Errorf("list: %d of the 2 added readers", found)
+		}
+	}
+	if err := s.SetReaderKey(ctx, id, u.name("rotated")); err != nil {
+		t.Errorf("set key: %v", err)
+	}
+	_, err = s.ReaderByKey(ctx, in.ApiKey)
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("old key after rotation: got %v, want ErrNotFound", err)
+	}
+	got, err = s.ReaderByKey(ctx, u.name("rotated"))
+	if err != nil {
+		t.Errorf("new key: %v", err)
+	} else if got.Id != id {
+		t.Errorf("new key: got reader %d, want %d", got.Id, id)
+	}
+	for _, secret := range []string{u.name("secret"), ""} {
+		if err := s.SetReaderSecret(ctx, id, secret); err != nil {
+			t.Errorf("set secret %q: %v", secret, err)
+		}
+		got, err = s.Reader(ctx, id)
+		if err != nil || got.Secret != secret {
+			t.Errorf("secret: got %q %v, want %q", got.Secret, err, secret)
+		}
+	}
+	if err := s.SetReaderSecret(ctx, -1, "x"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("secret of no reader: got %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteReader(ctx, id); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	_, err = s.Reader(ctx, id)
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("deleted: got %v, want ErrNotFound", err)
+	}
+}
+
+func readerNotFound(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	_, err := s.ReaderByKey(ctx, u.name("missing"))
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("by key: got %v, want ErrNotFound", err)
+	}
+	if err := s.SetReaderKey(ctx, -1, "x"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("set key: got %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteReader(ctx, -1); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("delete: got %v, want ErrNotFound", err)
+	}
+}
+
+func cards(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	owner, err := s.AddPerson(ctx, store.Person{Name: u.name("owner"), Permission: "all"})
+	if err != nil {
+		t.Fatalf("add owner: %v", err)
+	}
+	defer s.DeletePerson(ctx, owner)
+	in := store.Card{SerialNumber: u.name("serial"), Authtoken: "auth", WriteKey: "write", ReadKey: "read", Owner: owner}
+	if err := s.AddCard(ctx, in); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	got, err := s.Card(ctx, in.SerialNumber)
+	if err != nil {
+		t.Errorf("get: %v", err)
+	} else if got != in {
+		t.Errorf("get: got %+v, want %+v", got, in)
+	}
+	all, err := s.ListCards(ctx)
+	if err != nil {
+		t.Errorf("list: %v", err)
+	} else {
+		found := false
+		for _, card := range all {
+			found = found || card == in
+		}
+		if !found {
+			t.Errorf("list: no added card")
+		}
+	}
+	if err := s.DeleteCard(ctx, in.SerialNumber); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	_, err = s.Card(ctx, in.SerialNumber)
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("deleted: got %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteCard(ctx, in.SerialNumber); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("delete again: got %v, want ErrNotFound", err)
+	}
+}
+
+func duplicateCard(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	in := store.Card{SerialNumber: u.name("dup"), Authtoken: "a", WriteKey: "w", ReadKey: "r"}
+	if err := s.AddCard(ctx, in); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	defer s.DeleteCard(ctx, in.SerialNumber)
+	in.Authtoken = "b"
+	err := s.AddCard(ctx, in)
+	if !errors.Is(err, store.ErrExists) {
+		t.Errorf("second add: got %v, want ErrExists", err)
+	}
+	got, err := s.Card(ctx, in.SerialNumber)
+	if err != nil {
+		t.Errorf("get: %v", err)
+	} else if got.Authtoken != "a" {
+		t.Errorf("second add changed the card: %+v", got)
+	}
+}
+
+func rollingAuthtoken(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	in := store.Card{SerialNumber: u.name("rolling"), Authtoken: "t0", WriteKey: "w", ReadKey: "r"}
+	if err := s.AddCard(ctx, in); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	defer s.DeleteCard(ctx, in.SerialNumber)
+	if err := s.RollAuthtoken(ctx, in.SerialNumber, "nope", "t1"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("roll of an old token: got %v, want ErrNotFound", err)
+	}
+	if err := s.RollAuthtoken(ctx, u.name("nocard"), "t0", "t1"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("roll of no card: got %v, want ErrNotFound", err)
+	}
+	before := time.Now().Add(-time.Minute)
+	if err := s.RollAuthtoken(ctx, in.SerialNumber, "t0", "t1"); err != nil {
+		t.Errorf("roll: %v", err)
+	}
+	if err := s.RollAuthtoken(ctx, in.SerialNumber, "t1", "t2"); err != nil {
+		t.Errorf("roll again: %v", err)
+	}
+	got, err := s.Card(ctx, in.SerialNumber)
+	if err != nil {
+		t.Errorf("get: %v", err)
+	} else {
+		if got.Authtoken != "t2" || got.PrevAuthtoken != "t1" || got.Suspended {
+			t.Errorf("rolled: got %+v", got)
+		}
+		if got.Rolled.Before(before) || got.Rolled.After(time.Now().Add(time.Minute)) {
+			t.Errorf("rolled at %v", got.Rolled)
+		}
+	}
+	for _, tc := range []struct {
+		serialNumber, authtoken string
+		used                    bool
+	}{
+		{in.SerialNumber, "t0", true},
+		{in.SerialNumber, "t1", true},
+		{in.SerialNumber, "t2", false},
+		{in.SerialNumber, "nope", false},
+		{u.name("nocard"), "t0", false},
+	} {
+		used, err := s.UsedAuthtoken(ctx, tc.serialNumber, tc.authtoken)
+		if err != nil || used != tc.used {
+			t.Errorf("used %s of %s: got %v %v, want %v", tc.authtoken, tc.serialNumber, used, err, tc.used)
+		}
+	}
+	if err := s.SetSuspended(ctx, in.SerialNumber, true); err != nil {
+		t.Errorf("suspend: %v", err)
+	}
+	got, err = s.Card(ctx, in.SerialNumber)
+	if err != nil {
+		t.Errorf("get suspended: %v", err)
+	} else if !got.Suspended || got.Authtoken != "t2" {
+		t.Errorf("suspended: got %+v", got)
+	}
+	if err := s.SetSuspended(ctx, in.SerialNumber, false); err != nil {
+		t.Errorf("lift: %v", err)
+	}
+	got, err = s.Card(ctx, in.SerialNumber)
+	if err != nil {
+		t.Errorf("get lifted: %v", err)
+	} else if got.Suspended {
+		t.Errorf("lifted: still suspended")
+	}
+	if err := s.SetSuspended(ctx, u.name("nocard"), true); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("suspend no card: got %v, want ErrNotFound", err)
+	}
+	// the history goes with the card, a new card of the serial starts clean
+	if err := s.DeleteCard(ctx, in.SerialNumber); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := s.AddCard(ctx, in); err != nil {
+		t.Fatalf("add again: %v", err)
+	}
+	if used, err := s.UsedAuthtoken(ctx, in.SerialNumber, "t1"); err != nil || used {
+		t.Errorf("used t1 of the new card: got %v %v, want false", used, err)
+	}
+}
+
+func people(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	in := store.Person{Name: u.name("Kovács Éva"), Permission: "door"}
+	id, err := s.AddPerson(ctx, in)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	in.Id = id
+	got, err := s.Person(ctx, id)
+	if err != nil {
+		t.Errorf("get: %v", err)
+	} else if got != in {
+		t.Errorf("get: got %+v, want %+v", got, in)
+	}
+	all, err := s.ListPeople(ctx)
+	if err != nil {
+		t.Errorf("list: %v", err)
+	} else {
+		found := false
+		for _, p := range all {
+			found = found || p == in
+		}
+		if !found {
+			t.Errorf("list: no added person")
+		}
+	}
+	if err := s.DeletePerson(ctx, id); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	_, err = s.Person(ctx, id)
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("deleted: got %v, want ErrNotFound", err)
+	}
+}
+
+// the cards added by the readers belong to person 0
+func nobody(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	p, err := s.Person(ctx, 0)
+	if err != nil {
+		t.Errorf("person 0: %v", err)
+	} else if p.Name != "nobody" {
+		t.Errorf("person 0: got %+v", p)
+	}
+}
+
+// the cards of a person have to be revoked before the person goes
+func personWithCards(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	owner, err := s.AddPerson(ctx, store.Person{Name: u.name("owner"), Permission: "all"})
+	if err != nil {
+		t.Fatalf("add owner: %v", err)
+	}
+	defer s.DeletePerson(ctx, owner)
+	card := store.Card{SerialNumber: u.name("owned"), Authtoken: "a", WriteKey: "w", ReadKey: "r", Owner: owner}
+	if err := s.AddCard(ctx, card); err != nil {
+		t.Fatalf("add card: %v", err)
+	}
+	defer s.DeleteCard(ctx, card.SerialNumber)
+	if err := s.DeletePerson(ctx, owner); err == nil {
+		t.Errorf("delete with cards: no error")
+	}
+	_, err = s.Card(ctx, card.SerialNumber)
+	if err != nil {
+		t.Errorf("card after delete: %v", err)
+	}
+	card.SerialNumber, card.Owner = u.name("orphan"), -1
+	if err := s.AddCard(ctx, card); err == nil {
+		s.DeleteCard(ctx, card.SerialNumber)
+		t.Errorf("card of missing person: no error")
+	}
+}
+
+func logOutlivesReader(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	reader, err := s.AddReader(ctx, store.Reader{ApiKey: u.name("gone")})
+	if err != nil {
+		t.Fatalf("add reader: %v", err)
+	}
+	id, err := s.AddLog(ctx, store.LogEntry{Card: store.Null(u.name("card")), Reader: store.Int(reader)})
+	if err != nil {
+		t.Fatalf("add log: %v", err)
+	}
+	if err := s.DeleteReader(ctx, reader); err != nil {
+		t.Fatalf("delete reader: %v", err)
+	}
+	got, err := s.RecentLogs(ctx, 10)
+	if err != nil {
+		t.Fatalf("recent: %v", err)
+	}
+	for _, e := range got {
+		if e.Id == id {
+			if e.Reader.Valid || e.Card.String != u.name("card") {
+				t.Errorf("entry after reader delete: %+v", e)
+			}
+			return
+		}
+	}
+	t.Errorf("entry %d is gone with its reader", id)
+}
+
+func logs(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	reader, err := s.AddReader(ctx, store.Reader{ApiKey: u.name("logkey")})
+	if err != nil {
+		t.Fatalf("add reader: %v", err)
+	}
+	defer s.DeleteReader(ctx, reader)
+	before := time.Now().Add(-time.Minute)
+	in := store.LogEntry{
+		Card:      store.Null(u.name("logcard")),
+		Reader:    store.Int(reader),
+		Person:    store.Int(0),
+		Allowed:   true,
+		Direction: store.Null("in"),
+		Comment:   store.Null("granted"),
+	}
+	first, err := s.AddLog(ctx, in)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	second, err := s.AddLog(ctx, store.LogEntry{Comment: store.Null("alarm")})
+	if err != nil {
+		t.Fatalf("add without reader: %v", err)
+	}
+	if second <= first {
+		t.Errorf("ids: %d after %d", second, first)
+	}
+	got, err := s.RecentLogs(ctx, 2)
+	if err != nil {
+		t.Fatalf("recent: %v", err)
+	}
+	if len(got) != 2 || got[0].Id != second || got[1].Id != first {
+		t.Errorf("recent: got %+v, want %d then %d", got, second, first)
+		return
+	}
+	e := got[1]
+	if e.Card != in.Card || e.Reader != in.Reader || e.Person != in.Person || e.Allowed != in.Allowed || e.Direction != in.Direction || e.Comment != in.Comment {
+		t.Errorf("entry: got %+v, want %+v", e, in)
+	}
+	if e.Time.Before(before) || e.Time.After(time.Now().Add(time.Minute)) {
+		t.Errorf("entry time: %v", e.Time)
+	}
+	if got[0].Card.Valid || got[0].Reader.Valid || got[0].Person.Valid || got[0].Allowed {
+		t.Errorf("entry without reader: got %+v", got[0])
+	}
+	r, err := s.Reader(ctx, reader)
+	if err != nil {
+		t.Errorf("reader: %v", err)
+	} else if r.LastSeen.Before(before) || r.LastSeen.After(time.Now().Add(time.Minute)) {
+		t.Errorf("reader last seen: %v", r.LastSeen)
+	}
+}
+
+func admins(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	in := store.Admin{Username: u.name("admin"), Pwhash: "hash", Role: "installer"}
+	id, err := s.AddAdmin(ctx, in)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	defer s.DeleteAdmin(ctx, in.Username)
+	in.Id = id
+	got, err := s.Admin(ctx, in.Username)
+	if err != nil {
+		t.Errorf("get: %v", err)
+	} else if got != in {
+		t.Errorf("get: got %+v, want %+v", got, in)
+	}
+	if err := s.SetPassword(ctx, in.Username, "other"); err != nil {
+		t.Errorf("set password: %v", err)
+	}
+	if err := s.SetDisabled(ctx, in.Username, true); err != nil {
+		t.Errorf("disable: %v", err)
+	}
+	got, err = s.Admin(ctx, in.Username)
+	if err != nil {
+		t.Errorf("get: %v", err)
+	} else if got.Pwhash != "other" || !got.Disabled {
+		t.Errorf("after changes: got %+v", got)
+	}
+	all, err := s.ListAdmins(ctx)
+	if err != nil {
+		t.Errorf("list: %v", err)
+	} else {
+		found := false
+		for _, a := range all {
+			found = found || a.Id == id
+		}
+		if !found {
+			t.Errorf("list: no added admin")
+		}
+	}
+	if err := s.SetPassword(ctx, u.name("missing"), "x"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("set password of missing admin: got %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteAdmin(ctx, in.Username); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	_, err = s.Admin(ctx, in.Username)
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("deleted: got %v, want ErrNotFound", err)
+	}
+}
+
+func duplicateAdmin(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	in := store.Admin{Username: u.name("dupadmin"), Pwhash: "hash", Role: "viewer"}
+	_, err := s.AddAdmin(ctx, in)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	defer s.DeleteAdmin(ctx, in.Username)
+	_, err = s.AddAdmin(ctx, in)
+	if !errors.Is(err, store.ErrExists) {
+		t.Errorf("second add: got %v, want ErrExists", err)
+	}
+}
+
+func tables(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	added, err := s.Insert(ctx, "reader", store.Row{"apiKey": u.name("rowkey"), "addCard": 1, "writeCard": 0, "zone": u.name("rowzone")})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	id := added["id"]
+	defer s.Delete(ctx, "reader", store.Row{"id": id})
+	if added["apiKey"] != u.name("rowkey") || added["addCard"] != true || added["writeCard"] != false || added["direction"] != nil {
+		t.Errorf("insert: got %v", added)
+	}
+	n, err := s.Update(ctx, "reader", store.Row{"writeCard": "true", "direction": "out"}, store.Row{"id": id})
+	if err != nil || n != 1 {
+		t.Errorf("update: %d rows, %v", n, err)
+	}
+	got, err := s.Rows(ctx, "reader", []string{"writeCard", "direction"}, store.Row{"zone": u.name("rowzone"), "secret": nil})
+	if err != nil {
+		t.Errorf("rows: %v", err)
+	} else if len(got) != 1 || len(got[0]) != 2 || got[0]["writeCard"] != true || got[0]["direction"] != "out" {
+		t.Errorf("rows: got %v", got)
+	}
+	if _, err := s.Update(ctx, "reader", store.Row{"zone": nil}, nil); err == nil {
+		t.Errorf("update without where: no error")
+	}
+	if _, err := s.Rows(ctx, "reader", []string{"nope"}, nil); err == nil {
+		t.Errorf("unknown column: no error")
+	}
+	n, err = s.Delete(ctx, "reader", store.Row{"id": id})
+	if err != nil || n != 1 {
+		t.Errorf("delete: %d rows, %v", n, err)
+	}
+}
+
+func change(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	admin := store.Row{"username": u.name("txadmin"), "pwhash": "hash", "role": "viewer", "disabled": 0}
+	err := s.Change(ctx, func(tx store.Tables) error {
+		_, err := tx.Insert(ctx, "admins", admin)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Insert(ctx, "admins", admin)
+		if !errors.Is(err, store.ErrExists) {
+			t.Errorf("duplicate in tx: got %v, want ErrExists", err)
+		}
+		// the failed insert doesn't spoil the transaction
+		_, err = tx.Insert(ctx, "people", store.Row{"name": u.name("txperson"), "permission": ""})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("change: %v", err)
+	}
+	defer s.Delete(ctx, "admins", store.Row{"username": u.name("txadmin")})
+	defer s.Delete(ctx, "people", store.Row{"name": u.name("txperson")})
+	got, err := s.Rows(ctx, "people", nil, store.Row{"name": u.name("txperson")})
+	if err != nil || len(got) != 1 {
+		t.Errorf("committed person: got %v, %v", got, err)
+	}
+	failed := errors.New("failed")
+	err = s.Change(ctx, func(tx store.Tables) error {
+		_, err := tx.Insert(ctx, "reader", store.Row{"apiKey": u.name("rolledback"), "addCard": false, "writeCard": false})
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("change: got %v, want the error of fn", err)
+	}
+	got, err = s.Rows(ctx, "reader", nil, store.Row{"apiKey": u.name("rolledback")})
+	if err != nil || len(got) != 0 {
+		t.Errorf("rolled back reader: got %v, %v", got, err)
+	}
+}
+
+func reports(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	reader, err := s.AddReader(ctx, store.Reader{ApiKey: u.name("reportkey"), Zone: u.name("reportzone"), Direction: "in"})
+	if err != nil {
+		t.Fatalf("add reader: %v", err)
+	}
+	defer s.DeleteReader(ctx, reader)
+	person, err := s.AddPerson(ctx, store.Person{Name: u.name("reported")})
+	if err != nil {
+		t.Fatalf("add person: %v", err)
+	}
+	defer s.DeletePerson(ctx, person)
+	for _, allowed := range []bool{true, false} {
+		_, err = s.AddLog(ctx, store.LogEntry{Card: store.Null(u.name("reportcard")), Reader: store.Int(reader), Person: store.Int(person), Allowed: allowed})
+		if err != nil {
+			t.Fatalf("add log: %v", err)
+		}
+	}
+	f := store.LogFilter{Person: store.Int(person), Zone: u.name("reportzone")}
+	for name, want := range map[string]int{"person": 2, "reader": 1, "denied": 1, "presence": 1} {
+		got, err := s.Report(ctx, name, f)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if len(got) != want {
+			t.Errorf("%s: got %v, want %d rows", name, got, want)
+		}
+	}
+	got, err := s.Report(ctx, "reader", f)
+	if err == nil && len(got) == 1 && len(got[0]) == 5 {
+		if got[0][2] != int64(1) || got[0][3] != int64(1) {
+			t.Errorf("reader: got %v, want 1 allowed and 1 denied", got[0])
+		}
+	}
+	if _, err := s.Report(ctx, "nope", f); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("unknown report: got %v, want ErrNotFound", err)
+	}
+	taps, err := s.Taps(ctx, f)
+	if err != nil {
+		t.Errorf("taps: %v", err)
+	} else if len(taps) != 1 || taps[0].Person != person || taps[0].Name != u.name("reported") || taps[0].Direction != "in" {
+		t.Errorf("taps: got %+v", taps)
+	}
+}
+
+func history(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	admin := u.name("historian")
+	for _, action := range []string{"add", "delete"} {
+		_, err := s.Insert(ctx, "adminAudit", store.Row{"admin": admin, "action": action, "tableName": "people", "after": u.name("needle")})
+		if err != nil {
+			t.Fatalf("insert audit: %v", err)
+		}
+	}
+	defer s.Delete(ctx, "adminAudit", store.Row{"admin": admin})
+	got, err := s.AuditLog(ctx, store.AuditFilter{Admin: admin, Text: u.name("needle")}, 10)
+	if err != nil {
+		t.Errorf("audit log: %v", err)
+	} else if len(got) != 2 || got[0].Action != "delete" || got[1].Action != "add" || got[0].IP != "" {
+		t.Errorf("audit log: got %+v", got)
+	}
+	got, err = s.AuditLog(ctx, store.AuditFilter{Admin: admin, Action: "add"}, 10)
+	if err != nil || len(got) != 1 {
+		t.Errorf("audit log of adds: got %+v, %v", got, err)
+	}
+	old := time.Now().AddDate(-20, 0, 0)
+	for _, when := range []any{old, nil} {
+		row := store.Row{"admin": admin, "page": "people", "tableName": "people", "data": "[]"}
+		if when != nil {
+			row["time"] = when
+		}
+		_, err := s.Insert(ctx, "trash", row)
+		if err != nil {
+			t.Fatalf("insert trash: %v", err)
+		}
+	}
+	defer s.Delete(ctx, "trash", store.Row{"admin": admin})
+	n, err := s.PurgeTrash(ctx, old.AddDate(0, 0, 1))
+	if err != nil || n < 1 {
+		t.Errorf("purge: %d rows, %v", n, err)
+	}
+	trash, err := s.Trash(ctx)
+	if err != nil {
+		t.Fatalf("trash: %v", err)
+	}
+	left := 0
+	for _, e := range trash {
+		if e.Admin == admin {
+			left++
+			if e.Time.Before(time.Now().Add(-time.Hour)) {
+				t.Errorf("purge left the old entry: %+v", e)
+			}
+		}
+	}
+	if left != 1 {
+		t.Errorf("trash after purge: %d entries, want 1", left)
+	}
+}
+
+func webhooks(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	event := u.name("event")
+	hook, err := s.Insert(ctx, "webhooks", store.Row{"url": "https://example.com/hook", "secret": "s", "events": "other, " + event, "enabled": true})
+	if err != nil {
+		t.Fatalf("insert webhook: %v", err)
+	}
+	id := hook["id"].(int64)
+	defer s.Delete(ctx, "webhookLog", store.Row{"webhook": id})
+	defer s.Delete(ctx, "webhooks", store.Row{"id": id})
+	n, err := s.QueueEvent(ctx, event, []byte(`{"a":1}`))
+	if err != nil || n < 1 {
+		t.Fatalf("queue: %d webhooks, %v", n, err)
+	}
+	// mine finds the delivery of the webhook, the db may have others
+	mine := func() []store.Delivery {
+		due, err := s.DueDeliveries(ctx, 1000)
+		if err != nil {
+			t.Fatalf("due: %v", err)
+		}
+		out := make([]store.Delivery, 0)
+		for _, d := range due {
+			if d.Webhook == id {
+				out = append(out, d)
+			}
+		}
+		return out
+	}
+	due := mine()
+	if len(due) != 1 || due[0].Event != event || string(due[0].Payload) != `{"a":1}` || due[0].Secret != "s" || due[0].Attempts != 0 {
+		t.Fatalf("due: got %+v", due)
+	}
+	d := due[0]
+	d.Attempts++
+	if err := s.Attempted(ctx, d, 500, "server error", time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("attempted: %v", err)
+	}
+	if due := mine(); len(due) != 0 {
+		t.Errorf("due before the next try: %+v", due)
+	}
+	d.Attempts++
+	if err := s.Attempted(ctx, d, 200, "", time.Time{}); err != nil {
+		t.Errorf("attempted: %v", err)
+	}
+	logged, err := s.Rows(ctx, "webhookLog", []string{"attempt", "status", "error"}, store.Row{"webhook": id})
+	if err != nil {
+		t.Errorf("log: %v", err)
+	} else if len(logged) != 2 || logged[0]["status"] != int64(500) || logged[0]["error"] != "server error" || logged[1]["attempt"] != int64(2) || logged[1]["error"] != nil {
+		t.Errorf("log: got %v", logged)
+	}
+}
+
+func insertWithId(t *testing.T, s store.Store, u unique) {
+	ctx := t.Context()
+	first, err := s.Insert(ctx, "people", store.Row{"name": u.name("first"), "permission": ""})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	defer s.Delete(ctx, "people", store.Row{"id": first["id"]})
+	// as the import and the restore from the trash do
+	id := first["id"].(int64) + 1000
+	_, err = s.Insert(ctx, "people", store.Row{"id": id, "name": u.name("given"), "permission": ""})
+	if err != nil {
+		t.Fatalf("insert with id: %v", err)
+	}
+	defer s.Delete(ctx, "people", store.Row{"id": id})
+	next, err := s.Insert(ctx, "people", store.Row{"name": u.name("next"), "permission": ""})
+	if err != nil {
+		t.Fatalf("insert after the given id: %v", err)
+	}
+	defer s.Delete(ctx, "people", store.Row{"id": next["id"]})
+	if next["id"].(int64) <= id {
+		t.Errorf("id %v after the given %d", next["id"], id)
+	}
+}
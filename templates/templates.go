@@ -0,0 +1,25 @@
+// Package templates holds the templates of the admin ui, they are built
+// into the binary.
+package templates
+
+import (
+	"embed"
+	htmltemplate "html/template"
+	"text/template"
+)
+
+//go:embed htmltemplates/*.html txttemplates/*.tmpl
+var files embed.FS
+
+// Parse parses the html pages and the text templates of the sql helpers
+func Parse() (*htmltemplate.Template, *template.Template, error) {
+	html, err := htmltemplate.ParseFS(files, "htmltemplates/*.html")
+	if err != nil {
+		return nil, nil, err
+	}
+	txt, err := template.ParseFS(files, "txttemplates/*.tmpl")
+	if err != nil {
+		return nil, nil, err
+	}
+	return html, txt, nil
+}
@@ -1,34 +1,43 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
+
+	"server/client"
 )
 
 var (
-	key    = flag.String("k", "asd", "api key")
-	serial = flag.String("s", "asd", "serial number")
+	url     = flag.String("url", "http://localhost:8090", "address of the server")
+	ca      = flag.String("ca", "", "ca certificate of an https server")
+	retries = flag.Int("retries", 0, "retries of a request that got no answer")
+	key     = flag.String("k", "asd", "api key")
+	serial  = flag.String("s", "asd", "serial number")
 )
 
-type addCardRequest struct {
-	ApiKey       string `json:"apikey"`
-	SerialNumber string `json:"serialnumber"`
-}
-
 func main() {
 	flag.Parse()
-	ans := addCardRequest{
+	request := client.AddCardRequest{
 		ApiKey:       *key,
 		SerialNumber: *serial,
 	}
-	js, _ := json.Marshal(ans)
+	js, _ := json.Marshal(request)
+	fmt.Println(string(js))
+	c := client.New(*url)
+	c.Retries = *retries
+	if *ca != "" {
+		config, err := client.TLSConfig(*ca, "", "")
+		if err != nil {
+			panic(err)
+		}
+		c.SetTLS(config)
+	}
+	ans, err := c.AddCard(context.Background(), request)
+	if err != nil {
+		panic(err)
+	}
+	js, _ = json.Marshal(ans)
 	fmt.Println(string(js))
-	r, _ := http.DefaultClient.Post("http://localhost:8090/api/request/addCard", "application/json", bytes.NewReader(js))
-	body, _ := io.ReadAll(r.Body)
-	fmt.Println(len(body))
-	fmt.Println(string(body))
 }
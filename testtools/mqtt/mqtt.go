@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	broker = flag.String("b", "tcp://localhost:1883", "mqtt broker")
+	prefix = flag.String("prefix", "cardreader", "topic prefix of the server")
+	reader = flag.String("id", "1", "id of the reader of the api key, the server answers on its topic")
+	kind   = flag.String("t", "verify", "request: verify, key or addCard, events only listens to the events")
+	apiKey = flag.String("k", "asd", "api key")
+	serial = flag.String("s", "asd", "serial number")
+	auth   = flag.String("a", "asd", "authtoken for verify")
+	write  = flag.Bool("w", false, "request write key")
+)
+
+func main() {
+	flag.Parse()
+	opts := mqtt.NewClientOptions().AddBroker(*broker).SetClientID("testtool-" + *reader + "-" + *kind)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+	defer client.Disconnect(250)
+	if *kind == "events" {
+		client.Subscribe(*prefix+"/events/#", 0, func(c mqtt.Client, m mqtt.Message) {
+			fmt.Println(m.Topic(), string(m.Payload()))
+		})
+		select {}
+	}
+	got := make(chan []byte)
+	token := client.Subscribe(*prefix+"/reply/"+*reader+"/"+*kind, 1, func(c mqtt.Client, m mqtt.Message) {
+		got <- m.Payload()
+	})
+	if token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+	request := map[string]any{"apikey": *apiKey, "serialnumber": *serial}
+	switch *kind {
+	case "verify":
+		request["authtoken"] = *auth
+	case "key":
+		request["write"] = *write
+	}
+	js, err := json.Marshal(request)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(js))
+	client.Publish(*prefix+"/request/"+*reader+"/"+*kind, 1, false, js).Wait()
+	select {
+	case body := <-got:
+		fmt.Println(string(body))
+	case <-time.After(10 * time.Second):
+		fmt.Println("no answer")
+	}
+}
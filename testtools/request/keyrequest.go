@@ -1,43 +1,48 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
+
+	"server/client"
 )
 
 var (
+	url      = flag.String("url", "http://localhost:8090", "address of the server")
+	ca       = flag.String("ca", "", "ca certificate of an https server")
+	retries  = flag.Int("retries", 0, "retries of a request that got no answer")
 	apiKey   = flag.String("k", "asd", "api key")
 	writekey = flag.Bool("w", false, "request write key")
 	serial   = flag.String("s", "asd", "serial number")
 )
 
-type keyRequest struct {
-	ApiKey       string `json:"apikey"`
-	SerialNumber string `json:"serialnumber"`
-	Write        bool   `json:"write"`
-}
-
 func main() {
 	flag.Parse()
-	ans := keyRequest{
+	request := client.KeyRequest{
 		ApiKey:       *apiKey,
 		SerialNumber: *serial,
 		Write:        *writekey,
 	}
-	js, err := json.Marshal(ans)
+	js, err := json.Marshal(request)
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println(string(js))
-	r, err := http.DefaultClient.Post("http://localhost:8090/api/request/key", "application/json", bytes.NewReader(js))
+	c := client.New(*url)
+	c.Retries = *retries
+	if *ca != "" {
+		config, err := client.TLSConfig(*ca, "", "")
+		if err != nil {
+			panic(err)
+		}
+		c.SetTLS(config)
+	}
+	ans, err := c.GetKey(context.Background(), request)
 	if err != nil {
 		panic(err)
 	}
-	body, _ := io.ReadAll(r.Body)
-	fmt.Println(len(body))
-	fmt.Println(string(body))
+	js, _ = json.Marshal(ans)
+	fmt.Println(string(js))
 }
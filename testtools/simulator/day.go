@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"server/store"
+)
+
+// the simulated day
+const (
+	dayStart = 6 * time.Hour
+	dayEnd   = 20 * time.Hour
+)
+
+// fixture is what the simulation makes in the db, every card has its own
+// person
+type fixture struct {
+	in, out []store.Reader
+	cards   []store.Card
+	people  []int64
+}
+
+// serial is a random 7 byte card uid, 04:xx:..., as the readers send them
+func serial() string {
+	uid := make([]byte, 7)
+	rand.Read(uid)
+	uid[0] = 0x04
+	parts := make([]string, len(uid))
+	for i, b := range uid {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func newFixture(ctx context.Context, s store.Store, readers, cards int) (*fixture, error) {
+	if readers < 2 || cards < 1 {
+		return nil, errors.New("at least 2 readers (in and out) and 1 card")
+	}
+	run := rand.Text()[:6]
+	f := &fixture{}
+	for i := range readers {
+		r := store.Reader{ApiKey: rand.Text(), Zone: "sim-" + run, Direction: "in"}
+		if i%2 == 1 {
+			r.Direction = "out"
+		}
+		id, err := s.AddReader(ctx, r)
+		if err != nil {
+			return f, err
+		}
+		r.Id = id
+		if r.Direction == "in" {
+			f.in = append(f.in, r)
+		} else {
+			f.out = append(f.out, r)
+		}
+	}
+	for i := range cards {
+		id, err := s.AddPerson(ctx, store.Person{Name: fmt.Sprintf("sim-%s-%d", run, i), Permission: "sim"})
+		if err != nil {
+			return f, err
+		}
+		f.people = append(f.people, id)
+		c := store.Card{SerialNumber: serial(), Authtoken: rand.Text(), WriteKey: rand.Text()[:8], ReadKey: rand.Text()[:8], Owner: id}
+		err = s.AddCard(ctx, c)
+		if err != nil {
+			return f, err
+		}
+		f.cards = append(f.cards, c)
+	}
+	return f, nil
+}
+
+// remove deletes the fixture, the access logs stay
+func (f *fixture) remove(ctx context.Context, s store.Store) {
+	var errs []error
+	for _, c := range f.cards {
+		errs = append(errs, s.DeleteCard(ctx, c.SerialNumber))
+	}
+	for _, id := range f.people {
+		errs = append(errs, s.DeletePerson(ctx, id))
+	}
+	for _, r := range append(f.in, f.out...) {
+		errs = append(errs, s.DeleteReader(ctx, r.Id))
+	}
+	if err := errors.Join(errs...); err != nil {
+		fmt.Println("removing the simulated data:", err)
+	}
+}
+
+// clock is a normally distributed time of the day
+func clock(rnd *mrand.Rand, mean, stddev time.Duration) time.Duration {
+	t := mean + time.Duration(rnd.NormFloat64()*float64(stddev))
+	return min(max(t, dayStart), dayEnd)
+}
+
+// day is the taps of a working day played in length: in in the morning,
+// half of the people go out for lunch, out in the afternoon
+func (f *fixture) day(rnd *mrand.Rand, length time.Duration) []tap {
+	taps := make([]tap, 0, 3*len(f.cards))
+	add := func(at time.Duration, readers []store.Reader, c store.Card) {
+		t := tap{
+			at:      time.Duration(float64(length) * float64(at-dayStart) / float64(dayEnd-dayStart)),
+			apiKey:  readers[rnd.IntN(len(readers))].ApiKey,
+			serial:  c.SerialNumber,
+			token:   c.Authtoken,
+			granted: true,
+			known:   true,
+		}
+		switch p := rnd.Float64(); {
+		case p < *unknown:
+			t.serial = serial()
+			t.granted, t.known = false, false
+		case p < *unknown+*deny:
+			t.token = rand.Text()
+			t.granted = false
+		}
+		taps = append(taps, t)
+	}
+	for _, c := range f.cards {
+		in := clock(rnd, 8*time.Hour, 40*time.Minute)
+		add(in, f.in, c)
+		if rnd.IntN(2) == 0 {
+			lunch := max(clock(rnd, 12*time.Hour, 30*time.Minute), in)
+			add(lunch, f.out, c)
+			add(min(lunch+30*time.Minute+time.Duration(rnd.Int64N(int64(30*time.Minute))), dayEnd), f.in, c)
+		}
+		add(max(clock(rnd, 16*time.Hour+30*time.Minute, time.Hour), in), f.out, c)
+	}
+	slices.SortFunc(taps, func(a, b tap) int { return int(a.at - b.at) })
+	return taps
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// replayTaps turns the accessLog of the db into taps, speed times faster.
+// A tap is a verify entry (no comment) or an unknown card the key request
+// stopped, the other key entries belong to the taps. The granted entries get
+// the authtoken of the card, the denied ones a wrong one and the entries
+// without a reader a wrong api key.
+func replayTaps(path string, speed float64) ([]tap, error) {
+	if speed <= 0 {
+		return nil, errors.New("-speed must be positive")
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT l.time, l.card, l.allowed, r.apiKey, c.authtoken FROM accessLog l
+		LEFT JOIN reader r ON r.id = l.reader
+		LEFT JOIN cards c ON c.serialNumber = l.card
+		WHERE l.card IS NOT NULL AND l.time IS NOT NULL AND (l.comment IS NULL OR l.comment = 'scan failed')
+		ORDER BY l.time, l.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var taps []tap
+	var first time.Time
+	for rows.Next() {
+		var at time.Time
+		var serial string
+		var allowed bool
+		var apiKey, token sql.NullString
+		err = rows.Scan(&at, &serial, &allowed, &apiKey, &token)
+		if err != nil {
+			return nil, err
+		}
+		if first.IsZero() {
+			first = at
+		}
+		t := tap{
+			at:      time.Duration(float64(at.Sub(first)) / speed),
+			apiKey:  apiKey.String,
+			serial:  serial,
+			token:   token.String,
+			granted: allowed && apiKey.Valid && token.Valid,
+			known:   apiKey.Valid && token.Valid,
+		}
+		if !apiKey.Valid {
+			t.apiKey = "replay-unknown-reader"
+		}
+		if !allowed {
+			t.token = "replay-wrong-token"
+		}
+		taps = append(taps, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(taps) == 0 {
+		return nil, errors.New("no access log with cards to replay")
+	}
+	return taps, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// results of one endpoint
+type endpoint struct {
+	latencies []time.Duration
+	ok        int
+	denied    int
+	errors    int
+}
+
+type results struct {
+	lock       sync.Mutex
+	start, end time.Time
+	endpoints  map[string]*endpoint
+	errors     int
+	unexpected int
+	// the first few problems, to have something to start from
+	examples []string
+}
+
+func newResults() *results {
+	return &results{endpoints: make(map[string]*endpoint)}
+}
+
+func (r *results) add(name string, took time.Duration, err error, ok, want bool, serial string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e := r.endpoints[name]
+	if e == nil {
+		e = &endpoint{}
+		r.endpoints[name] = e
+	}
+	e.latencies = append(e.latencies, took)
+	var problem string
+	switch {
+	case err != nil:
+		e.errors++
+		r.errors++
+		problem = fmt.Sprintf("%s %s: %v", name, serial, err)
+	case ok:
+		e.ok++
+	default:
+		e.denied++
+	}
+	if err == nil && ok != want {
+		r.unexpected++
+		problem = fmt.Sprintf("%s %s: ok %v, want %v", name, serial, ok, want)
+	}
+	if problem != "" && len(r.examples) < 10 {
+		r.examples = append(r.examples, problem)
+	}
+}
+
+// percentile of the sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func (r *results) print(w io.Writer) {
+	took := r.end.Sub(r.start)
+	total := 0
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "endpoint\trequests\tok\tdenied\terrors\terror rate\tp50\tp90\tp99\tmax\t")
+	for _, name := range []string{"key", "verify"} {
+		e := r.endpoints[name]
+		if e == nil {
+			continue
+		}
+		n := len(e.latencies)
+		total += n
+		slices.Sort(e.latencies)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.2f%%\t%s\t%s\t%s\t%s\t\n", name, n, e.ok, e.denied, e.errors,
+			100*float64(e.errors)/float64(n),
+			percentile(e.latencies, 0.5).Round(time.Microsecond),
+			percentile(e.latencies, 0.9).Round(time.Microsecond),
+			percentile(e.latencies, 0.99).Round(time.Microsecond),
+			e.latencies[n-1].Round(time.Microsecond))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d requests in %s, %.1f/s, %d unexpected answers\n", total, took.Round(time.Millisecond), float64(total)/took.Seconds(), r.unexpected)
+	for _, e := range r.examples {
+		fmt.Fprintln(w, "  ", e)
+	}
+}
@@ -0,0 +1,194 @@
+// The simulator plays readers tapping cards against the reader api and
+// reports the latencies and the answers that differ from the expected ones.
+//
+// A simulated working day: -readers readers and -cards cards, every card
+// comes in in the morning, some go out for lunch, everybody leaves in the
+// afternoon; -deny of the taps have a wrong authtoken and -unknown of them
+// are cards the server doesn't know. The day from 06:00 to 20:00 is played
+// in -day. The readers, the people and the cards are made in the db of the
+// server (-db) and deleted at the end.
+//
+//	simulator -url http://localhost:8090 -db database.db -readers 20 -cards 2000 -day 2m
+//
+// Without -url the simulator runs its own server on a temporary db.
+//
+// -replay plays the accessLog of a db as traffic, e.g. of a backup made by
+// the db backup command. The server has to run on a copy of the same db so
+// the api keys and the authtokens match:
+//
+//	simulator -url http://localhost:8090 -replay backup.db -speed 3600
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"server/client"
+	"server/servertest"
+	"server/store"
+	"server/store/sqlite"
+)
+
+var (
+	url         = flag.String("url", "", "address of the server, empty runs a server on a temporary db")
+	dbPath      = flag.String("db", "", "sqlite db of the server at -url, the simulated readers and cards are made in it")
+	readers     = flag.Int("readers", 10, "number of readers")
+	cards       = flag.Int("cards", 200, "number of cards")
+	day         = flag.Duration("day", time.Minute, "real time of the simulated day from 06:00 to 20:00")
+	deny        = flag.Float64("deny", 0.03, "part of the taps with a wrong authtoken")
+	unknown     = flag.Float64("unknown", 0.02, "part of the taps with a card the server doesn't know")
+	readKey     = flag.Bool("key", true, "ask for the read key before the verify, like the readers do")
+	concurrency = flag.Int("concurrency", 64, "most requests in flight")
+	seed        = flag.Uint64("seed", 0, "seed of the tap pattern, 0 is random")
+	replay      = flag.String("replay", "", "db whose accessLog is played instead of a simulated day")
+	speed       = flag.Float64("speed", 60, "replay speed, 60 plays an hour of the log in a minute")
+	keep        = flag.Bool("keep", false, "keep the simulated readers, people and cards in the db")
+)
+
+// tap is one card at one reader, at is the time from the start of the run
+type tap struct {
+	at      time.Duration
+	apiKey  string
+	serial  string
+	token   string
+	granted bool // the expected answer of the verify
+	known   bool // the server knows the card, the key request is ok
+}
+
+func main() {
+	flag.Parse()
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var api *client.Client
+	var s store.Store
+	switch {
+	case *url == "":
+		e, err := servertest.NewEnv()
+		if err != nil {
+			return err
+		}
+		defer e.Close()
+		api, s = e.Client, e.Store
+	case *replay == "" && *dbPath == "":
+		return fmt.Errorf("-db is needed with -url to make the simulated readers and cards")
+	default:
+		api = client.New(*url)
+		api.HTTP = &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}}
+	}
+	var taps []tap
+	var err error
+	if *replay != "" {
+		taps, err = replayTaps(*replay, *speed)
+	} else {
+		if s == nil {
+			db, err := sqlite.Open(*dbPath, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			s = db
+		}
+		var f *fixture
+		f, err = newFixture(ctx, s, *readers, *cards)
+		if f != nil && !*keep {
+			defer f.remove(context.Background(), s)
+		}
+		if err == nil {
+			if *seed == 0 {
+				*seed = rand.Uint64()
+			}
+			fmt.Println("seed", *seed)
+			taps = f.day(rand.New(rand.NewPCG(*seed, *seed)), *day)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d taps in %s\n", len(taps), taps[len(taps)-1].at.Round(time.Second))
+	r := play(ctx, api, taps)
+	r.print(os.Stdout)
+	if r.errors+r.unexpected > 0 {
+		return fmt.Errorf("%d errors, %d unexpected answers", r.errors, r.unexpected)
+	}
+	return nil
+}
+
+// play sends the taps at their time, a tap that is late because every
+// request slot is busy goes out as soon as there is one
+func play(ctx context.Context, api *client.Client, taps []tap) *results {
+	r := newResults()
+	slots := make(chan bool, *concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	r.start = start
+	for _, t := range taps {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(start.Add(t.at))):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		slots <- true
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			send(ctx, api, t, r)
+		}()
+	}
+	wg.Wait()
+	r.end = time.Now()
+	return r
+}
+
+// onCards are the authtokens on the cards, a server with rolling authtokens
+// gives a card a new one on every granted verify
+var onCards = struct {
+	sync.Mutex
+	tokens map[string]string
+}{tokens: make(map[string]string)}
+
+// send is one tap: the read key, then the verify if there was a key
+func send(ctx context.Context, api *client.Client, t tap, r *results) {
+	if *readKey {
+		start := time.Now()
+		ans, err := api.GetKey(ctx, client.KeyRequest{ApiKey: t.apiKey, SerialNumber: t.serial})
+		r.add("key", time.Since(start), err, ans.Ok, t.known, t.serial)
+		if err != nil || !ans.Ok {
+			return
+		}
+	}
+	if t.granted {
+		onCards.Lock()
+		if token, ok := onCards.tokens[t.serial]; ok {
+			t.token = token
+		}
+		onCards.Unlock()
+	}
+	start := time.Now()
+	ans, err := api.Verify(ctx, client.VerifyRequest{ApiKey: t.apiKey, SerialNumber: t.serial, Authtoken: t.token})
+	r.add("verify", time.Since(start), err, ans.Ok, t.granted, t.serial)
+	if ans.Authtoken != "" {
+		onCards.Lock()
+		onCards.tokens[t.serial] = ans.Authtoken
+		onCards.Unlock()
+	}
+}